@@ -2,15 +2,34 @@ package main
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/counters"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/cryptohelpers"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/grpcapi"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/middleware"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	pb "github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/proto"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
 	"github.com/go-resty/resty/v2"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestSendMetricJSON(t *testing.T) {
@@ -88,7 +107,7 @@ func TestSendMetricJSON(t *testing.T) {
 		Client:    client,
 		ServerURL: ts.URL,
 	}
-	err := agent.sendMetricJSON(expectedMetric)
+	err := agent.sendMetricJSON(context.Background(), expectedMetric)
 
 	// Проверяем, что ошибок не было
 	assert.NoError(t, err)
@@ -104,7 +123,675 @@ func TestCollectRuntimeMetrics(t *testing.T) {
 		assert.True(t, ok, "Expected metric %s not found", key)
 	}
 
-	assert.GreaterOrEqual(t, agent.RandomValue, 0.0)
-	assert.LessOrEqual(t, agent.RandomValue, 1.0)
 	assert.GreaterOrEqual(t, agent.Metrics["NumGC"], 0.0)
 }
+
+func TestPollCountReport(t *testing.T) {
+	agent := NewAgent("http://localhost")
+	for i := 0; i < 3; i++ {
+		agent.collectMetrics()
+	}
+	assert.Equal(t, int64(3), agent.pollCount.report())
+	assert.Equal(t, int64(0), agent.pollCount.report())
+	agent.collectMetrics()
+	agent.collectMetrics()
+	assert.Equal(t, int64(2), agent.pollCount.report())
+
+	// в режиме cumulative отправляется итог с запуска
+	flagCounterMode = counters.ModeCumulative
+	defer func() { flagCounterMode = counters.ModeDelta }()
+	agent.collectMetrics()
+	assert.Equal(t, int64(6), agent.pollCount.report())
+	assert.Equal(t, int64(6), agent.pollCount.report())
+}
+
+func TestNewCollectors(t *testing.T) {
+	a := NewAgent("http://localhost")
+	cs, err := newCollectors(a, defaultCollectors, 2*time.Second)
+	assert.NoError(t, err)
+	got := map[string]time.Duration{}
+	for _, c := range cs {
+		got[c.Name()] = c.Interval()
+	}
+	assert.Equal(t, map[string]time.Duration{
+		"runtime": 2 * time.Second, "random": 2 * time.Second, "system": 5 * time.Second,
+		"disk": 5 * time.Second, "net": 5 * time.Second, "load": 5 * time.Second,
+		"swap": 5 * time.Second, "processes": 5 * time.Second,
+	}, got)
+
+	// не перечисленные выключены, интервал задаётся после двоеточия
+	cs, err = newCollectors(a, "system:30s, runtime", time.Second)
+	assert.NoError(t, err)
+	if assert.Len(t, cs, 2) {
+		assert.Equal(t, "system", cs[0].Name())
+		assert.Equal(t, 30*time.Second, cs[0].Interval())
+		assert.Equal(t, time.Second, cs[1].Interval())
+	}
+
+	for _, spec := range []string{"unknown", "runtime,runtime", "system:0s", "system:soon"} {
+		_, err := newCollectors(a, spec, time.Second)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestOSCounters(t *testing.T) {
+	var o osCounters
+	eth0 := map[string]string{"interface": "eth0"}
+	assert.Equal(t, int64(0), o.observe("NetBytesRecv", eth0, 1000)) // точка отсчёта, а не итог с загрузки
+	assert.Equal(t, int64(0), o.observe("NetBytesRecv", nil, 7))     // другая серия
+	assert.Equal(t, int64(50), o.observe("NetBytesRecv", eth0, 1050))
+	assert.Equal(t, int64(0), o.observe("NetBytesRecv", eth0, 1050))
+	assert.Equal(t, int64(20), o.observe("NetBytesRecv", eth0, 20)) // счётчик ядра сброшен
+
+	// в режиме cumulative — итог с запуска агента
+	flagCounterMode = counters.ModeCumulative
+	defer func() { flagCounterMode = counters.ModeDelta }()
+	assert.Equal(t, int64(75), o.observe("NetBytesRecv", eth0, 25))
+}
+
+func TestHostCollectors(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("host collectors are checked on linux")
+	}
+	ctx := context.Background()
+	types := func(metrics []models.Metrics) map[string]string {
+		res := make(map[string]string)
+		for _, m := range metrics {
+			res[m.ID] = m.MType
+		}
+		return res
+	}
+
+	disk := &diskCollector{every: time.Second, mounts: []string{"/"}}
+	metrics, err := disk.Collect(ctx)
+	assert.NoError(t, err)
+	got := types(metrics)
+	assert.Equal(t, models.Gauge, got["DiskUsed"])
+	for _, m := range metrics {
+		if m.ID == "DiskUsed" {
+			assert.Equal(t, map[string]string{"mount": "/"}, m.Labels)
+		}
+	}
+	_, err = (&diskCollector{mounts: []string{"/no/such/mount"}}).Collect(ctx)
+	assert.Error(t, err)
+
+	nc := &netCollector{every: time.Second, interfaces: []string{"lo"}}
+	_, err = nc.Collect(ctx)
+	assert.NoError(t, err)
+	metrics, err = nc.Collect(ctx)
+	assert.NoError(t, err)
+	got = types(metrics)
+	for _, id := range []string{"NetBytesSent", "NetBytesRecv", "NetPacketsRecv", "NetErrorsIn", "NetDropsOut"} {
+		assert.Equal(t, models.Counter, got[id], id)
+	}
+	_, err = (&netCollector{interfaces: []string{"no-such-if0"}}).Collect(ctx)
+	assert.Error(t, err)
+
+	metrics, err = loadCollector{}.Collect(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, models.Gauge, types(metrics)["LoadAverage1"])
+
+	metrics, err = (&swapCollector{}).Collect(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, models.Gauge, types(metrics)["SwapUsed"])
+	assert.Equal(t, models.Counter, types(metrics)["SwapInBytes"])
+
+	metrics, err = (&processCollector{}).Collect(ctx)
+	assert.NoError(t, err)
+	got = types(metrics)
+	assert.Equal(t, models.Gauge, got["ProcessesTotal"])
+	assert.Equal(t, models.Counter, got["ProcessesCreated"])
+	assert.Equal(t, models.Gauge, got["OpenFileHandles"])
+	assert.Equal(t, models.Gauge, got["OpenFileHandlesMax"])
+	assert.Equal(t, models.Gauge, got["AgentOpenFDs"])
+
+	// открытые файлы считаются по всей системе из file-nr, а не по процессу агента
+	fileNr := filepath.Join(t.TempDir(), "file-nr")
+	assert.NoError(t, os.WriteFile(fileNr, []byte("3072\t72\t100000\n"), 0o600))
+	oldPath := fileNrPath
+	fileNrPath = fileNr
+	defer func() { fileNrPath = oldPath }()
+	open, limit, err := hostOpenFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3000), open)
+	assert.Equal(t, uint64(100000), limit)
+}
+
+// failingCollector возвращает одну метрику и ошибку
+type failingCollector struct{}
+
+func (failingCollector) Name() string            { return "failing" }
+func (failingCollector) Interval() time.Duration { return 5 * time.Millisecond }
+func (failingCollector) Collect(context.Context) ([]models.Metrics, error) {
+	v := 1.0
+	return []models.Metrics{{ID: "Partial", MType: models.Gauge, Value: &v}}, errors.New("boom")
+}
+
+func TestRunCollectors(t *testing.T) {
+	a := NewAgent("http://localhost")
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan models.Metrics, 1024)
+	done := make(chan struct{})
+	go func() {
+		runCollectors(ctx, []Collector{
+			&runtimeCollector{agent: a, every: 5 * time.Millisecond},
+			randomCollector{every: 5 * time.Millisecond},
+			failingCollector{},
+		}, out)
+		close(done)
+	}()
+
+	// метрики сливаются так же, как в батчере
+	agg := newAggregator()
+	seen := func(typ, key string) (models.Metrics, bool) {
+		m, ok := agg.metrics[typ+":"+key]
+		return m, ok
+	}
+	assert.Eventually(t, func() bool {
+		for {
+			select {
+			case m := <-out:
+				agg.add(m)
+				continue
+			default:
+			}
+			break
+		}
+		m, ok := seen(models.Counter, `CollectorErrors{collector="failing"}`)
+		return ok && *m.Delta >= 2
+	}, 2*time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	for _, key := range []string{"Alloc", "RandomValue", "Partial", `CollectorDuration{collector="runtime"}`} {
+		_, ok := seen(models.Gauge, key)
+		assert.True(t, ok, key)
+	}
+	_, ok := seen(models.Histogram, "GCPauseDuration")
+	assert.True(t, ok)
+	pc, ok := seen(models.Counter, "PollCount")
+	if assert.True(t, ok) {
+		assert.GreaterOrEqual(t, *pc.Delta, int64(1))
+	}
+	errs, _ := seen(models.Counter, `CollectorErrors{collector="runtime"}`)
+	assert.Equal(t, int64(0), *errs.Delta)
+}
+
+func TestCollectGCPauses(t *testing.T) {
+	agent := NewAgent("http://localhost")
+	runtime.GC()
+	agent.collectMetrics()
+
+	h := agent.takeGCPauses()
+	assert.NoError(t, h.Validate())
+	assert.GreaterOrEqual(t, h.Count(), uint64(1))
+
+	// после отправки гистограмма начинается заново, повторно паузы не учитываются
+	agent.collectMetrics()
+	next := agent.takeGCPauses()
+	assert.Equal(t, h.Bounds, next.Bounds)
+	assert.LessOrEqual(t, next.Count(), uint64(1))
+}
+
+func TestParseBuckets(t *testing.T) {
+	bounds, err := parseBuckets("0.001, 0.01,0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{0.001, 0.01, 0.1}, bounds)
+
+	_, err = parseBuckets("0.1,0.01")
+	assert.Error(t, err)
+	_, err = parseBuckets("abc")
+	assert.Error(t, err)
+}
+
+func TestSignRequest(t *testing.T) {
+	old := flagKey
+	flagKey = "secret"
+	defer func() { flagKey = old }()
+
+	payload := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	first := resty.New().R()
+	second := resty.New().R()
+	signRequest(first, payload)
+	signRequest(second, payload)
+
+	ts, err := strconv.ParseInt(first.Header.Get(cryptohelpers.HeaderTimestamp), 10, 64)
+	assert.NoError(t, err)
+	nonce := first.Header.Get(cryptohelpers.HeaderNonce)
+	assert.True(t, cryptohelpers.CompareRequest(payload, "secret", ts, nonce, first.Header.Get("HashSHA256")))
+	assert.NotEqual(t, nonce, second.Header.Get(cryptohelpers.HeaderNonce))
+}
+
+func TestGRPCSender(t *testing.T) {
+	oldKey := flagKey
+	flagKey = "secret"
+	defer func() { flagKey = oldKey }()
+
+	storage := repository.NewMemStorage()
+	guard := &middleware.GRPCGuard{
+		Key:    "secret",
+		Mode:   middleware.SignStrict,
+		Replay: middleware.NewReplayGuard(time.Minute),
+		Signed: map[string]bool{grpcapi.MethodUpdate: true, grpcapi.MethodUpdateBatch: true},
+	}
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(guard.Unary()))
+	pb.RegisterMetricsServer(srv, grpcapi.NewServer(storage))
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+
+	sender, err := newGRPCSender("http://" + lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	a := NewAgent("http://" + lis.Addr().String())
+	a.GRPC = sender
+
+	delta, value := int64(3), 1.5
+	assert.NoError(t, a.sendMetricJSON(context.Background(), models.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}))
+	assert.NoError(t, sender.updateBatch(context.Background(), cryptohelpers.NewNonce(), []models.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "Alloc", MType: "gauge", Value: &value},
+	}, httpDelays))
+
+	v, _ := storage.GetCounter(context.Background(), "PollCount")
+	assert.Equal(t, int64(6), v)
+	g, _ := storage.GetGauge(context.Background(), "Alloc")
+	assert.Equal(t, 1.5, g)
+
+	// с другим ключом сервер отклоняет вызов без ретраев
+	flagKey = "other"
+	err = sender.update(context.Background(), models.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestDrainJobs(t *testing.T) {
+	var received atomic.Int64
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Test-Block") != "" {
+			<-block
+		}
+		var batch []models.Metrics
+		gr, err := gzip.NewReader(r.Body)
+		if assert.NoError(t, err) {
+			assert.NoError(t, json.NewDecoder(gr).Decode(&batch))
+		}
+		received.Add(int64(len(batch)))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	gauge := func(id string) models.Metrics {
+		v := 1.0
+		return models.Metrics{ID: id, MType: "gauge", Value: &v}
+	}
+	// start запускает батчер и воркеров так же, как main
+	start := func(b *Batcher, jobs chan models.Metrics) (chan metricBatch, *sync.WaitGroup, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		batches := make(chan metricBatch, 1)
+		workers := startWorkers(ctx, 2, batches, b)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			b.Run(ctx, jobs, batches)
+		}()
+		return batches, workers, cancel
+	}
+
+	t.Run("queue is flushed", func(t *testing.T) {
+		received.Store(0)
+		b := NewBatcher(srv.URL+"/updates", time.Hour, 2, 0)
+		jobs := make(chan models.Metrics, 16)
+		for i := 0; i < 5; i++ {
+			jobs <- gauge("G" + strconv.Itoa(i))
+		}
+
+		batches, workers, cancel := start(b, jobs)
+		defer cancel()
+		var producers sync.WaitGroup
+		flushed, spooled, dropped := drainJobs(jobs, batches, &producers, workers, cancel, b, 5*time.Second)
+		assert.Equal(t, int64(5), flushed)
+		assert.Equal(t, int64(0), spooled)
+		assert.Equal(t, int64(0), dropped)
+		assert.Equal(t, int64(5), received.Load())
+	})
+
+	t.Run("deadline spools the rest", func(t *testing.T) {
+		b := NewBatcher(srv.URL+"/updates", time.Hour, 1, 0)
+		b.client.SetHeader("X-Test-Block", "1") // сервер не отвечает до конца теста
+		spool, err := openDiskQueue(t.TempDir(), 0)
+		assert.NoError(t, err)
+		b.backlog = spool
+		jobs := make(chan models.Metrics, 16)
+		for i := 0; i < 3; i++ {
+			jobs <- gauge("G" + strconv.Itoa(i))
+		}
+
+		batches, workers, cancel := start(b, jobs)
+		defer cancel()
+		var producers sync.WaitGroup
+		begin := time.Now()
+		flushed, spooled, dropped := drainJobs(jobs, batches, &producers, workers, cancel, b, 100*time.Millisecond)
+		assert.Less(t, time.Since(begin), 2*time.Second)
+		assert.Equal(t, int64(0), flushed)
+		assert.Equal(t, int64(3), spooled)
+		assert.Equal(t, int64(0), dropped)
+		assert.Equal(t, 3, spool.len())
+	})
+}
+
+func TestBatcherRun(t *testing.T) {
+	gauge := func(id string) models.Metrics {
+		v := 1.0
+		return models.Metrics{ID: id, MType: "gauge", Value: &v}
+	}
+	collect := func(b *Batcher, n int) [][]models.Metrics {
+		in := make(chan models.Metrics, n)
+		for i := 0; i < n; i++ {
+			in <- gauge("G" + strconv.Itoa(i))
+		}
+		close(in)
+		out := make(chan metricBatch, n)
+		b.Run(context.Background(), in, out)
+		var res [][]models.Metrics
+		keys := make(map[string]bool)
+		for batch := range out {
+			res = append(res, batch.Metrics)
+			keys[batch.Key] = true
+		}
+		assert.Len(t, keys, len(res), "each batch has its own idempotency key")
+		return res
+	}
+
+	// по числу метрик
+	batches := collect(NewBatcher("", time.Hour, 2, 0), 5)
+	assert.Len(t, batches, 3)
+	assert.Len(t, batches[2], 1)
+
+	// по размеру JSON: каждая метрика ~40 байт
+	one, err := json.Marshal(gauge("G0"))
+	assert.NoError(t, err)
+	batches = collect(NewBatcher("", time.Hour, 0, 2+2*(len(one)+1)), 5)
+	assert.Len(t, batches, 3)
+	for _, batch := range batches {
+		payload, err := json.Marshal(batch)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(payload), 2+2*(len(one)+1))
+	}
+}
+
+func TestDiskQueue(t *testing.T) {
+	dir := t.TempDir()
+	batch := func(id string) metricBatch {
+		v := 1.0
+		return newMetricBatch([]models.Metrics{{ID: id, MType: "gauge", Value: &v}})
+	}
+
+	q, err := openDiskQueue(dir, 0)
+	assert.NoError(t, err)
+	first := batch("A")
+	_, err = q.push(first)
+	assert.NoError(t, err)
+	_, err = q.push(batch("B"))
+	assert.NoError(t, err)
+
+	// очередь переживает перезапуск и отдаёт батчи по порядку, с прежним ключом идемпотентности
+	q, err = openDiskQueue(dir, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, q.len())
+	got, seq, ok := q.peek()
+	assert.True(t, ok)
+	assert.Equal(t, first.Key, got.Key)
+	assert.Equal(t, "A", got.Metrics[0].ID)
+	q.remove(seq)
+	_, err = q.push(batch("C"))
+	assert.NoError(t, err)
+	got, _, _ = q.peek()
+	assert.Equal(t, "B", got.Metrics[0].ID)
+
+	// сверх maxBytes вытесняются самые старые батчи
+	data, err := json.Marshal(batch("D"))
+	assert.NoError(t, err)
+	small, err := openDiskQueue(t.TempDir(), int64(2*len(data)))
+	assert.NoError(t, err)
+	var evicted int64
+	for _, id := range []string{"D", "E", "F"} {
+		n, err := small.push(batch(id))
+		assert.NoError(t, err)
+		evicted += n
+	}
+	assert.Equal(t, 2, small.len())
+	assert.Equal(t, int64(1), evicted, "вытесненный батч D должен попасть в потерянные")
+	got, _, _ = small.peek()
+	assert.Equal(t, "E", got.Metrics[0].ID)
+	_, err = small.push(newMetricBatch(make([]models.Metrics, 10)))
+	assert.ErrorIs(t, err, errBatchTooLarge)
+
+	// батчи, оставшиеся с прошлого запуска, при вытеснении тоже считаются
+	restored, err := openDiskQueue(small.dir, small.maxBytes)
+	assert.NoError(t, err)
+	n, err := restored.push(batch("G"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	// Batcher записывает вытесненные метрики в failed
+	b := NewBatcher("http://127.0.0.1:0/updates/", time.Second, 0, 0)
+	b.backlog = restored
+	b.stash(batch("H"))
+	assert.Equal(t, int64(1), b.failed.Load())
+	assert.Equal(t, int64(1), b.spooled.Load())
+}
+
+func TestBatcherSpoolReplay(t *testing.T) {
+	oldDelays := httpDelays
+	httpDelays = nil
+	defer func() { httpDelays = oldDelays }()
+
+	var down atomic.Bool
+	down.Store(true)
+	storage := repository.NewMemStorage()
+	var keys []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get(idempotencyKeyHeader))
+		var batch []models.Metrics
+		gr, err := gzip.NewReader(r.Body)
+		if assert.NoError(t, err) {
+			assert.NoError(t, json.NewDecoder(gr).Decode(&batch))
+		}
+		assert.NoError(t, storage.UpdateBatch(r.Context(), batch))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	b := NewBatcher(srv.URL+"/updates", time.Hour, 0, 0)
+	spool, err := openDiskQueue(t.TempDir(), 0)
+	assert.NoError(t, err)
+	b.backlog = spool
+
+	gauge := func(v float64) metricBatch {
+		return newMetricBatch([]models.Metrics{{ID: "Alloc", MType: "gauge", Value: &v}})
+	}
+	ctx := context.Background()
+
+	// сервер недоступен: батчи откладываются на диск
+	first := gauge(1)
+	b.deliver(ctx, first)
+	b.replay(ctx)
+	assert.Equal(t, 1, spool.len())
+
+	// сервер поднялся, но новый батч встаёт в очередь за отложенными, чтобы не обогнать их
+	down.Store(false)
+	b.deliver(ctx, gauge(2))
+	assert.Equal(t, 2, spool.len())
+
+	b.replay(ctx)
+	assert.Equal(t, 0, spool.len())
+	v, _ := storage.GetGauge(ctx, "Alloc")
+	assert.Equal(t, 2.0, v)
+	assert.Equal(t, first.Key, keys[0])
+	assert.Equal(t, int64(2), b.sent.Load())
+	assert.Equal(t, int64(2), b.spooled.Load())
+	assert.Equal(t, int64(0), b.failed.Load())
+}
+
+func TestAggregator(t *testing.T) {
+	a := newAggregator()
+	delta := func(v int64) *int64 { return &v }
+	value := func(v float64) *float64 { return &v }
+
+	a.add(models.Metrics{ID: "Alloc", MType: "gauge", Value: value(1)})
+	a.add(models.Metrics{ID: "PollCount", MType: "counter", Delta: delta(2)})
+	a.add(models.Metrics{ID: "Alloc", MType: "gauge", Value: value(3)})
+	a.add(models.Metrics{ID: "PollCount", MType: "counter", Delta: delta(5)})
+	a.add(models.Metrics{ID: "Alloc", MType: "gauge", Value: value(4), Labels: map[string]string{"host": "a"}})
+	h := models.NewHistogramData([]float64{1})
+	h.Observe(0.5)
+	a.add(models.Metrics{ID: "H", MType: models.Histogram, Histogram: h})
+	a.add(models.Metrics{ID: "H", MType: models.Histogram, Histogram: h})
+
+	got := a.take()
+	assert.Len(t, got, 4)
+	assert.Equal(t, 3.0, *got[0].Value)
+	assert.Equal(t, int64(7), *got[1].Delta)
+	assert.Equal(t, 4.0, *got[2].Value)
+	assert.Equal(t, uint64(2), got[3].Histogram.Count())
+	assert.Equal(t, uint64(1), h.Count(), "input is not modified")
+	assert.Equal(t, 0, a.len())
+}
+
+func TestBatcherOutage(t *testing.T) {
+	oldDelays := httpDelays
+	httpDelays = nil
+	defer func() { httpDelays = oldDelays }()
+
+	var down atomic.Bool
+	down.Store(true)
+	storage := repository.NewMemStorage()
+	srv := httptest.NewServer(handlerForUpdates(t, storage, &down))
+	defer srv.Close()
+
+	b := NewBatcher(srv.URL+"/updates", 5*time.Millisecond, 0, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jobs := make(chan models.Metrics)
+	batches := make(chan metricBatch, 1)
+	workers := startWorkers(ctx, 1, batches, b)
+	go b.Run(ctx, jobs, batches)
+	go b.runReplay(ctx, 5*time.Millisecond)
+
+	report := func(i int) {
+		v, d := float64(i), int64(1)
+		jobs <- models.Metrics{ID: "Alloc", MType: "gauge", Value: &v}
+		jobs <- models.Metrics{ID: "PollCount", MType: "counter", Delta: &d}
+	}
+
+	// пока сервер лежит, очередь не растёт с каждым отчётом: копятся только последние значения
+	for i := 1; i <= 200; i++ {
+		report(i)
+		if i%20 == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.LessOrEqual(t, b.backlog.len(), 2)
+	}
+
+	down.Store(false)
+	assert.Eventually(t, func() bool {
+		c, _ := storage.GetCounter(context.Background(), "PollCount")
+		return c == 200
+	}, 2*time.Second, 5*time.Millisecond)
+	g, _ := storage.GetGauge(context.Background(), "Alloc")
+	assert.Equal(t, 200.0, g)
+	assert.Equal(t, int64(0), b.failed.Load())
+	cancel()
+	workers.Wait()
+}
+
+func TestBatcherCumulativeCounters(t *testing.T) {
+	oldDelays, oldStarted := httpDelays, agentStarted
+	httpDelays = nil
+	flagCounterMode, flagInstance = counters.ModeCumulative, "agent-1"
+	defer func() {
+		httpDelays, agentStarted = oldDelays, oldStarted
+		flagCounterMode, flagInstance = counters.ModeDelta, ""
+	}()
+
+	var down atomic.Bool
+	down.Store(true)
+	storage := repository.NewMemStorage()
+	tracker := counters.NewTracker(time.Hour)
+	srv := httptest.NewServer(middleware.CumulativeCounters(tracker)(handlerForUpdates(t, storage, &down)))
+	defer srv.Close()
+
+	counter := func() int64 {
+		c, _ := storage.GetCounter(context.Background(), "PollCount")
+		return c
+	}
+	run := func(from, to, want int64) {
+		b := NewBatcher(srv.URL+"/updates", 5*time.Millisecond, 0, 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		jobs := make(chan models.Metrics)
+		batches := make(chan metricBatch, 1)
+		workers := startWorkers(ctx, 1, batches, b)
+		go b.Run(ctx, jobs, batches)
+		go b.runReplay(ctx, 5*time.Millisecond)
+
+		for total := from; total <= to; total++ {
+			pc := total
+			jobs <- models.Metrics{ID: "PollCount", MType: "counter", Delta: &pc}
+			if total%20 == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		down.Store(false)
+		assert.Eventually(t, func() bool { return counter() >= want }, 2*time.Second, 5*time.Millisecond)
+		// повторы итогов не прибавляются
+		time.Sleep(20 * time.Millisecond)
+		assert.Equal(t, want, counter())
+		cancel()
+		workers.Wait()
+	}
+
+	// агент запущен после сервера: итоги, накопленные за простой, учитываются ровно один раз
+	agentStarted = time.Now()
+	run(1, 200, 200)
+
+	// перезапуск агента: итог снова считается с нуля
+	down.Store(true)
+	agentStarted = time.Now()
+	run(1, 50, 250)
+}
+
+// handlerForUpdates — /updates поверх storage; пока down, отвечает 503
+func handlerForUpdates(t *testing.T, storage *repository.MemStorage, down *atomic.Bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []models.Metrics
+		gr, err := gzip.NewReader(r.Body)
+		if assert.NoError(t, err) {
+			assert.NoError(t, json.NewDecoder(gr).Decode(&batch))
+		}
+		batch, commit := counters.ToDeltas(r.Context(), batch)
+		err = storage.UpdateBatch(r.Context(), batch)
+		commit(err == nil)
+		assert.NoError(t, err)
+		w.WriteHeader(http.StatusOK)
+	}
+}
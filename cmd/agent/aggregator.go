@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+
+	"go.uber.org/zap"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// aggregator копит метрики между отправками по одной записи на серию: у gauge остаётся
+// последнее значение, приращения counter складываются (итоги в режиме cumulative — заменяются),
+// гистограммы сливаются.
+// Поэтому объём ожидающих отправки данных ограничен числом серий, а не длительностью простоя сервера.
+// Не потокобезопасен: им владеет горутина Batcher.Run.
+type aggregator struct {
+	keys    []string // порядок появления серий, чтобы батчи были стабильны
+	metrics map[string]models.Metrics
+}
+
+func newAggregator() *aggregator {
+	return &aggregator{metrics: make(map[string]models.Metrics)}
+}
+
+// add учитывает метрику; значения копируются, m можно переиспользовать
+func (a *aggregator) add(m models.Metrics) {
+	key := m.MType + ":" + m.Key()
+	cur, ok := a.metrics[key]
+	if !ok {
+		a.keys = append(a.keys, key)
+		a.metrics[key] = cloneMetric(m)
+		return
+	}
+	switch m.MType {
+	case models.Counter:
+		if m.Delta == nil {
+			return
+		}
+		if cumulativeCounters() {
+			cur = cloneMetric(m)
+			break
+		}
+		sum := *m.Delta
+		if cur.Delta != nil {
+			sum += *cur.Delta
+		}
+		cur.Delta = &sum
+	case models.Histogram:
+		if m.Histogram == nil {
+			return
+		}
+		// при смене границ бакетов накопленное не слить — остаются новые наблюдения
+		if cur.Histogram == nil || cur.Histogram.Merge(m.Histogram) != nil {
+			cur.Histogram = m.Histogram.Clone()
+		}
+	default:
+		cur = cloneMetric(m)
+	}
+	a.metrics[key] = cur
+}
+
+func (a *aggregator) len() int {
+	return len(a.keys)
+}
+
+// take возвращает накопленные метрики и начинает копить заново
+func (a *aggregator) take() []models.Metrics {
+	res := make([]models.Metrics, 0, len(a.keys))
+	for _, key := range a.keys {
+		res = append(res, a.metrics[key])
+	}
+	a.keys = nil
+	a.metrics = make(map[string]models.Metrics)
+	return res
+}
+
+func cloneMetric(m models.Metrics) models.Metrics {
+	if m.Delta != nil {
+		d := *m.Delta
+		m.Delta = &d
+	}
+	if m.Value != nil {
+		v := *m.Value
+		m.Value = &v
+	}
+	if m.Histogram != nil {
+		m.Histogram = m.Histogram.Clone()
+	}
+	return m
+}
+
+// splitBatch режет метрики на батчи не больше maxSize штук и maxBytes байт JSON (0 — без ограничения).
+// Метрика, которая одна больше maxBytes, уходит отдельным батчем; не кодируемая в JSON — выбрасывается.
+func splitBatch(metrics []models.Metrics, maxSize, maxBytes int) [][]models.Metrics {
+	var res [][]models.Metrics
+	var cur []models.Metrics
+	size := 2 // скобки JSON-массива
+	for _, m := range metrics {
+		data, err := json.Marshal(m)
+		if err != nil {
+			logger.Log.Error("marshal metric", zap.String("id", m.ID), zap.Error(err))
+			continue
+		}
+		n := len(data) + 1
+		if len(cur) > 0 && ((maxSize > 0 && len(cur) >= maxSize) || (maxBytes > 0 && size+n > maxBytes)) {
+			res = append(res, cur)
+			cur, size = nil, 2
+		}
+		cur = append(cur, m)
+		size += n
+	}
+	if len(cur) > 0 {
+		res = append(res, cur)
+	}
+	return res
+}
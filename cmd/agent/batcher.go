@@ -6,111 +6,270 @@ import (
 	"compress/gzip"
 	"encoding/json"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
 	"github.com/go-resty/resty/v2"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"context"
 	"errors"
 	"fmt"
-	"net"
 
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/cryptohelpers"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/retry"
 )
 
+// errRejected — батч отвергнут сервером (4xx) или не кодируется: повтор, в том числе из очереди на диске, не поможет
+var errRejected = errors.New("rejected by server")
+
+// metricBatch — батч на отправку. Key — ключ идемпотентности, общий для всех попыток,
+// включая повтор из очереди на диске: сервер не применит батч дважды.
+// Started — в режиме cumulative время запуска агента, с которого считаются итоги счётчиков батча;
+// хранится в батче, чтобы батч прошлого запуска из очереди не выдал себя за текущий.
+type metricBatch struct {
+	Key     string           `json:"key"`
+	Metrics []models.Metrics `json:"metrics"`
+	Started string           `json:"started,omitempty"`
+}
+
+func newMetricBatch(metrics []models.Metrics) metricBatch {
+	batch := metricBatch{Key: cryptohelpers.NewNonce(), Metrics: metrics}
+	if cumulativeCounters() {
+		batch.Started = agentStarted.Format(time.RFC3339Nano)
+	}
+	return batch
+}
+
+// Batcher копит метрики (см. aggregator), режет их на батчи и отправляет на /updates (или по gRPC).
+// Батчи, которые не удалось отправить, откладываются в очередь и повторяются по порядку (см. runReplay);
+// пока очередь не разобрана, новые батчи не формируются, а метрики продолжают копиться.
 type Batcher struct {
-	in       chan models.Metrics
 	flushInt time.Duration
-	maxSize  int
+	maxSize  int // метрик в батче, 0 — без ограничения
+	maxBytes int // байт JSON в батче, 0 — без ограничения
 	client   *resty.Client
 	endpoint string
+	grpc     *grpcSender // если задан, батчи уходят по gRPC (UpdateBatch), а не на endpoint
+	backlog  batchQueue  // отложенные батчи: на диске (-queue-dir) или в памяти
+
+	sent    atomic.Int64 // метрик доставлено
+	spooled atomic.Int64 // метрик отложено в очередь (в том числе уже доставленных оттуда)
+	failed  atomic.Int64 // метрик потеряно
 }
 
-func NewBatcher(endpoint string, flushInt time.Duration, maxSize int) *Batcher {
-	c := resty.New().
+func NewBatcher(endpoint string, flushInt time.Duration, maxSize, maxBytes int) *Batcher {
+	c := newHTTPClient().
 		SetHeader("Content-Type", "application/json")
 	return &Batcher{
-		in:       make(chan models.Metrics, 1024),
 		flushInt: flushInt,
 		maxSize:  maxSize,
+		maxBytes: maxBytes,
 		client:   c,
 		endpoint: endpoint,
+		backlog:  &memQueue{},
 	}
 }
 
-func (b *Batcher) Add(m models.Metrics) {
-	// не блокируем продюсеров — канал с буфером; при переполнении лучше дропнуть/логировать
-	select {
-	case b.in <- m:
-	default:
-		logger.Log.Warn("batch channel full, metric dropped", zap.String("id", m.ID))
-	}
-}
-
-func (b *Batcher) Run() {
+// Run копит метрики из in и раз в flushInt (или как только набралось maxSize серий) передаёт их
+// в out батчами не больше maxSize метрик и maxBytes байт. Пока есть отложенные батчи или воркеры заняты,
+// метрики копятся дальше. Когда in закрыт, отдаёт остаток и закрывает out;
+// отмена ctx откладывает остаток в очередь.
+func (b *Batcher) Run(ctx context.Context, in <-chan models.Metrics, out chan<- metricBatch) {
+	defer close(out)
 	t := time.NewTicker(b.flushInt)
 	defer t.Stop()
 
-	buf := make([]models.Metrics, 0, b.maxSize)
+	agg := newAggregator()
 
-	flush := func() {
-		if len(buf) == 0 {
-			return
-		}
-		payload, err := json.Marshal(buf)
-		if err != nil {
-			logger.Log.Error("marshal batch", zap.Error(err))
-			buf = buf[:0]
+	// final — остановка: остаток отдаётся, даже если придётся ждать воркеров
+	flush := func(final bool) {
+		if agg.len() == 0 {
 			return
 		}
-		var gz bytes.Buffer
-		zw := gzip.NewWriter(&gz)
-		if _, err := zw.Write(payload); err != nil {
-			logger.Log.Error("gzip write", zap.Error(err))
-			buf = buf[:0]
-			_ = zw.Close()
+		// сервер, скорее всего, недоступен: не плодим батчи, а копим последние значения
+		if !final && b.backlog.len() > 0 {
 			return
 		}
-		_ = zw.Close()
-
-		// Отправляем пакет метрик на сервер
-		if err := b.postJSONWithRetry(context.Background(), b.endpoint, gz.Bytes()); err != nil {
-			logger.Log.Error("batch post error", zap.Error(err))
-			return
+		chunks := splitBatch(agg.take(), b.maxSize, b.maxBytes)
+		for i, chunk := range chunks {
+			batch := newMetricBatch(chunk)
+			if final {
+				select {
+				case out <- batch:
+				case <-ctx.Done():
+					b.stash(batch)
+				}
+				continue
+			}
+			select {
+			case out <- batch:
+			default:
+				// воркеры заняты: неотправленное возвращается к накопленному
+				for _, rest := range chunks[i:] {
+					for _, m := range rest {
+						agg.add(m)
+					}
+				}
+				return
+			}
 		}
-		buf = buf[:0]
 	}
 
 	for {
 		select {
-		case m, ok := <-b.in:
+		case <-ctx.Done():
+			if agg.len() > 0 {
+				b.stash(newMetricBatch(agg.take()))
+			}
+			return
+		case m, ok := <-in:
 			if !ok {
-				flush()
+				flush(true)
 				return
 			}
-			buf = append(buf, m)
-			if b.maxSize > 0 && len(buf) >= b.maxSize {
-				flush()
+			agg.add(m)
+			if b.maxSize > 0 && agg.len() >= b.maxSize {
+				flush(false)
 			}
 		case <-t.C:
-			flush()
+			flush(false)
 		}
 	}
 }
 
+// deliver отправляет батч с ретраями. Если сервер так и не ответил, батч откладывается в очередь;
+// туда же сразу идут новые батчи, пока очередь не разобрана, чтобы сохранить порядок.
+func (b *Batcher) deliver(ctx context.Context, batch metricBatch) {
+	if b.backlog.len() > 0 {
+		b.stash(batch)
+		return
+	}
+	err := b.send(ctx, batch, httpDelays)
+	switch {
+	case err == nil:
+		b.sent.Add(int64(len(batch.Metrics)))
+	case isPermanent(err):
+		b.failed.Add(int64(len(batch.Metrics)))
+		logger.Log.Error("batch rejected", zap.Int("size", len(batch.Metrics)), zap.Error(err))
+	default:
+		logger.Log.Warn("batch not delivered", zap.Int("size", len(batch.Metrics)), zap.Error(err))
+		b.stash(batch)
+	}
+}
+
+// stash откладывает батч в очередь; метрики вытесненных из неё батчей считаются потерянными
+func (b *Batcher) stash(batch metricBatch) {
+	n := int64(len(batch.Metrics))
+	evicted, err := b.backlog.push(batch)
+	b.failed.Add(evicted)
+	if err != nil {
+		logger.Log.Error("cannot queue batch on disk", zap.Int("size", len(batch.Metrics)), zap.Error(err))
+		b.failed.Add(n)
+		return
+	}
+	b.spooled.Add(n)
+}
+
+// runReplay раз в every отправляет отложенные батчи, пока не отменён ctx
+func (b *Batcher) runReplay(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		b.replay(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// replay отправляет батчи из очереди по порядку, по одной попытке на батч: первая же
+// неудача значит, что сервер ещё недоступен, и разбор откладывается до следующего раза
+func (b *Batcher) replay(ctx context.Context) {
+	for ctx.Err() == nil {
+		batch, seq, ok := b.backlog.peek()
+		if !ok {
+			return
+		}
+		err := b.send(ctx, batch, nil)
+		if err != nil && !isPermanent(err) {
+			logger.Log.Debug("server still unavailable, queued batches kept", zap.Error(err))
+			return
+		}
+		b.backlog.remove(seq)
+		n := int64(len(batch.Metrics))
+		if err != nil {
+			b.failed.Add(n)
+			logger.Log.Error("queued batch rejected", zap.Int("size", len(batch.Metrics)), zap.Error(err))
+			continue
+		}
+		b.sent.Add(n)
+	}
+}
+
+// send отправляет батч; delays — паузы между повторами (nil — одна попытка)
+func (b *Batcher) send(ctx context.Context, batch metricBatch, delays []time.Duration) error {
+	if b.grpc != nil {
+		return b.grpc.updateBatch(withCounterMetadata(ctx, batch.Started), batch.Key, batch.Metrics, delays)
+	}
+
+	payload, err := json.Marshal(batch.Metrics)
+	if err != nil {
+		return fmt.Errorf("marshal batch: %w: %w", errRejected, err)
+	}
+	// подписывается исходный JSON, а сжимается уже зашифрованное тело (см. encryptPayload)
+	body, err := encryptPayload(payload)
+	if err != nil {
+		return fmt.Errorf("encrypt batch: %w: %w", errRejected, err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write(body); err != nil {
+		return fmt.Errorf("gzip batch: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("gzip batch: %w", err)
+	}
+
+	// Отправляем пакет метрик на сервер
+	return b.postJSONWithRetry(ctx, b.endpoint, batch, payload, gz.Bytes(), delays)
+}
+
+// isPermanent сообщает, что батч отвергнут сервером и повторять его бессмысленно
+func isPermanent(err error) bool {
+	if errors.Is(err, errRejected) {
+		return true
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.InvalidArgument, codes.PermissionDenied, codes.Unauthenticated,
+			codes.FailedPrecondition, codes.Unimplemented:
+			return true
+		}
+	}
+	return false
+}
+
 /////////////////////////////////
 
-func (b *Batcher) postJSONWithRetry(ctx context.Context, url string, body []byte) error {
-	return retry.DoIf(ctx, httpDelays, func(ctx context.Context) error {
-		resp, err := b.client.R().
+// postJSONWithRetry отправляет сжатое тело body; подписывается исходный JSON payload
+func (b *Batcher) postJSONWithRetry(ctx context.Context, url string, batch metricBatch, payload, body []byte, delays []time.Duration) error {
+	return retry.DoIf(ctx, delays, func(ctx context.Context) error {
+		req := b.client.R().
 			SetContext(ctx).
 			SetHeader("Content-Type", "application/json").
 			SetHeader("Content-Encoding", "gzip").
-			SetBody(body).
-			Post(url)
+			SetHeader(idempotencyKeyHeader, batch.Key).
+			SetBody(body)
+		setAgentHeaders(req, payload)
+		setCounterHeaders(req, batch.Started)
+		resp, err := req.Post(url)
 		if err != nil {
 			return err
 		}
@@ -120,21 +279,14 @@ func (b *Batcher) postJSONWithRetry(ctx context.Context, url string, body []byte
 			return fmt.Errorf("temporary server error %d", resp.StatusCode())
 		}
 		if resp.StatusCode() >= 400 && resp.StatusCode() < 500 {
-			return fmt.Errorf("client error %d: %s", resp.StatusCode(), resp.String())
+			return fmt.Errorf("%w: client error %d: %s", errRejected, resp.StatusCode(), resp.String())
 		}
 		if resp.StatusCode() != http.StatusOK {
 			return fmt.Errorf("server error %d: %s", resp.StatusCode(), resp.String())
 		}
 		return nil
 	}, func(err error) bool {
-		if err == nil {
-			return false
-		}
-		var ne net.Error
-		if errors.As(err, &ne) && ne.Timeout() {
-			return true
-		}
-		// обрыв соединения и прочие транспортные ошибки — ретраим
-		return true
+		// 4xx не ретраим; обрыв соединения, таймауты и прочие транспортные ошибки — ретраим
+		return err != nil && !errors.Is(err, errRejected)
 	})
 }
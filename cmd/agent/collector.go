@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// Collector — источник метрик агента. Коллекторы опрашиваются независимо, каждый со своим интервалом;
+// их метрики копит Batcher (см. aggregator) и отправляет раз в report-interval.
+type Collector interface {
+	Name() string
+	Interval() time.Duration
+	// Collect возвращает собранные метрики. При частичном сбое — то, что удалось собрать, и ошибку.
+	Collect(ctx context.Context) ([]models.Metrics, error)
+}
+
+// collectorPlugin — коллектор в реестре: интервал по умолчанию и конструктор
+type collectorPlugin struct {
+	every time.Duration // 0 — интервал опроса -p
+	build func(a *Agent, every time.Duration) Collector
+}
+
+// collectorRegistry — коллекторы, которые можно включить флагом -collectors
+var collectorRegistry = map[string]collectorPlugin{
+	"runtime": {build: func(a *Agent, every time.Duration) Collector { return &runtimeCollector{agent: a, every: every} }},
+	"random":  {build: func(_ *Agent, every time.Duration) Collector { return randomCollector{every: every} }},
+	"system":  {every: 5 * time.Second, build: func(_ *Agent, every time.Duration) Collector { return systemCollector{every: every} }},
+	"disk": {every: 5 * time.Second, build: func(_ *Agent, every time.Duration) Collector {
+		return &diskCollector{every: every, mounts: splitList(flagDiskMounts)}
+	}},
+	"net": {every: 5 * time.Second, build: func(_ *Agent, every time.Duration) Collector {
+		return &netCollector{every: every, interfaces: splitList(flagNetInterfaces)}
+	}},
+	"load":      {every: 5 * time.Second, build: func(_ *Agent, every time.Duration) Collector { return loadCollector{every: every} }},
+	"swap":      {every: 5 * time.Second, build: func(_ *Agent, every time.Duration) Collector { return &swapCollector{every: every} }},
+	"processes": {every: 5 * time.Second, build: func(_ *Agent, every time.Duration) Collector { return &processCollector{every: every} }},
+}
+
+// defaultCollectors — значение -collectors по умолчанию
+const defaultCollectors = "runtime,random,system,disk,net,load,swap,processes"
+
+// newCollectors создаёт коллекторы по списку вида "runtime,system:30s" (имя[:интервал] через запятую).
+// Не перечисленные коллекторы выключены; без интервала берётся интервал коллектора по умолчанию или poll.
+func newCollectors(a *Agent, spec string, poll time.Duration) ([]Collector, error) {
+	var res []Collector
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, everyStr, hasEvery := strings.Cut(item, ":")
+		plugin, ok := collectorRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown collector %q (available: %s)", name, strings.Join(collectorNames(), ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("collector %q is listed twice", name)
+		}
+		seen[name] = true
+
+		every := plugin.every
+		if every == 0 {
+			every = poll
+		}
+		if hasEvery {
+			d, err := time.ParseDuration(everyStr)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid interval for collector %q: %q", name, everyStr)
+			}
+			every = d
+		}
+		res = append(res, plugin.build(a, every))
+	}
+	return res, nil
+}
+
+func collectorNames() []string {
+	names := make([]string, 0, len(collectorRegistry))
+	for name := range collectorRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runCollectors опрашивает каждый коллектор в своей горутине и пишет метрики в out, пока не отменён ctx.
+// После каждого опроса добавляются метрики самого коллектора: CollectorDuration (секунды)
+// и CollectorErrors (число неудачных опросов) с меткой collector.
+func runCollectors(ctx context.Context, collectors []Collector, out chan<- models.Metrics) {
+	var wg sync.WaitGroup
+	for _, c := range collectors {
+		wg.Add(1)
+		go func(c Collector) {
+			defer wg.Done()
+			runCollector(ctx, c, out)
+		}(c)
+	}
+	wg.Wait()
+}
+
+func runCollector(ctx context.Context, c Collector, out chan<- models.Metrics) {
+	t := time.NewTicker(c.Interval())
+	defer t.Stop()
+	labels := map[string]string{"collector": c.Name()}
+	var errs counter
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		start := time.Now()
+		metrics, err := c.Collect(ctx)
+		took := time.Since(start).Seconds()
+		if err != nil && ctx.Err() == nil {
+			errs.add(1)
+			logger.Log.Warn("collector failed", zap.String("collector", c.Name()), zap.Error(err))
+		}
+		failed := errs.report()
+		metrics = append(metrics,
+			models.Metrics{ID: "CollectorDuration", MType: models.Gauge, Value: &took, Labels: labels},
+			models.Metrics{ID: "CollectorErrors", MType: models.Counter, Delta: &failed, Labels: labels},
+		)
+
+		for _, m := range metrics {
+			select {
+			case out <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// counter — счётчик агента: итог с запуска и значение для отправки. В режиме delta report возвращает
+// прирост с прошлого вызова: отданное Batcher не теряется — пока сервер не подтвердил приём, оно копится
+// в агрегаторе и очереди. В режиме cumulative — итог с запуска, приращение вычисляет сервер.
+// После перезапуска агента итог снова считается с нуля, поэтому прирост остаётся верным.
+type counter struct {
+	mu       sync.Mutex
+	total    int64
+	reported int64 // total на момент предыдущего report
+}
+
+func (c *counter) add(n int64) {
+	c.mu.Lock()
+	c.total += n
+	c.mu.Unlock()
+}
+
+func (c *counter) report() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cumulativeCounters() {
+		return c.total
+	}
+	d := c.total - c.reported
+	c.reported = c.total
+	return d
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// Коллекторы хоста через gopsutil. Объёмы и загрузка — gauge; счётчики ядра (байты и операции
+// ввода-вывода, пакеты, ошибки) — counter, см. osCounters.
+
+// metricSink собирает метрики одного опроса
+type metricSink struct {
+	metrics []models.Metrics
+	errs    []error
+}
+
+func (s *metricSink) gauge(id string, v float64, labels map[string]string) {
+	s.metrics = append(s.metrics, models.Metrics{ID: id, MType: models.Gauge, Value: &v, Labels: labels})
+}
+
+func (s *metricSink) counter(id string, d int64, labels map[string]string) {
+	s.metrics = append(s.metrics, models.Metrics{ID: id, MType: models.Counter, Delta: &d, Labels: labels})
+}
+
+func (s *metricSink) fail(what string, err error) {
+	s.errs = append(s.errs, fmt.Errorf("%s: %w", what, err))
+}
+
+func (s *metricSink) result() ([]models.Metrics, error) {
+	return s.metrics, errors.Join(s.errs...)
+}
+
+// osCounters переводит счётчики ядра, которые считаются с загрузки системы, в счётчики агента,
+// которые считаются с его запуска: первое наблюдение серии только задаёт точку отсчёта.
+// Если значение уменьшилось (устройство пересоздано, переполнение), оно считается приростом с нуля.
+type osCounters struct {
+	mu     sync.Mutex
+	series map[string]*osCounter
+}
+
+type osCounter struct {
+	last uint64
+	c    counter
+}
+
+// observe учитывает текущее значение и возвращает значение для отправки (см. counter.report)
+func (o *osCounters) observe(id string, labels map[string]string, v uint64) int64 {
+	key := models.Metrics{ID: id, Labels: labels}.Key()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.series == nil {
+		o.series = make(map[string]*osCounter)
+	}
+	s, ok := o.series[key]
+	if !ok {
+		o.series[key] = &osCounter{last: v}
+		return 0
+	}
+	if v >= s.last {
+		s.c.add(int64(v - s.last))
+	} else {
+		s.c.add(int64(v))
+	}
+	s.last = v
+	return s.c.report()
+}
+
+// splitList разбирает список через запятую; пустой список — nil
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// diskCollector — заполненность файловых систем по точкам монтирования и ввод-вывод по устройствам под ними.
+// mounts пуст — все физические разделы.
+type diskCollector struct {
+	every  time.Duration
+	mounts []string
+	io     osCounters
+}
+
+func (c *diskCollector) Name() string            { return "disk" }
+func (c *diskCollector) Interval() time.Duration { return c.every }
+
+func (c *diskCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	var sink metricSink
+
+	parts, err := disk.PartitionsWithContext(ctx, len(c.mounts) > 0)
+	if err != nil {
+		sink.fail("partitions", err)
+	}
+	var selected []disk.PartitionStat
+	if len(c.mounts) == 0 {
+		selected = parts
+	} else {
+		byMount := make(map[string]disk.PartitionStat, len(parts))
+		for _, p := range parts {
+			byMount[p.Mountpoint] = p
+		}
+		for _, m := range c.mounts {
+			p, ok := byMount[m]
+			if !ok {
+				p = disk.PartitionStat{Mountpoint: m} // не смонтировано или скрыто: ошибку покажет Usage
+			}
+			selected = append(selected, p)
+		}
+	}
+
+	devices := make(map[string]bool)
+	for _, p := range selected {
+		u, err := disk.UsageWithContext(ctx, p.Mountpoint)
+		if err != nil {
+			sink.fail("usage of "+p.Mountpoint, err)
+			continue
+		}
+		labels := map[string]string{"mount": p.Mountpoint}
+		sink.gauge("DiskTotal", float64(u.Total), labels)
+		sink.gauge("DiskUsed", float64(u.Used), labels)
+		sink.gauge("DiskFree", float64(u.Free), labels)
+		sink.gauge("DiskUsedPercent", u.UsedPercent, labels)
+		sink.gauge("DiskInodesUsedPercent", u.InodesUsedPercent, labels)
+		if dev := blockDevice(p.Device); dev != "" {
+			devices[dev] = true
+		}
+	}
+	if len(devices) == 0 {
+		return sink.result()
+	}
+
+	names := make([]string, 0, len(devices))
+	for dev := range devices {
+		names = append(names, dev)
+	}
+	stats, err := disk.IOCountersWithContext(ctx, names...)
+	if err != nil {
+		sink.fail("io counters", err)
+	}
+	for dev, s := range stats {
+		labels := map[string]string{"device": dev}
+		sink.counter("DiskReadBytes", c.io.observe("DiskReadBytes", labels, s.ReadBytes), labels)
+		sink.counter("DiskWriteBytes", c.io.observe("DiskWriteBytes", labels, s.WriteBytes), labels)
+		sink.counter("DiskReads", c.io.observe("DiskReads", labels, s.ReadCount), labels)
+		sink.counter("DiskWrites", c.io.observe("DiskWrites", labels, s.WriteCount), labels)
+		sink.gauge("DiskIOInProgress", float64(s.IopsInProgress), labels)
+	}
+	return sink.result()
+}
+
+// blockDevice — имя устройства для статистики ввода-вывода: /dev/sda1 → sda1, /dev/mapper/vg-root → dm-0
+func blockDevice(dev string) string {
+	if !strings.HasPrefix(dev, "/dev/") {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = resolved
+	}
+	return filepath.Base(dev)
+}
+
+// netCollector — трафик, пакеты и ошибки по сетевым интерфейсам. interfaces пуст — все, кроме lo.
+type netCollector struct {
+	every      time.Duration
+	interfaces []string
+	io         osCounters
+}
+
+func (c *netCollector) Name() string            { return "net" }
+func (c *netCollector) Interval() time.Duration { return c.every }
+
+func (c *netCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	var sink metricSink
+	stats, err := net.IOCountersWithContext(ctx, true)
+	if err != nil {
+		sink.fail("io counters", err)
+		return sink.result()
+	}
+	wanted := make(map[string]bool, len(c.interfaces))
+	for _, name := range c.interfaces {
+		wanted[name] = true
+	}
+	for _, s := range stats {
+		if (len(c.interfaces) > 0 && !wanted[s.Name]) || (len(c.interfaces) == 0 && s.Name == "lo") {
+			continue
+		}
+		delete(wanted, s.Name)
+		labels := map[string]string{"interface": s.Name}
+		for _, v := range []struct {
+			id  string
+			val uint64
+		}{
+			{"NetBytesSent", s.BytesSent},
+			{"NetBytesRecv", s.BytesRecv},
+			{"NetPacketsSent", s.PacketsSent},
+			{"NetPacketsRecv", s.PacketsRecv},
+			{"NetErrorsIn", s.Errin},
+			{"NetErrorsOut", s.Errout},
+			{"NetDropsIn", s.Dropin},
+			{"NetDropsOut", s.Dropout},
+		} {
+			sink.counter(v.id, c.io.observe(v.id, labels, v.val), labels)
+		}
+	}
+	for name := range wanted {
+		sink.fail("interface "+name, errors.New("not found"))
+	}
+	return sink.result()
+}
+
+// loadCollector — средняя загрузка за 1, 5 и 15 минут
+type loadCollector struct {
+	every time.Duration
+}
+
+func (c loadCollector) Name() string            { return "load" }
+func (c loadCollector) Interval() time.Duration { return c.every }
+
+func (c loadCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	var sink metricSink
+	if avg, err := load.AvgWithContext(ctx); err == nil {
+		sink.gauge("LoadAverage1", avg.Load1, nil)
+		sink.gauge("LoadAverage5", avg.Load5, nil)
+		sink.gauge("LoadAverage15", avg.Load15, nil)
+	} else {
+		sink.fail("load average", err)
+	}
+	return sink.result()
+}
+
+// swapCollector — использование подкачки и объём подкачанного
+type swapCollector struct {
+	every time.Duration
+	io    osCounters
+}
+
+func (c *swapCollector) Name() string            { return "swap" }
+func (c *swapCollector) Interval() time.Duration { return c.every }
+
+func (c *swapCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	var sink metricSink
+	sw, err := mem.SwapMemoryWithContext(ctx)
+	if err != nil {
+		sink.fail("swap", err)
+		return sink.result()
+	}
+	sink.gauge("SwapTotal", float64(sw.Total), nil)
+	sink.gauge("SwapUsed", float64(sw.Used), nil)
+	sink.gauge("SwapFree", float64(sw.Free), nil)
+	sink.counter("SwapInBytes", c.io.observe("SwapInBytes", nil, sw.Sin), nil)
+	sink.counter("SwapOutBytes", c.io.observe("SwapOutBytes", nil, sw.Sout), nil)
+	return sink.result()
+}
+
+// processCollector — число процессов и открытых файлов хоста; AgentOpenFDs — дескрипторы самого агента
+type processCollector struct {
+	every time.Duration
+	io    osCounters
+}
+
+func (c *processCollector) Name() string            { return "processes" }
+func (c *processCollector) Interval() time.Duration { return c.every }
+
+func (c *processCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	var sink metricSink
+	// load.Misc есть только в Linux; в остальных системах число процессов — по списку PID
+	if misc, err := load.MiscWithContext(ctx); err == nil {
+		sink.gauge("ProcessesTotal", float64(misc.ProcsTotal), nil)
+		sink.gauge("ProcessesRunning", float64(misc.ProcsRunning), nil)
+		sink.gauge("ProcessesBlocked", float64(misc.ProcsBlocked), nil)
+		sink.counter("ProcessesCreated", c.io.observe("ProcessesCreated", nil, uint64(misc.ProcsCreated)), nil)
+	} else if pids, err := process.PidsWithContext(ctx); err == nil {
+		sink.gauge("ProcessesTotal", float64(len(pids)), nil)
+	} else {
+		sink.fail("processes", err)
+	}
+
+	if open, limit, err := hostOpenFiles(); err == nil {
+		sink.gauge("OpenFileHandles", float64(open), nil)
+		sink.gauge("OpenFileHandlesMax", float64(limit), nil)
+	} else {
+		sink.fail("open file handles", err)
+	}
+
+	if p, err := process.NewProcessWithContext(ctx, int32(os.Getpid())); err == nil {
+		if fds, err := p.NumFDsWithContext(ctx); err == nil {
+			sink.gauge("AgentOpenFDs", float64(fds), nil)
+		} else {
+			sink.fail("agent open fds", err)
+		}
+	} else {
+		sink.fail("agent open fds", err)
+	}
+	return sink.result()
+}
+
+// errUnsupported — метрика недоступна в этой ОС
+var errUnsupported = errors.New("not supported on " + runtime.GOOS)
+
+// fileNrPath — счётчики файловых дескрипторов ядра Linux: выделено, свободно из выделенных, максимум
+var fileNrPath = "/proc/sys/fs/file-nr"
+
+// hostOpenFiles возвращает число открытых файлов во всей системе и их предел (fs.file-max)
+func hostOpenFiles() (open, limit uint64, err error) {
+	if runtime.GOOS != "linux" {
+		return 0, 0, errUnsupported
+	}
+	data, err := os.ReadFile(fileNrPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return 0, 0, fmt.Errorf("unexpected %s format: %q", fileNrPath, data)
+	}
+	var v [3]uint64
+	for i, f := range fields {
+		if v[i], err = strconv.ParseUint(f, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("unexpected %s format: %w", fileNrPath, err)
+		}
+	}
+	return v[0] - v[1], v[2], nil
+}
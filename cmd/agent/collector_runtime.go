@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// runtimeCollector — метрики runtime.MemStats, PollCount и гистограмма пауз GC (см. Agent.collectMetrics)
+type runtimeCollector struct {
+	agent *Agent
+	every time.Duration
+}
+
+func (c *runtimeCollector) Name() string            { return "runtime" }
+func (c *runtimeCollector) Interval() time.Duration { return c.every }
+
+func (c *runtimeCollector) Collect(_ context.Context) ([]models.Metrics, error) {
+	a := c.agent
+	a.collectMetrics()
+
+	res := make([]models.Metrics, 0, len(a.Metrics)+2)
+	for name, val := range a.Metrics {
+		v := val
+		res = append(res, models.Metrics{ID: name, MType: models.Gauge, Value: &v})
+	}
+	// PollCount: прирост с прошлого опроса или итог (-counter-mode)
+	pc := a.pollCount.report()
+	res = append(res,
+		models.Metrics{ID: "PollCount", MType: models.Counter, Delta: &pc},
+		// паузы GC с прошлого опроса; Batcher сливает гистограммы до отправки
+		models.Metrics{ID: "GCPauseDuration", MType: models.Histogram, Histogram: a.takeGCPauses()},
+	)
+	return res, nil
+}
+
+// randomCollector — gauge RandomValue со случайным значением
+type randomCollector struct {
+	every time.Duration
+}
+
+func (c randomCollector) Name() string            { return "random" }
+func (c randomCollector) Interval() time.Duration { return c.every }
+
+func (c randomCollector) Collect(_ context.Context) ([]models.Metrics, error) {
+	v := rand.Float64()
+	return []models.Metrics{{ID: "RandomValue", MType: models.Gauge, Value: &v}}, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -10,29 +11,34 @@ import (
 	"github.com/shirou/gopsutil/v3/mem"
 )
 
-func collectSysLoop(ctx context.Context, every time.Duration, out chan<- models.Metrics) {
-	t := time.NewTicker(every)
-	defer t.Stop()
+// systemCollector — память и загрузка CPU хоста через gopsutil
+type systemCollector struct {
+	every time.Duration
+}
+
+func (c systemCollector) Name() string            { return "system" }
+func (c systemCollector) Interval() time.Duration { return c.every }
 
-	postGauge := func(id string, v float64) {
+func (c systemCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	var res []models.Metrics
+	var errs []error
+	gauge := func(id string, v float64) {
 		val := v
-		out <- models.Metrics{ID: id, MType: "gauge", Value: &val}
+		res = append(res, models.Metrics{ID: id, MType: models.Gauge, Value: &val})
 	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-t.C:
-			if vm, err := mem.VirtualMemoryWithContext(ctx); err == nil {
-				postGauge("TotalMemory", float64(vm.Total))
-				postGauge("FreeMemory", float64(vm.Free))
-			}
-			if perc, err := cpu.PercentWithContext(ctx, 200*time.Millisecond, true); err == nil {
-				for i, p := range perc {
-					postGauge(fmt.Sprintf("CPUutilization%d", i+1), p)
-				}
-			}
+	if vm, err := mem.VirtualMemoryWithContext(ctx); err == nil {
+		gauge("TotalMemory", float64(vm.Total))
+		gauge("FreeMemory", float64(vm.Free))
+	} else {
+		errs = append(errs, fmt.Errorf("memory: %w", err))
+	}
+	if perc, err := cpu.PercentWithContext(ctx, 200*time.Millisecond, true); err == nil {
+		for i, p := range perc {
+			gauge(fmt.Sprintf("CPUutilization%d", i+1), p)
 		}
+	} else {
+		errs = append(errs, fmt.Errorf("cpu: %w", err))
 	}
+	return res, errors.Join(errs...)
 }
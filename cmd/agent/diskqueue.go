@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+)
+
+// queueFileExt — расширение файлов батчей в очереди на диске
+const queueFileExt = ".batch"
+
+// errBatchTooLarge — батч больше, чем вся очередь на диске
+var errBatchTooLarge = errors.New("batch exceeds disk queue size")
+
+// batchQueue — отложенные батчи, которые досылаются по порядку (см. Batcher.replay)
+type batchQueue interface {
+	push(b metricBatch) (evicted int64, err error) // evicted — метрик в батчах, вытесненных ради места
+	peek() (metricBatch, uint64, bool)             // самый старый батч и его номер
+	remove(seq uint64)
+	len() int
+}
+
+// memQueue — очередь отложенных батчей в памяти, когда очередь на диске выключена (-queue-dir="").
+// Батч повторяется с тем же ключом идемпотентности, но остановку агента не переживает.
+type memQueue struct {
+	mu      sync.Mutex
+	batches []metricBatch
+	seqs    []uint64
+	next    uint64
+}
+
+func (q *memQueue) push(b metricBatch) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.next++
+	q.batches = append(q.batches, b)
+	q.seqs = append(q.seqs, q.next)
+	return 0, nil
+}
+
+func (q *memQueue) peek() (metricBatch, uint64, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.batches) == 0 {
+		return metricBatch{}, 0, false
+	}
+	return q.batches[0], q.seqs[0], true
+}
+
+func (q *memQueue) remove(seq uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, s := range q.seqs {
+		if s == seq {
+			q.batches = append(q.batches[:i], q.batches[i+1:]...)
+			q.seqs = append(q.seqs[:i], q.seqs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (q *memQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.batches)
+}
+
+// metrics возвращает число метрик в очереди — они пропадут при остановке
+func (q *memQueue) metrics() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var n int64
+	for _, b := range q.batches {
+		n += int64(len(b.Metrics))
+	}
+	return n
+}
+
+// diskQueue — очередь неотправленных батчей на диске: по файлу на батч, имя — порядковый номер.
+// Переживает перезапуск агента и, благодаря fsync файла и каталога, потерю питания.
+// Если очередь превышает maxBytes, вытесняются самые старые батчи.
+type diskQueue struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	files []queuedFile // по возрастанию seq: первый — самый старый
+	size  int64
+	next  uint64
+}
+
+type queuedFile struct {
+	seq     uint64
+	size    int64
+	metrics int64 // метрик в батче; -1 — не известно (файл остался с прошлого запуска)
+}
+
+// openDiskQueue открывает (создавая при необходимости) очередь в каталоге dir
+func openDiskQueue(dir string, maxBytes int64) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	q := &diskQueue{dir: dir, maxBytes: maxBytes, next: 1}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// недописанный батч: агент упал до переименования
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, queueFileExt), 10, 64)
+		if err != nil || !strings.HasSuffix(name, queueFileExt) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		q.files = append(q.files, queuedFile{seq: seq, size: info.Size(), metrics: -1})
+		q.size += info.Size()
+		if seq >= q.next {
+			q.next = seq + 1
+		}
+	}
+	sort.Slice(q.files, func(i, j int) bool { return q.files[i].seq < q.files[j].seq })
+	return q, nil
+}
+
+func (q *diskQueue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, queueFileExt))
+}
+
+// push дописывает батч в конец очереди и возвращает число метрик в вытесненных батчах
+func (q *diskQueue) push(b metricBatch) (int64, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(len(data))
+	if q.maxBytes > 0 && size > q.maxBytes {
+		return 0, errBatchTooLarge
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var evicted int64
+	for q.maxBytes > 0 && q.size+size > q.maxBytes && len(q.files) > 0 {
+		oldest := q.files[0]
+		n := oldest.metrics
+		if n < 0 {
+			n = q.countMetrics(oldest.seq)
+		}
+		if err := os.Remove(q.path(oldest.seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return evicted, err
+		}
+		q.files = q.files[1:]
+		q.size -= oldest.size
+		evicted += n
+		logger.Log.Warn("disk queue is full, oldest batch dropped", zap.Uint64("seq", oldest.seq), zap.Int64("metrics", n))
+	}
+
+	seq := q.next
+	if err := writeQueueFile(q.path(seq), data); err != nil {
+		return evicted, err
+	}
+	q.next++
+	q.files = append(q.files, queuedFile{seq: seq, size: size, metrics: int64(len(b.Metrics))})
+	q.size += size
+	return evicted, nil
+}
+
+// writeQueueFile атомарно записывает файл батча: через временный файл, fsync и переименование,
+// после которого синхронизируется каталог — иначе при потере питания файл может пропасть
+func writeQueueFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// countMetrics возвращает число метрик в файле батча; нечитаемый файл — 0
+func (q *diskQueue) countMetrics(seq uint64) int64 {
+	data, err := os.ReadFile(q.path(seq))
+	if err != nil {
+		return 0
+	}
+	var b metricBatch
+	if err := json.Unmarshal(data, &b); err != nil {
+		return 0
+	}
+	return int64(len(b.Metrics))
+}
+
+// peek возвращает самый старый батч и его номер, не удаляя его. Нечитаемые файлы выбрасываются.
+func (q *diskQueue) peek() (metricBatch, uint64, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.files) > 0 {
+		head := q.files[0]
+		data, err := os.ReadFile(q.path(head.seq))
+		var b metricBatch
+		if err == nil {
+			if err = json.Unmarshal(data, &b); err == nil {
+				return b, head.seq, true
+			}
+		}
+		logger.Log.Warn("dropping unreadable queued batch", zap.Uint64("seq", head.seq), zap.Error(err))
+		q.removeLocked(head.seq)
+	}
+	return metricBatch{}, 0, false
+}
+
+// remove удаляет батч seq; если его уже вытеснили, ничего не делает
+func (q *diskQueue) remove(seq uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.removeLocked(seq)
+}
+
+func (q *diskQueue) removeLocked(seq uint64) {
+	for i, f := range q.files {
+		if f.seq != seq {
+			continue
+		}
+		if err := os.Remove(q.path(seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Log.Warn("cannot remove queued batch", zap.Uint64("seq", seq), zap.Error(err))
+		}
+		q.files = append(q.files[:i], q.files[i+1:]...)
+		q.size -= f.size
+		return
+	}
+}
+
+// len возвращает число батчей в очереди
+func (q *diskQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.files)
+}
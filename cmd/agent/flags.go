@@ -1,28 +1,90 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/counters"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/payloadcrypto"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tlsconfig"
 
 	"github.com/caarlos0/env/v6"
 )
 
 // неэкспортированная переменная flagRunAddr содержит адрес и порт для запроса
 var (
-	flagRunAddr        string
-	flagReportInterval int64
-	flagPollInterval   int64
-	flagKey            string
-	flagRateLimit      int
+	flagRunAddr         string
+	flagReportInterval  int64
+	flagPollInterval    int64
+	flagKey             string
+	flagRateLimit       int
+	flagTenant          string
+	flagTLSCA           string
+	flagTLSCert         string
+	flagTLSKey          string
+	flagCryptoKey       string
+	flagTransport       string
+	flagShutdownTimeout time.Duration
+	flagBatchSize       int
+	flagBatchBytes      int
+	flagQueueDir        string
+	flagQueueMaxBytes   int64
+	flagCounterMode     string
+	flagInstance        string
+	flagCollectors      string
+	flagDiskMounts      string
+	flagNetInterfaces   string
+)
+
+// Транспорты агента (-transport)
+const (
+	transportHTTP = "http"
+	transportGRPC = "grpc"
 )
 
+// payloadEncryptor шифрует тела запросов открытым ключом сервера (nil — без шифрования)
+var payloadEncryptor *payloadcrypto.Encryptor
+
+// clientTLS — настройки TLS для resty-клиентов (nil — настройки по умолчанию)
+var clientTLS *tls.Config
+
+// границы бакетов гистограммы пауз GC в секундах: от 10µs до 100ms
+var gcPauseBuckets = []float64{
+	0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1,
+}
+
 type Config struct {
-	RunAddr        string `env:"ADDRESS"`
-	ReportInterval int    `env:"REPORT_INTERVAL"`
-	PollInterval   int    `env:"POLL_INTERVAL"`
-	Key            string `env:"KEY"`
-	RateLimit      int    `env:"RATE_LIMIT"`
+	RunAddr         string        `env:"ADDRESS"`
+	ReportInterval  int           `env:"REPORT_INTERVAL"`
+	PollInterval    int           `env:"POLL_INTERVAL"`
+	Key             string        `env:"KEY"`
+	RateLimit       int           `env:"RATE_LIMIT"`
+	GCPauseBuckets  string        `env:"GC_PAUSE_BUCKETS"`
+	Tenant          string        `env:"TENANT"`
+	TLSCA           string        `env:"TLS_CA"`
+	TLSCert         string        `env:"TLS_CERT"`
+	TLSKey          string        `env:"TLS_KEY"`
+	CryptoKey       string        `env:"CRYPTO_KEY"`
+	Transport       string        `env:"TRANSPORT"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	BatchSize       int           `env:"BATCH_SIZE"`
+	BatchBytes      int           `env:"BATCH_BYTES"`
+	QueueDir        string        `env:"QUEUE_DIR"`
+	QueueMaxBytes   int64         `env:"QUEUE_MAX_BYTES"`
+	CounterMode     string        `env:"COUNTER_MODE"`
+	Instance        string        `env:"AGENT_INSTANCE"`
+	Collectors      string        `env:"COLLECTORS"`
+	DiskMounts      string        `env:"DISK_MOUNTS"`
+	NetInterfaces   string        `env:"NET_INTERFACES"`
 }
 
 // parseFlags обрабатывает аргументы командной строки
@@ -42,13 +104,37 @@ func parseFlags() {
 
 	flag.IntVar(&flagRateLimit, "l", 0, "max concurrent outbound requests (RATE_LIMIT)")
 
+	flag.StringVar(&flagTenant, "tenant", "", "tenant id sent in X-Tenant-ID (TENANT)")
+
+	flag.StringVar(&flagTLSCA, "tls-ca", "", "CA bundle to verify the server certificate (TLS_CA)")
+	flag.StringVar(&flagTLSCert, "tls-cert", "", "client certificate for mutual TLS (TLS_CERT)")
+	flag.StringVar(&flagTLSKey, "tls-key", "", "client private key for mutual TLS (TLS_KEY)")
+
+	flag.StringVar(&flagCryptoKey, "crypto-key", "", "server public key (PEM, RSA or X25519) to encrypt payloads (CRYPTO_KEY)")
+
+	flag.StringVar(&flagTransport, "transport", transportHTTP, "transport to the server: http or grpc (TRANSPORT)")
+
+	flag.DurationVar(&flagShutdownTimeout, "shutdown-timeout", 10*time.Second, "time to send queued metrics on SIGINT/SIGTERM/SIGQUIT (SHUTDOWN_TIMEOUT)")
+
+	flag.IntVar(&flagBatchSize, "batch-size", 100, "max metrics per /updates batch, 0 for no limit (BATCH_SIZE)")
+	flag.IntVar(&flagBatchBytes, "batch-bytes", 512<<10, "max uncompressed JSON bytes per batch, 0 for no limit (BATCH_BYTES)")
+	flag.StringVar(&flagQueueDir, "queue-dir", filepath.Join(os.TempDir(), "metrics-agent-queue"), "directory for batches that could not be delivered, empty disables (QUEUE_DIR)")
+	flag.Int64Var(&flagQueueMaxBytes, "queue-max-bytes", 64<<20, "max disk queue size; the oldest batches are dropped beyond it (QUEUE_MAX_BYTES)")
+
+	flag.StringVar(&flagCounterMode, "counter-mode", counters.ModeDelta, "how counters are sent: delta (increase since the last report) or cumulative (running total, server computes deltas) (COUNTER_MODE)")
+	hostname, _ := os.Hostname()
+	flag.StringVar(&flagInstance, "instance", hostname, "agent id the server tracks cumulative counters by (AGENT_INSTANCE)")
+
+	flag.StringVar(&flagCollectors, "collectors", defaultCollectors, "enabled collectors with optional intervals, e.g. runtime,system:30s (COLLECTORS)")
+	flag.StringVar(&flagDiskMounts, "disk-mounts", "", "comma-separated mount points for the disk collector, empty for all physical partitions (DISK_MOUNTS)")
+	flag.StringVar(&flagNetInterfaces, "net-interfaces", "", "comma-separated interfaces for the net collector, empty for all except lo (NET_INTERFACES)")
+
+	var flagGCPauseBuckets string
+	flag.StringVar(&flagGCPauseBuckets, "gc-buckets", "", "comma-separated GC pause histogram bucket bounds in seconds (GC_PAUSE_BUCKETS)")
+
 	// парсим переданные аргументы в зарегистрированные переменные
 	flag.Parse()
 
-	if !strings.HasPrefix(flagRunAddr, "http://") && !strings.HasPrefix(flagRunAddr, "https://") {
-		flagRunAddr = "http://" + flagRunAddr
-	}
-
 	// проверка на неизвестные аргументы
 	if len(flag.Args()) > 0 {
 		log.Fatalf("Неизвестные аргументы: %v", flag.Args())
@@ -64,9 +150,6 @@ func parseFlags() {
 
 	if envRunAddr := cfg.RunAddr; envRunAddr != "" {
 		flagRunAddr = envRunAddr
-		if !strings.HasPrefix(flagRunAddr, "http://") && !strings.HasPrefix(flagRunAddr, "https://") {
-			flagRunAddr = "http://" + flagRunAddr
-		}
 	}
 
 	if envReportInterval := cfg.ReportInterval; envReportInterval != 0 {
@@ -81,6 +164,95 @@ func parseFlags() {
 		flagKey = envKey
 	}
 
+	if cfg.Tenant != "" {
+		flagTenant = cfg.Tenant
+	}
+
+	if cfg.TLSCA != "" {
+		flagTLSCA = cfg.TLSCA
+	}
+	if cfg.TLSCert != "" {
+		flagTLSCert = cfg.TLSCert
+	}
+	if cfg.TLSKey != "" {
+		flagTLSKey = cfg.TLSKey
+	}
+
+	if cfg.ShutdownTimeout > 0 {
+		flagShutdownTimeout = cfg.ShutdownTimeout
+	}
+
+	if cfg.BatchSize > 0 {
+		flagBatchSize = cfg.BatchSize
+	}
+	if cfg.BatchBytes > 0 {
+		flagBatchBytes = cfg.BatchBytes
+	}
+	if cfg.QueueDir != "" {
+		flagQueueDir = cfg.QueueDir
+	}
+	if cfg.QueueMaxBytes > 0 {
+		flagQueueMaxBytes = cfg.QueueMaxBytes
+	}
+
+	if cfg.Collectors != "" {
+		flagCollectors = cfg.Collectors
+	}
+	if cfg.DiskMounts != "" {
+		flagDiskMounts = cfg.DiskMounts
+	}
+	if cfg.NetInterfaces != "" {
+		flagNetInterfaces = cfg.NetInterfaces
+	}
+
+	if cfg.CounterMode != "" {
+		flagCounterMode = cfg.CounterMode
+	}
+	if flagCounterMode != counters.ModeDelta && flagCounterMode != counters.ModeCumulative {
+		log.Fatalf("Неизвестный режим счётчиков: %s", flagCounterMode)
+	}
+	if cfg.Instance != "" {
+		flagInstance = cfg.Instance
+	}
+	if flagCounterMode == counters.ModeCumulative && flagInstance == "" {
+		log.Fatal("Для -counter-mode=cumulative нужен -instance")
+	}
+
+	if cfg.Transport != "" {
+		flagTransport = cfg.Transport
+	}
+	if flagTransport != transportHTTP && flagTransport != transportGRPC {
+		log.Fatalf("Неизвестный транспорт: %s", flagTransport)
+	}
+
+	if cfg.CryptoKey != "" {
+		flagCryptoKey = cfg.CryptoKey
+	}
+	if flagCryptoKey != "" {
+		enc, err := payloadcrypto.LoadPublicKey(flagCryptoKey)
+		if err != nil {
+			log.Fatalf("Некорректный ключ шифрования: %v", err)
+		}
+		payloadEncryptor = enc
+	}
+
+	if tlsEnabled() {
+		cfg, err := tlsconfig.Client(flagTLSCA, flagTLSCert, flagTLSKey)
+		if err != nil {
+			log.Fatalf("Некорректные настройки TLS: %v", err)
+		}
+		clientTLS = cfg
+	}
+
+	// адрес без схемы: https, если настроен TLS, иначе http
+	if !strings.HasPrefix(flagRunAddr, "http://") && !strings.HasPrefix(flagRunAddr, "https://") {
+		if tlsEnabled() {
+			flagRunAddr = "https://" + flagRunAddr
+		} else {
+			flagRunAddr = "http://" + flagRunAddr
+		}
+	}
+
 	// if envRateLimit := cfg.RateLimit; envRateLimit != 0 {
 	// 	flagRateLimit = int(envRateLimit)
 	// }
@@ -93,4 +265,42 @@ func parseFlags() {
 		flagRateLimit = 1 // безопасный дефолт: без параллелизма
 	}
 
+	if cfg.GCPauseBuckets != "" {
+		flagGCPauseBuckets = cfg.GCPauseBuckets
+	}
+	if flagGCPauseBuckets != "" {
+		bounds, err := parseBuckets(flagGCPauseBuckets)
+		if err != nil {
+			log.Fatalf("Некорректные границы бакетов: %v", err)
+		}
+		gcPauseBuckets = bounds
+	}
+
+}
+
+// cumulativeCounters сообщает, что счётчики отправляются итогами с запуска агента (-counter-mode=cumulative)
+func cumulativeCounters() bool {
+	return flagCounterMode == counters.ModeCumulative
+}
+
+// tlsEnabled сообщает, задан ли хоть один из флагов TLS
+func tlsEnabled() bool {
+	return flagTLSCA != "" || flagTLSCert != "" || flagTLSKey != ""
+}
+
+// parseBuckets разбирает список границ бакетов вида "0.001,0.01,0.1"
+func parseBuckets(s string) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	bounds := make([]float64, 0, len(parts))
+	for _, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bucket %q: %w", p, err)
+		}
+		bounds = append(bounds, v)
+	}
+	if err := models.NewHistogramData(bounds).Validate(); err != nil {
+		return nil, err
+	}
+	return bounds, nil
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/counters"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/cryptohelpers"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/grpcapi"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	pb "github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/proto"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/retry"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tenant"
+)
+
+// grpcSender отправляет метрики по gRPC вместо HTTP (-transport=grpc)
+type grpcSender struct {
+	conn   *grpc.ClientConn
+	client pb.MetricsClient
+}
+
+// newGRPCSender подключается к серверу; адрес берётся из -a без схемы
+func newGRPCSender(serverURL string) (*grpcSender, error) {
+	target := serverURL
+	if u, err := url.Parse(serverURL); err == nil && u.Host != "" {
+		target = u.Host
+	}
+
+	creds := insecure.NewCredentials()
+	if clientTLS != nil {
+		creds = credentials.NewTLS(clientTLS)
+	}
+	conn, err := grpc.NewClient(target,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithUnaryInterceptor(signUnaryInterceptor),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("grpc dial %s: %w", target, err)
+	}
+	return &grpcSender{conn: conn, client: pb.NewMetricsClient(conn)}, nil
+}
+
+func (s *grpcSender) Close() error {
+	return s.conn.Close()
+}
+
+// update отправляет одну метрику; ключ идемпотентности общий для всех ретраев
+func (s *grpcSender) update(ctx context.Context, m models.Metrics) error {
+	ctx = metadata.AppendToOutgoingContext(ctx, grpcapi.IdempotencyKeyMD, cryptohelpers.NewNonce())
+	req := &pb.UpdateRequest{Metric: grpcapi.ToProto(m)}
+	return retry.DoIf(ctx, httpDelays, func(ctx context.Context) error {
+		_, err := s.client.Update(ctx, req)
+		return err
+	}, isRetriableGRPC)
+}
+
+// updateBatch отправляет батч метрик одним вызовом с ключом идемпотентности idemKey;
+// delays — паузы между повторами (nil — одна попытка)
+func (s *grpcSender) updateBatch(ctx context.Context, idemKey string, batch []models.Metrics, delays []time.Duration) error {
+	ctx = metadata.AppendToOutgoingContext(ctx, grpcapi.IdempotencyKeyMD, idemKey)
+	req := &pb.UpdateBatchRequest{Metrics: make([]*pb.Metric, 0, len(batch))}
+	for _, m := range batch {
+		req.Metrics = append(req.Metrics, grpcapi.ToProto(m))
+	}
+	return retry.DoIf(ctx, delays, func(ctx context.Context) error {
+		resp, err := s.client.UpdateBatch(ctx, req)
+		if err == nil && !resp.GetApplied() {
+			logger.Log.Debug("batch was already applied by server", zap.Int("size", len(batch)))
+		}
+		return err
+	}, isRetriableGRPC)
+}
+
+// withCounterMetadata помечает вызов с батчем накопительных счётчиков, как setCounterHeaders у HTTP
+func withCounterMetadata(ctx context.Context, started string) context.Context {
+	if started == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx,
+		strings.ToLower(counters.ModeHeader), counters.ModeCumulative,
+		strings.ToLower(counters.InstanceHeader), flagInstance,
+		strings.ToLower(counters.StartedHeader), started,
+	)
+}
+
+// isRetriableGRPC — ретраим только недоступность сервера и таймауты, как 502/503/504 у HTTP
+func isRetriableGRPC(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// signUnaryInterceptor добавляет к вызову те же метаданные, что setAgentHeaders к HTTP-запросу.
+// Подписывается детерминированная сериализация запроса; на каждой попытке — новые метка времени и nonce.
+func signUnaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	var payload []byte
+	if msg, ok := req.(proto.Message); ok && flagKey != "" {
+		var err error
+		if payload, err = (proto.MarshalOptions{Deterministic: true}).Marshal(msg); err != nil {
+			return err
+		}
+	}
+	return invoker(withAgentMetadata(ctx, payload), method, req, reply, cc, opts...)
+}
+
+func withAgentMetadata(ctx context.Context, payload []byte) context.Context {
+	var kv []string
+	if flagKey != "" {
+		ts := time.Now().Unix()
+		nonce := cryptohelpers.NewNonce()
+		kv = append(kv,
+			strings.ToLower("HashSHA256"), cryptohelpers.SignRequest(payload, flagKey, ts, nonce),
+			strings.ToLower(cryptohelpers.HeaderTimestamp), strconv.FormatInt(ts, 10),
+			strings.ToLower(cryptohelpers.HeaderNonce), nonce,
+		)
+	}
+	if flagTenant != "" {
+		kv = append(kv, strings.ToLower(tenant.Header), flagTenant)
+	}
+	if agentIP != "" {
+		kv = append(kv, strings.ToLower(realIPHeader), agentIP)
+	}
+	if len(kv) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
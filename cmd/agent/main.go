@@ -7,16 +7,25 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
+	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/counters"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/cryptohelpers"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/payloadcrypto"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/retry"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tenant"
 	"github.com/go-resty/resty/v2"
 	"go.uber.org/zap"
 )
@@ -25,24 +34,135 @@ var httpDelays = []time.Duration{time.Second, 3 * time.Second, 5 * time.Second}
 
 // Agent инкапсулирует состояние и поведение агента для сбора и отправки метрик на сервер
 type Agent struct {
-	PollCount   int64              // счётчик обновлений метрик
-	RandomValue float64            // случайное значение метрики
-	Metrics     map[string]float64 // метрики типа gauge из runtime
-	Client      *resty.Client      // HTTP-клиент
-	ServerURL   string             // адрес сервера
+	Metrics   map[string]float64    // метрики типа gauge из runtime
+	GCPauses  *models.HistogramData // паузы GC (в секундах), ещё не переданные батчеру
+	Client    *resty.Client         // HTTP-клиент
+	ServerURL string                // адрес сервера
+	GRPC      *grpcSender           // gRPC-клиент при -transport=grpc (nil — HTTP)
+
+	histMu    sync.Mutex // защищает GCPauses: пишет опрос, забирает отправка
+	lastNumGC uint32     // NumGC на момент предыдущего опроса
+
+	pollCount counter // PollCount — число опросов runtime
 }
 
 // NewAgent создаёт и возвращает новый экземпляр агента
+// newHTTPClient создаёт resty-клиент с настройками TLS из флагов
+func newHTTPClient() *resty.Client {
+	c := resty.New()
+	if clientTLS != nil {
+		c.SetTLSClientConfig(clientTLS)
+	}
+	return c
+}
+
 func NewAgent(serverURL string) *Agent {
 	return &Agent{
-		Metrics:   make(map[string]float64), // инициализируем хранилище метрик
-		Client:    resty.New(),              // Создаём HTTP-клиент resty
-		ServerURL: serverURL,                // Адрес сервера, куда будем отправлять метрики
+		Metrics:   make(map[string]float64),                // инициализируем хранилище метрик
+		GCPauses:  models.NewHistogramData(gcPauseBuckets), // гистограмма пауз GC
+		Client:    newHTTPClient(),                         // Создаём HTTP-клиент resty
+		ServerURL: serverURL,                               // Адрес сервера, куда будем отправлять метрики
+	}
+}
+
+// takeGCPauses забирает накопленную гистограмму пауз GC и начинает новую.
+// Сервер складывает гистограммы, поэтому отправляем только наблюдения за интервал.
+func (a *Agent) takeGCPauses() *models.HistogramData {
+	a.histMu.Lock()
+	defer a.histMu.Unlock()
+	h := a.GCPauses
+	a.GCPauses = models.NewHistogramData(h.Bounds)
+	return h
+}
+
+// idempotencyKeyHeader — ключ идемпотентности: один на батч и общий для всех его ретраев,
+// чтобы сервер не применил повторно батч, ответ на который потерялся
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// signRequest подписывает тело запроса ключом -k. Метка времени и nonce входят в подпись
+// и меняются на каждой попытке, поэтому перехваченный запрос сервер повторно не примет.
+func signRequest(req *resty.Request, payload []byte) {
+	if flagKey == "" {
+		return
+	}
+	ts := time.Now().Unix()
+	nonce := cryptohelpers.NewNonce()
+	req.SetHeader("HashSHA256", cryptohelpers.SignRequest(payload, flagKey, ts, nonce))
+	req.SetHeader(cryptohelpers.HeaderTimestamp, strconv.FormatInt(ts, 10))
+	req.SetHeader(cryptohelpers.HeaderNonce, nonce)
+}
+
+// encryptPayload шифрует тело открытым ключом сервера; без -crypto-key возвращает его как есть.
+// Порядок обработки тела: JSON → подпись HMAC → шифрование → gzip; сервер проходит его в обратную сторону.
+func encryptPayload(payload []byte) ([]byte, error) {
+	if payloadEncryptor == nil {
+		return payload, nil
 	}
+	return payloadEncryptor.Encrypt(payload)
+}
+
+// setAgentHeaders выставляет заголовки, общие для всех запросов агента: подпись исходного JSON,
+// алгоритм шифрования, арендатора и IP агента для проверки доверенной подсети на сервере
+func setAgentHeaders(req *resty.Request, payload []byte) {
+	signRequest(req, payload) // HMAC-SHA256 от JSON вместе с меткой времени и nonce
+	if payloadEncryptor != nil {
+		req.SetHeader(payloadcrypto.Header, payloadEncryptor.Alg())
+	}
+	if flagTenant != "" {
+		req.SetHeader(tenant.Header, flagTenant) // метрики попадут в раздел арендатора
+	}
+	if agentIP != "" {
+		req.SetHeader(realIPHeader, agentIP)
+	}
+}
+
+// setCounterHeaders помечает батч накопительных счётчиков (см. metricBatch.Started)
+func setCounterHeaders(req *resty.Request, started string) {
+	if started == "" {
+		return
+	}
+	req.SetHeader(counters.ModeHeader, counters.ModeCumulative)
+	req.SetHeader(counters.InstanceHeader, flagInstance)
+	req.SetHeader(counters.StartedHeader, started)
+}
+
+// realIPHeader — заголовок с IP агента, сервер сверяет его с доверенной подсетью
+const realIPHeader = "X-Real-IP"
+
+// agentIP — адрес, с которого агент ходит на сервер (см. outboundIP)
+var agentIP string
+
+// agentStarted — время запуска агента: с него считаются итоги накопительных счётчиков
+var agentStarted = time.Now()
+
+// outboundIP возвращает локальный IP, через который идёт маршрут до сервера.
+// UDP-«соединение» пакетов не отправляет, а только выбирает маршрут и локальный адрес.
+func outboundIP(serverURL string) string {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
 }
 
 // sendMetricJSON отправляет одну метрику на сервер в формате JSON, сжатом через gzip
-func (a *Agent) sendMetricJSON(metric models.Metrics) error {
+// ctx прерывает ретраи, например по истечении срока остановки агента
+func (a *Agent) sendMetricJSON(ctx context.Context, metric models.Metrics) error {
+	if a.GRPC != nil {
+		return a.GRPC.update(ctx, metric)
+	}
 
 	// Сериализуем метрику в JSON
 	var jsonBuf bytes.Buffer
@@ -51,10 +171,17 @@ func (a *Agent) sendMetricJSON(metric models.Metrics) error {
 		return err
 	}
 
-	// Сжимаем JSON в gzip
+	// Шифруем JSON открытым ключом сервера (если задан -crypto-key); подписывается исходный JSON
+	body, err := encryptPayload(jsonBuf.Bytes())
+	if err != nil {
+		logger.Log.Debug("encrypt error:", zap.Error(err))
+		return err
+	}
+
+	// Сжимаем в gzip
 	var gzBuf bytes.Buffer
 	gz := gzip.NewWriter(&gzBuf)
-	if _, err := gz.Write(jsonBuf.Bytes()); err != nil {
+	if _, err := gz.Write(body); err != nil {
 		logger.Log.Debug("gzip write error:", zap.Error(err))
 		return err
 	}
@@ -64,18 +191,18 @@ func (a *Agent) sendMetricJSON(metric models.Metrics) error {
 	}
 
 	// Отправляем сжатый JSON
-	return retry.DoIf(context.Background(), httpDelays, func(ctx context.Context) error {
+	idemKey := cryptohelpers.NewNonce()
+	return retry.DoIf(ctx, httpDelays, func(ctx context.Context) error {
 
 		req := a.Client.R().
+			SetContext(ctx).
 			SetHeader("Content-Type", "application/json").
 			SetHeader("Content-Encoding", "gzip").
 			SetHeader("Accept-Encoding", "gzip"). // Говорим серверу: "Я поддерживаю сжатые ответы"
+			SetHeader(idempotencyKeyHeader, idemKey).
 			SetBody(gzBuf.Bytes())
 
-		if flagKey != "" {
-			hashStr := cryptohelpers.Sign(jsonBuf.Bytes(), flagKey) // Вычисляем HMAC-SHA256 от JSON
-			req.SetHeader("HashSHA256", hashStr)
-		}
+		setAgentHeaders(req, jsonBuf.Bytes())
 
 		resp, err := req.Post(a.ServerURL + "/update")
 		if err != nil {
@@ -146,71 +273,95 @@ func (a *Agent) collectMetrics() {
 	a.Metrics["Sys"] = float64(m.Sys)
 	a.Metrics["TotalAlloc"] = float64(m.TotalAlloc)
 
-	a.RandomValue = rand.Float64() // Обновляем случайное значение метрики
-	a.PollCount++                  // Увеличиваем счётчик обновлений
+	// PauseNs — кольцевой буфер последних 256 пауз, пауза сборки номер i лежит в PauseNs[(i+255)%256].
+	// Наблюдаем только паузы, случившиеся после предыдущего опроса.
+	a.histMu.Lock()
+	if m.NumGC > a.lastNumGC {
+		n := m.NumGC - a.lastNumGC
+		if n > uint32(len(m.PauseNs)) {
+			n = uint32(len(m.PauseNs))
+		}
+		for i := m.NumGC - n + 1; i <= m.NumGC; i++ {
+			a.GCPauses.Observe(float64(m.PauseNs[(i+255)%256]) / float64(time.Second))
+		}
+		a.lastNumGC = m.NumGC
+	}
+	a.histMu.Unlock()
+
+	a.pollCount.add(1) // Увеличиваем счётчик обновлений
 }
 
 func main() {
 
 	parseFlags() // обрабатываем аргументы командной строки
 
+	if err := logger.Initialize("INFO"); err != nil {
+		log.Fatal(err)
+	}
+
 	// запускаем агента
 	reportInterval := time.Duration(flagReportInterval) * time.Second // Интервал отправки метрик на сервер, по умолчанию 10 секунд
 	pollInterval := time.Duration(flagPollInterval) * time.Second     // Интервал обновления метрик, по умолчанию 2 секунды
 
+	agentIP = outboundIP(flagRunAddr) // IP для заголовка X-Real-IP
+
 	agent := NewAgent(flagRunAddr) // Создаём нового агента с адресом сервера
+	if flagTransport == transportGRPC {
+		sender, err := newGRPCSender(flagRunAddr)
+		if err != nil {
+			logger.Log.Fatal("grpc client", zap.Error(err))
+		}
+		defer sender.Close()
+		agent.GRPC = sender
+	}
 
 	// Канал заданий на отправку
 	jobs := make(chan models.Metrics, 2048)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// SIGINT/SIGTERM/SIGQUIT останавливают опрос и формирование заданий; очередь отправляется в drainJobs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
 
-	// (а) Сбор runtime по pollInterval — только обновляет состояние агентa
+	// Коллекторы (-collectors) опрашиваются каждый со своим интервалом; батчер копит их метрики
+	// и отправляет раз в reportInterval
+	collectors, err := newCollectors(agent, flagCollectors, pollInterval)
+	if err != nil {
+		logger.Log.Fatal("collectors", zap.Error(err))
+	}
+	var producers sync.WaitGroup
+	producers.Add(1)
 	go func() {
-		t := time.NewTicker(pollInterval)
-		defer t.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-t.C:
-				agent.collectMetrics()
-			}
-		}
+		defer producers.Done()
+		runCollectors(ctx, collectors, jobs)
 	}()
 
-	// (б) Формирование заданий для отправки по reportInterval
-	go func() {
-		t := time.NewTicker(reportInterval)
-		defer t.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-t.C:
-				// gauge из карты
-				for name, val := range agent.Metrics {
-					v := val
-					jobs <- models.Metrics{ID: name, MType: "gauge", Value: &v}
-				}
-				// RandomValue как gauge
-				rv := agent.RandomValue
-				jobs <- models.Metrics{ID: "RandomValue", MType: "gauge", Value: &rv}
-				// PollCount как counter
-				pc := agent.PollCount
-				jobs <- models.Metrics{ID: "PollCount", MType: "counter", Delta: &pc}
-			}
+	// Батчер собирает задания в батчи для /updates; пул воркеров ограничивает число
+	// одновременных исходящих запросов. Оба переживают сигнал остановки, чтобы отправить накопленную очередь.
+	batcher := NewBatcher(agent.ServerURL+"/updates", reportInterval, flagBatchSize, flagBatchBytes)
+	batcher.grpc = agent.GRPC
+	if flagQueueDir != "" {
+		spool, err := openDiskQueue(flagQueueDir, flagQueueMaxBytes)
+		if err != nil {
+			logger.Log.Fatal("disk queue", zap.String("dir", flagQueueDir), zap.Error(err))
 		}
-	}()
-
-	// (в) Системные метрики через gopsutil (каждые 5s)
-	go collectSysLoop(ctx, 5*time.Second, jobs)
+		batcher.backlog = spool
+	}
 
-	// Пул воркеров ограничивает число одновременных исходящих запросов
-	_ = startWorkers(ctx, flagRateLimit, jobs, agent)
+	sendCtx, cancelSend := context.WithCancel(context.Background())
+	defer cancelSend()
+	batches := make(chan metricBatch, flagRateLimit)
+	workers := startWorkers(sendCtx, flagRateLimit, batches, batcher)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		batcher.Run(sendCtx, jobs, batches)
+	}()
 
-	// Блокируемся (упрощённо). Для graceful shutdown можно ловить SIGINT/SIGTERM.
-	select {}
+	// отложенные батчи (в том числе прошлым запуском, если очередь на диске) досылаются по порядку
+	go batcher.runReplay(ctx, reportInterval)
 
+	<-ctx.Done()
+	logger.Log.Info("Shutting down agent", zap.Int("queued", len(jobs)), zap.Duration("timeout", flagShutdownTimeout))
+	flushed, spooled, dropped := drainJobs(jobs, batches, &producers, workers, cancelSend, batcher, flagShutdownTimeout)
+	logger.Log.Info("Agent stopped", zap.Int64("flushed", flushed), zap.Int64("spooled", spooled), zap.Int64("dropped", dropped))
 }
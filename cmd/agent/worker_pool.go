@@ -2,13 +2,15 @@ package main
 
 import (
 	"context"
-	"log"
 	"sync"
+	"time"
 
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
 )
 
-func startWorkers(ctx context.Context, n int, jobs <-chan models.Metrics, agent *Agent) *sync.WaitGroup {
+// startWorkers запускает n воркеров, которые отправляют батчи из batches, пока канал не закрыт.
+// Отмена ctx прерывает отправку: ретраи останавливаются, прерванный батч уходит в очередь.
+func startWorkers(ctx context.Context, n int, batches <-chan metricBatch, b *Batcher) *sync.WaitGroup {
 	if n < 1 {
 		n = 1
 	}
@@ -16,22 +18,73 @@ func startWorkers(ctx context.Context, n int, jobs <-chan models.Metrics, agent
 	wg.Add(n)
 
 	for i := 0; i < n; i++ {
-		go func(id int) {
+		go func() {
 			defer wg.Done()
 			for {
 				select {
 				case <-ctx.Done():
 					return
-				case m, ok := <-jobs:
+				case batch, ok := <-batches:
 					if !ok {
 						return
 					}
-					if err := agent.sendMetricJSON(m); err != nil {
-						log.Printf("[worker %d] send error for %s: %v", id, m.ID, err)
-					}
+					b.deliver(ctx, batch)
 				}
 			}
-		}(i + 1)
+		}()
 	}
 	return &wg
 }
+
+// drainJobs дожидается, пока продюсеры перестанут ставить задания, закрывает jobs
+// и даёт батчеру и воркерам отправить очередь. Если за timeout не успели, stopWorkers прерывает
+// отправку, а недоотправленное откладывается в очередь (см. Batcher.stash).
+// flushed — доставлено после начала остановки; spooled — отложено на диск; dropped — потеряно.
+func drainJobs(jobs chan models.Metrics, batches chan metricBatch, producers, workers *sync.WaitGroup,
+	stopWorkers context.CancelFunc, b *Batcher, timeout time.Duration) (flushed, spooled, dropped int64) {
+	sent, queued, failed := b.sent.Load(), b.spooled.Load(), b.failed.Load()
+
+	done := make(chan struct{})
+	go func() {
+		producers.Wait() // новых заданий больше не будет
+		close(jobs)
+		workers.Wait() // батчер закроет batches, когда разберёт jobs
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		// продюсер может так и остаться заблокированным на полной очереди — процесс всё равно завершается
+		stopWorkers()
+		workers.Wait()
+		// батчер и воркеры остановлены: всё, что осталось в каналах, откладываем в очередь
+		for batch := range batches {
+			b.stash(batch)
+		}
+		var rest []models.Metrics
+	drain:
+		for {
+			select {
+			case m, ok := <-jobs:
+				if !ok {
+					break drain
+				}
+				rest = append(rest, m)
+			default:
+				break drain
+			}
+		}
+		if len(rest) > 0 {
+			b.stash(newMetricBatch(rest))
+		}
+	}
+
+	flushed, spooled, dropped = b.sent.Load()-sent, b.spooled.Load()-queued, b.failed.Load()-failed
+	// очередь в памяти остановку не переживёт: всё, что в ней осталось, потеряно
+	if q, ok := b.backlog.(*memQueue); ok {
+		dropped += q.metrics()
+		spooled = 0
+	}
+	return flushed, spooled, dropped
+}
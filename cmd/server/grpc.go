@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/grpcapi"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/middleware"
+	pb "github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/proto"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+)
+
+// newGRPCServer собирает gRPC-сервер с теми же проверками, что у HTTP-маршрутов:
+// логирование, арендатор, доверенная подсеть для изменяющих методов и подпись
+// для Update, UpdateBatch, GetValue и каждого сообщения потока Push.
+func newGRPCServer(storage repository.Storage, guard *middleware.GRPCGuard, tlsCfg *tls.Config) *grpc.Server {
+	guard.Mutating = map[string]bool{
+		grpcapi.MethodUpdate:      true,
+		grpcapi.MethodUpdateBatch: true,
+		grpcapi.MethodPush:        true,
+	}
+	guard.Signed = map[string]bool{
+		grpcapi.MethodUpdate:      true,
+		grpcapi.MethodUpdateBatch: true,
+		grpcapi.MethodGetValue:    true,
+		grpcapi.MethodPush:        true,
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(logger.UnaryRequestLogger, guard.Unary()),
+		grpc.ChainStreamInterceptor(logger.StreamRequestLogger, guard.Stream()),
+	}
+	if tlsCfg != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+	srv := grpc.NewServer(opts...)
+	pb.RegisterMetricsServer(srv, grpcapi.NewServer(storage))
+	return srv
+}
+
+// startGRPCServer начинает слушать addr и обслуживает gRPC в отдельной горутине
+func startGRPCServer(addr string, storage repository.Storage, guard *middleware.GRPCGuard, tlsCfg *tls.Config) (*grpc.Server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("grpc listen: %w", err)
+	}
+	srv := newGRPCServer(storage, guard, tlsCfg)
+	logger.Log.Info("Running gRPC server", zap.String("address", addr), zap.Bool("tls", tlsCfg != nil))
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			logger.Log.Error("grpc server stopped", zap.Error(err))
+		}
+	}()
+	return srv, nil
+}
+
+// stopGRPCServer дожидается завершения текущих вызовов и потоков, но не дольше timeout;
+// затем обрывает оставшиеся
+func stopGRPCServer(srv *grpc.Server, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.Log.Warn("grpc graceful stop timed out, closing remaining calls")
+		srv.Stop()
+	}
+}
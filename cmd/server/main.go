@@ -1,23 +1,36 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/counters"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/handler"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/middleware"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/payloadcrypto"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tenant"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tlsconfig"
 	"github.com/go-chi/chi/v5"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 // handler обрабатывает POST-запросы на /update/{type}/{name}/{value}
@@ -40,7 +53,10 @@ func updateHandler(storage repository.Storage) http.HandlerFunc {
 				http.Error(w, "Invalid gauge value", http.StatusBadRequest)
 				return
 			}
-			storage.UpdateGauge(r.Context(), name, value)
+			if err := repository.UpdateGauge(r.Context(), storage, name, value); err != nil {
+				http.Error(w, "storage error", http.StatusInternalServerError)
+				return
+			}
 
 		case "counter":
 			value, err := strconv.ParseInt(valueStr, 10, 64)
@@ -48,7 +64,13 @@ func updateHandler(storage repository.Storage) http.HandlerFunc {
 				http.Error(w, "Invalid counter value", http.StatusBadRequest)
 				return
 			}
-			storage.UpdateCounter(r.Context(), name, value)
+			m, commit := counters.ToDeltas(r.Context(), []models.Metrics{{ID: name, MType: models.Counter, Delta: &value}})
+			err = repository.UpdateCounter(r.Context(), storage, name, *m[0].Delta)
+			commit(err == nil)
+			if err != nil {
+				http.Error(w, "storage error", http.StatusInternalServerError)
+				return
+			}
 
 		default:
 			http.Error(w, "Invalid metric type", http.StatusBadRequest)
@@ -72,6 +94,10 @@ func updateHandlerJSON(storage repository.Storage) http.HandlerFunc {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
+		if err := m.ValidateLabels(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		switch m.MType {
 		case "gauge":
@@ -79,19 +105,76 @@ func updateHandlerJSON(storage repository.Storage) http.HandlerFunc {
 				http.Error(w, "missing gauge value", http.StatusBadRequest)
 				return
 			}
-			storage.UpdateGauge(r.Context(), m.ID, *m.Value)
 		case "counter":
 			if m.Delta == nil {
 				http.Error(w, "missing counter delta", http.StatusBadRequest)
 				return
 			}
-			storage.UpdateCounter(r.Context(), m.ID, *m.Delta)
+		case models.Histogram:
+			if _, ok := storage.(repository.HistogramStorage); !ok {
+				http.Error(w, "histograms are not supported by storage", http.StatusNotImplemented)
+				return
+			}
+			if m.Histogram == nil {
+				http.Error(w, "missing histogram", http.StatusBadRequest)
+				return
+			}
+			if err := m.Histogram.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case models.Summary:
+			if _, ok := storage.(repository.SummaryStorage); !ok {
+				http.Error(w, "summaries are not supported by storage", http.StatusNotImplemented)
+				return
+			}
+			if m.Summary == nil {
+				http.Error(w, "missing summary", http.StatusBadRequest)
+				return
+			}
+			if err := m.Summary.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 		default:
 			http.Error(w, "unknown metric type", http.StatusNotImplemented)
 			return
 		}
 
-		if err := handler.WriteSignedJSONResponse(w, m, flagKey); err != nil {
+		// в накопительном режиме итог счётчика заменяется приращением; в ответе остаётся присланное значение
+		batch, commit := counters.ToDeltas(r.Context(), []models.Metrics{m})
+		defer commit(false)
+
+		// с ключом идемпотентности метрика применяется как батч из одного элемента, не больше одного раза
+		handled, applied, ok := handler.ApplyOnce(w, r, storage, batch)
+		if handled && !ok {
+			return
+		}
+		if !handled {
+			var err error
+			switch m.MType {
+			case "gauge":
+				err = repository.UpdateGauge(r.Context(), storage, m.Key(), *m.Value)
+			case "counter":
+				err = repository.UpdateCounter(r.Context(), storage, m.Key(), *batch[0].Delta)
+			case models.Histogram:
+				err = storage.(repository.HistogramStorage).UpdateHistogram(r.Context(), m.Key(), m.Histogram)
+			case models.Summary:
+				err = storage.(repository.SummaryStorage).UpdateSummary(r.Context(), m.Key(), m.Summary)
+			}
+			if errors.Is(err, models.ErrBoundsMismatch) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, "storage error", http.StatusInternalServerError)
+				return
+			}
+			applied = true
+		}
+		commit(applied)
+
+		if err := handler.WriteSignedJSONResponse(w, m, tenant.KeyOr(r.Context(), flagKey)); err != nil {
 			logger.Log.Debug("error writing signed response", zap.Error(err))
 		}
 
@@ -106,29 +189,57 @@ func valueHandlerJSON(storage repository.Storage) http.HandlerFunc {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
+		if err := m.ValidateLabels(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		//w.Header().Set("Content-Type", "application/json")
 		switch m.MType {
 		case "gauge":
-			val, ok := storage.GetGauge(r.Context(), m.ID)
+			val, ok := storage.GetGauge(r.Context(), m.Key())
 			if !ok {
 				http.Error(w, "not found", http.StatusNotFound)
 				return
 			}
 			m.Value = &val
 		case "counter":
-			val, ok := storage.GetCounter(r.Context(), m.ID)
+			val, ok := storage.GetCounter(r.Context(), m.Key())
 			if !ok {
 				http.Error(w, "not found", http.StatusNotFound)
 				return
 			}
 			m.Delta = &val
+		case models.Histogram:
+			hs, ok := storage.(repository.HistogramStorage)
+			if !ok {
+				http.Error(w, "histograms are not supported by storage", http.StatusNotImplemented)
+				return
+			}
+			h, ok := hs.GetHistogram(r.Context(), m.Key())
+			if !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			m.Histogram = h
+		case models.Summary:
+			ss, ok := storage.(repository.SummaryStorage)
+			if !ok {
+				http.Error(w, "summaries are not supported by storage", http.StatusNotImplemented)
+				return
+			}
+			sm, ok := ss.GetSummary(r.Context(), m.Key())
+			if !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			m.Summary = sm
 		default:
 			http.Error(w, "unknown metric type", http.StatusNotImplemented)
 			return
 		}
 
-		_ = handler.WriteSignedJSONResponse(w, m, flagKey)
+		_ = handler.WriteSignedJSONResponse(w, m, tenant.KeyOr(r.Context(), flagKey))
 	}
 }
 
@@ -214,6 +325,36 @@ func initPostgres(dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
+// cumulativeCountersTTL — сколько помнить итог накопительного счётчика агента, который перестал его присылать
+const cumulativeCountersTTL = 24 * time.Hour
+
+// Виды хранилища для флага -storage
+const (
+	storageMemory   = "memory"
+	storagePostgres = "postgres"
+	storageBolt     = "bolt"
+)
+
+// storageKind определяет хранилище: явно заданное флагом -storage или,
+// если он пуст, PostgreSQL при заданном DSN и память без него
+func storageKind(kind, dsn string) (string, error) {
+	switch kind {
+	case "":
+		if dsn != "" {
+			return storagePostgres, nil
+		}
+		return storageMemory, nil
+	case storagePostgres:
+		if dsn == "" {
+			return "", errors.New("-storage=postgres requires -d")
+		}
+		return kind, nil
+	case storageMemory, storageBolt:
+		return kind, nil
+	}
+	return "", fmt.Errorf("unknown storage type %q (want memory, postgres or bolt)", kind)
+}
+
 func main() {
 
 	// обрабатываем аргументы командной строки
@@ -232,24 +373,66 @@ func run() error {
 		return err
 	}
 
-	db, err := initPostgres(flagDatabaseDSN)
+	// SIGINT/SIGTERM/SIGQUIT отменяют ctx: сервер перестаёт принимать запросы,
+	// дожидается текущих и сохраняет последний снимок (см. shutdown)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	kind, err := storageKind(flagStorageType, flagDatabaseDSN)
+	if err != nil {
+		return err
+	}
+	var dsn string
+	if kind == storagePostgres {
+		dsn = flagDatabaseDSN
+	}
+
+	db, err := initPostgres(dsn)
 	if err != nil {
 		return err
 	}
+	if db != nil {
+		defer func() {
+			if err := db.Close(); err != nil {
+				logger.Log.Warn("Failed to close DB", zap.Error(err))
+			}
+		}()
+	}
 
 	if db != nil {
-		if err := repository.RunMigrations(flagDatabaseDSN); err != nil {
+		if err := repository.RunMigrations(dsn); err != nil {
 			return fmt.Errorf("failed to run migrations: %w", err)
 		}
 	}
 
 	var storage repository.Storage
-	if db != nil {
+	switch kind {
+	case storagePostgres:
 		storage = repository.NewPostgresStorage(db)
-	} else {
+	case storageBolt:
+		boltStorage, err := repository.NewBoltStorage(flagBoltPath)
+		if err != nil {
+			return fmt.Errorf("failed to open bolt storage: %w", err)
+		}
+		defer func() {
+			if err := boltStorage.Close(); err != nil {
+				logger.Log.Warn("Failed to close bolt storage", zap.Error(err))
+			}
+		}()
+		logger.Log.Info("Opened bolt storage", zap.String("path", flagBoltPath))
+		storage = boltStorage
+	default:
 		storage = repository.NewMemStorage()
 	}
 
+	if memStorage, ok := storage.(*repository.MemStorage); ok {
+		perm, err := strconv.ParseUint(flagSnapshotPerm, 8, 32)
+		if err != nil || perm > 0o777 {
+			return fmt.Errorf("invalid snapshot permissions %q", flagSnapshotPerm)
+		}
+		memStorage.SetSnapshotOptions(flagSnapshotKeep, fs.FileMode(perm))
+	}
+
 	// загружаем метрики из файла, если включено
 	if memStorage, ok := storage.(*repository.MemStorage); ok && flagRestore && flagFileStoragePath != "" {
 		if err := memStorage.LoadFromFile(flagFileStoragePath); err != nil {
@@ -257,9 +440,63 @@ func run() error {
 		}
 	}
 
+	// журнал изменений накатывается поверх восстановленного снимка
+	if memStorage, ok := storage.(*repository.MemStorage); ok && flagWALPath != "" {
+		policy, err := repository.ParseWALSyncPolicy(flagWALSync)
+		if err != nil {
+			return err
+		}
+		if err := memStorage.OpenWAL(flagWALPath, policy, flagRestore); err != nil {
+			return fmt.Errorf("failed to open WAL: %w", err)
+		}
+	}
+
+	// STORE_INTERVAL=0 — снимок пишется синхронно на каждое изменение
+	if memStorage, ok := storage.(*repository.MemStorage); ok && flagStoreInterval == 0 && flagFileStoragePath != "" {
+		memStorage.EnableSyncStore(flagFileStoragePath)
+	}
+
 	// запуск периодического сохранения, если установлен интервал > 0
+	var storeDone chan struct{}
 	if memStorage, ok := storage.(*repository.MemStorage); ok && flagStoreInterval > 0 && flagFileStoragePath != "" {
-		go memStorage.PeriodicStore(flagFileStoragePath, time.Duration(flagStoreInterval)*time.Second)
+		storeDone = make(chan struct{})
+		go func() {
+			defer close(storeDone)
+			memStorage.PeriodicStore(ctx, flagFileStoragePath, time.Duration(flagStoreInterval)*time.Second)
+		}()
+	}
+
+	tenantKeys, err := tenant.ParseKeys(flagTenantKeys)
+	if err != nil {
+		return fmt.Errorf("invalid tenant keys: %w", err)
+	}
+	tenants := tenant.NewRegistry(flagKey, tenantKeys)
+
+	signMode, err := middleware.ParseSignMode(flagSignMode)
+	if err != nil {
+		return err
+	}
+	signStats := &middleware.SignatureStats{}
+	var replayGuard *middleware.ReplayGuard
+	if flagReplayWindow > 0 {
+		replayGuard = middleware.NewReplayGuard(flagReplayWindow)
+	}
+
+	trusted, err := middleware.ParseSubnets(flagTrustedSubnet)
+	if err != nil {
+		return err
+	}
+
+	var decryptor *payloadcrypto.Decryptor
+	if flagCryptoKey != "" {
+		if decryptor, err = payloadcrypto.LoadPrivateKey(flagCryptoKey); err != nil {
+			return err
+		}
+	}
+
+	var counterTracker *counters.Tracker
+	if flagCumulativeCounters {
+		counterTracker = counters.NewTracker(cumulativeCountersTTL)
 	}
 
 	r := chi.NewRouter()
@@ -269,28 +506,140 @@ func run() error {
 	// Добавляем middleware для обработки gzip-запросов и ответов
 	r.Use(gzipRequestMiddleware)
 	r.Use(gzipResponseMiddleware)
+	// расшифровка тела: после распаковки gzip и до проверки подписи
+	r.Use(middleware.DecryptBody(decryptor))
+	// Арендатор (X-Tenant-ID) определяет раздел хранилища и ключ подписи
+	r.Use(middleware.ResolveTenant(tenants))
+	// накопительные счётчики (X-Counter-Mode: cumulative) принимаются только с -cumulative-counters
+	r.Use(middleware.CumulativeCounters(counterTracker))
+
+	// в режиме strict подпись обязательна на /update, /updates и /value (см. -sign-mode);
+	// запросы арендатора не по умолчанию без подписи его ключом отклоняются в любом режиме
+	hashMiddleware := middleware.RequireHashSHA256(flagKey, signMode, signStats, replayGuard)
+
+	// изменяющие маршруты доступны только из доверенных подсетей (-t); чтение открыто
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.TrustedSubnet(trusted))
 
-	r.Post("/update/{type}/{name}/{value}", updateHandler(storage)) // Регистрируем маршрут с параметрами
+		r.With(hashMiddleware).Post("/update/{type}/{name}/{value}", updateHandler(storage)) // Регистрируем маршрут с параметрами
 
-	hashMiddleware := middleware.ValidateHashSHA256(flagKey)
+		r.With(hashMiddleware).Post("/update", updateHandlerJSON(storage))
+		r.With(hashMiddleware).Post("/update/", updateHandlerJSON(storage))
 
-	r.With(hashMiddleware).Post("/update", updateHandlerJSON(storage))
-	r.With(hashMiddleware).Post("/update/", updateHandlerJSON(storage))
+		r.With(hashMiddleware).Post("/updates", handler.UpdatesHandler(storage, flagKey))
+		r.With(hashMiddleware).Post("/updates/", handler.UpdatesHandler(storage, flagKey))
+	})
 
-	r.With(hashMiddleware).Post("/updates", handler.UpdatesHandler(storage, flagKey))
-	r.With(hashMiddleware).Post("/updates/", handler.UpdatesHandler(storage, flagKey))
+	r.With(hashMiddleware).Post("/value", valueHandlerJSON(storage))
+	r.With(hashMiddleware).Post("/value/", valueHandlerJSON(storage))
 
-	r.Post("/value", valueHandlerJSON(storage))
-	r.Post("/value/", valueHandlerJSON(storage))
+	// чтение без подписи открыто только для арендатора по умолчанию: данные остальных
+	// отдаются по запросу, подписанному ключом арендатора (пустое тело, метка времени и nonce)
+	readMiddleware := middleware.RequireHashSHA256(flagKey, middleware.SignOptional, signStats, replayGuard)
+	r.Group(func(r chi.Router) {
+		r.Use(readMiddleware)
 
-	r.Get("/value/{type}/{name}", valueHandler(storage))
-	r.Get("/", indexHandler(storage))
+		r.Get("/value/{type}/{name}", valueHandler(storage))
+		r.Get("/history/{type}/{name}", handler.HistoryHandler(storage, flagKey))
+		r.Get("/", indexHandler(storage))
+		r.Get("/metrics", handler.PrometheusHandler(storage, signStats.Counters)) // экспорт для Prometheus
+	})
 
 	if db != nil {
 		r.Get("/ping", pingHandler(db)) //проверяет соединение с базой данных.
 	}
 
-	logger.Log.Info("Running server", zap.String("address", flagRunAddr))
+	var tlsCfg *tls.Config
+	if flagTLSCert != "" || flagTLSKey != "" {
+		if tlsCfg, err = tlsconfig.Server(flagTLSCert, flagTLSKey, flagTLSClientCA); err != nil {
+			return err
+		}
+	} else if flagTLSClientCA != "" {
+		return errors.New("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+
+	var grpcSrv *grpc.Server
+	if flagGRPCAddr != "" {
+		guard := &middleware.GRPCGuard{
+			Tenants: tenants,
+			Trusted: trusted,
+			Key:     flagKey,
+			Mode:    signMode,
+			Stats:   signStats,
+			Replay:  replayGuard,
+
+			Counters: counterTracker,
+		}
+		if grpcSrv, err = startGRPCServer(flagGRPCAddr, storage, guard, tlsCfg); err != nil {
+			return err
+		}
+	}
+
+	lis, err := net.Listen("tcp", flagRunAddr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: r, TLSConfig: tlsCfg}
+	logger.Log.Info("Running server", zap.String("address", flagRunAddr),
+		zap.Bool("tls", tlsCfg != nil), zap.Bool("mtls", flagTLSClientCA != ""))
+
+	err = serve(ctx, srv, lis, flagShutdownTimeout)
+	stop()
+	shutdown(storage, grpcSrv, storeDone)
+	return err
+}
+
+// serve обслуживает lis, пока не отменён ctx, затем вызывает http.Server.Shutdown:
+// новые соединения не принимаются, а начатые запросы (например, /updates) завершаются,
+// но не дольше timeout
+func serve(ctx context.Context, srv *http.Server, lis net.Listener, timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// сертификат уже загружен в TLSConfig
+			errCh <- srv.ServeTLS(lis, "", "")
+			return
+		}
+		errCh <- srv.Serve(lis)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
 
-	return http.ListenAndServe(flagRunAddr, r)
+	logger.Log.Info("Shutting down server", zap.Duration("timeout", timeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("http shutdown: %w", err)
+	}
+	return nil
+}
+
+// shutdown останавливает gRPC и периодическое сохранение и пишет последний снимок
+// MemStorage в файл, чтобы не потерять метрики, пришедшие после последнего тика
+func shutdown(storage repository.Storage, grpcSrv *grpc.Server, storeDone <-chan struct{}) {
+	if grpcSrv != nil {
+		stopGRPCServer(grpcSrv, flagShutdownTimeout)
+	}
+	if storeDone != nil {
+		<-storeDone
+	}
+	memStorage, ok := storage.(*repository.MemStorage)
+	if !ok {
+		return
+	}
+	if flagFileStoragePath != "" {
+		if err := memStorage.SaveToFile(flagFileStoragePath); err != nil {
+			logger.Log.Error("Failed to save metrics on shutdown", zap.Error(err))
+		} else {
+			logger.Log.Info("Metrics saved on shutdown", zap.String("path", flagFileStoragePath))
+		}
+	}
+	// если снимок не записался, изменения остаются в журнале
+	if err := memStorage.CloseWAL(); err != nil {
+		logger.Log.Error("Failed to close WAL", zap.Error(err))
+	}
 }
@@ -1,18 +1,54 @@
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/counters"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/cryptohelpers"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/grpcapi"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/handler"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/middleware"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/payloadcrypto"
+	pb "github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/proto"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tenant"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tlsconfig"
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestUpdateHandler_TableDriven(t *testing.T) {
@@ -340,3 +376,1578 @@ func TestValueHandlerJSON_GzipResponse(t *testing.T) {
 
 	assert.Contains(t, string(uncompressed), `"value":2.718`)
 }
+
+func TestHistoryHandler(t *testing.T) {
+	storage := repository.NewMemStorage()
+	for _, v := range []float64{1, 2, 6} {
+		storage.UpdateGauge(context.Background(), "HGauge", v)
+	}
+	storage.UpdateCounter(context.Background(), "HCounter", 2)
+	storage.UpdateCounter(context.Background(), "HCounter", 3)
+
+	r := chi.NewRouter()
+	r.Get("/history/{type}/{name}", handler.HistoryHandler(storage, ""))
+
+	now := time.Now()
+	from := now.Add(-time.Minute).Unix()
+	to := now.Add(time.Minute).Unix()
+
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+		wantValues []float64
+	}{
+		{"raw gauge", fmt.Sprintf("/history/gauge/HGauge?from=%d&to=%d", from, to), http.StatusOK, []float64{1, 2, 6}},
+		{"gauge avg", fmt.Sprintf("/history/gauge/HGauge?from=%d&to=%d&step=5m", from, to), http.StatusOK, []float64{3}},
+		{"gauge max", fmt.Sprintf("/history/gauge/HGauge?from=%d&to=%d&step=300&agg=max", from, to), http.StatusOK, []float64{6}},
+		{"gauge last", fmt.Sprintf("/history/gauge/HGauge?from=%d&to=%d&step=5m&agg=last", from, to), http.StatusOK, []float64{6}},
+		{"counter increase", fmt.Sprintf("/history/counter/HCounter?from=%d&to=%d&step=5m", from, to), http.StatusOK, []float64{5}},
+		{"unknown metric", fmt.Sprintf("/history/gauge/none?from=%d&to=%d", from, to), http.StatusOK, []float64{}},
+		{"empty range", fmt.Sprintf("/history/gauge/HGauge?from=%d&to=%d", to, to+60), http.StatusOK, []float64{}},
+		{"bad step", "/history/gauge/HGauge?step=abc", http.StatusBadRequest, nil},
+		{"step overflows duration", "/history/gauge/HGauge?step=9300000000000", http.StatusBadRequest, nil},
+		{"negative step overflows duration", "/history/gauge/HGauge?step=-9300000000000", http.StatusBadRequest, nil},
+		{"bad agg", "/history/gauge/HGauge?step=1m&agg=median", http.StatusBadRequest, nil},
+		{"too many points", "/history/gauge/HGauge?step=1ms", http.StatusBadRequest, nil},
+		{"bad type", "/history/unknown/HGauge", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+			if tt.wantValues == nil {
+				return
+			}
+
+			var points []handler.HistoryPoint
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(&points))
+			values := make([]float64, 0, len(points))
+			for _, p := range points {
+				values = append(values, p.Value)
+			}
+			assert.Equal(t, tt.wantValues, values)
+		})
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	storage := repository.NewMemStorage()
+	storage.UpdateGauge(context.Background(), "HeapAlloc", 1.5)
+	storage.UpdateGauge(context.Background(), "CPU.util-1", 42)
+	storage.UpdateCounter(context.Background(), "PollCount", 7)
+
+	r := chi.NewRouter()
+	r.Get("/metrics", handler.PrometheusHandler(storage))
+
+	tests := []struct {
+		name            string
+		accept          string
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			name:            "text format",
+			wantContentType: "text/plain; version=0.0.4; charset=utf-8",
+			wantBody: "# TYPE CPU_util_1 gauge\nCPU_util_1 42\n" +
+				"# TYPE HeapAlloc gauge\nHeapAlloc 1.5\n" +
+				"# TYPE PollCount counter\nPollCount 7\n",
+		},
+		{
+			name:            "openmetrics",
+			accept:          "application/openmetrics-text;version=1.0.0,text/plain;q=0.5",
+			wantContentType: "application/openmetrics-text; version=1.0.0; charset=utf-8",
+			wantBody: "# TYPE CPU_util_1 gauge\nCPU_util_1 42\n" +
+				"# TYPE HeapAlloc gauge\nHeapAlloc 1.5\n" +
+				"# TYPE PollCount counter\nPollCount_total 7\n" +
+				"# EOF\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			res := w.Result()
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, tt.wantContentType, res.Header.Get("Content-Type"))
+			assert.Equal(t, tt.wantBody, string(body))
+		})
+	}
+}
+
+func TestPrometheusHandler_FamilyCollisions(t *testing.T) {
+	storage := repository.NewMemStorage()
+	ctx := context.Background()
+	storage.UpdateGauge(ctx, "Requests", 1)
+	storage.UpdateCounter(ctx, "Requests", 2)
+	storage.UpdateGauge(ctx, "a.b", 3)
+	storage.UpdateGauge(ctx, "a_b", 4)
+	storage.UpdateGauge(ctx, "Jobs", 5)
+	storage.UpdateCounter(ctx, "Jobs_total", 6)
+
+	r := chi.NewRouter()
+	r.Get("/metrics", handler.PrometheusHandler(storage))
+	scrape := func(accept string) string {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	// у каждого имени — одна строка # TYPE; конфликтующие семейства пропущены
+	assert.Equal(t, "# TYPE Jobs gauge\nJobs 5\n"+
+		"# TYPE Jobs_total counter\nJobs_total 6\n"+
+		"# TYPE Requests counter\nRequests 2\n"+
+		"# TYPE a_b gauge\na_b 3\n", scrape(""))
+	// в OpenMetrics counter Jobs_total — семейство Jobs, которое уже занято gauge
+	assert.Equal(t, "# TYPE Jobs gauge\nJobs 5\n"+
+		"# TYPE Requests counter\nRequests_total 2\n"+
+		"# TYPE a_b gauge\na_b 3\n"+
+		"# EOF\n", scrape("application/openmetrics-text"))
+}
+
+func TestSanitizePromName(t *testing.T) {
+	assert.Equal(t, "HeapAlloc", handler.SanitizePromName("HeapAlloc"))
+	assert.Equal(t, "disk_used_bytes", handler.SanitizePromName("disk.used-bytes"))
+	assert.Equal(t, "_1st", handler.SanitizePromName("1st"))
+	assert.Equal(t, "ns:metric", handler.SanitizePromName("ns:metric"))
+	assert.Equal(t, "_", handler.SanitizePromName(""))
+}
+
+func TestUpdateHandlerJSON_Labels(t *testing.T) {
+	storage := repository.NewMemStorage()
+	update := updateHandlerJSON(storage)
+	value := valueHandlerJSON(storage)
+
+	post := func(h http.HandlerFunc, body string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		h(rr, req)
+		res := rr.Result()
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	// одна метрика с разными метками — разные серии; без меток — ещё одна
+	code, _ := post(update, `{"id":"CPUutilization","type":"gauge","value":10,"labels":{"cpu":"1"}}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = post(update, `{"id":"CPUutilization","type":"gauge","value":20,"labels":{"cpu":"2"}}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = post(update, `{"id":"CPUutilization","type":"gauge","value":30}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = post(update, `{"id":"Requests","type":"counter","delta":2,"labels":{"b":"y","a":"x"}}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = post(update, `{"id":"Requests","type":"counter","delta":3,"labels":{"a":"x","b":"y"}}`)
+	assert.Equal(t, http.StatusOK, code)
+
+	v, ok := storage.GetGauge(context.Background(), `CPUutilization{cpu="2"}`)
+	assert.True(t, ok)
+	assert.Equal(t, 20.0, v)
+	v, ok = storage.GetGauge(context.Background(), "CPUutilization")
+	assert.True(t, ok)
+	assert.Equal(t, 30.0, v)
+	c, ok := storage.GetCounter(context.Background(), `Requests{a="x",b="y"}`)
+	assert.True(t, ok)
+	assert.Equal(t, int64(5), c)
+
+	code, body := post(value, `{"id":"CPUutilization","type":"gauge","labels":{"cpu":"1"}}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"value":10`)
+	assert.Contains(t, body, `"labels":{"cpu":"1"}`)
+
+	code, _ = post(value, `{"id":"CPUutilization","type":"gauge","labels":{"cpu":"3"}}`)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = post(update, `{"id":"Bad","type":"gauge","value":1,"labels":{"1bad":"x"}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// метки попадают в вывод /metrics одним семейством
+	r := chi.NewRouter()
+	r.Get("/metrics", handler.PrometheusHandler(storage))
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+	out, _ := io.ReadAll(res.Body)
+	assert.Equal(t, "# TYPE CPUutilization gauge\n"+
+		"CPUutilization 30\n"+
+		"CPUutilization{cpu=\"1\"} 10\n"+
+		"CPUutilization{cpu=\"2\"} 20\n"+
+		"# TYPE Requests counter\n"+
+		"Requests{a=\"x\",b=\"y\"} 5\n", string(out))
+}
+
+func TestSeriesKeyRoundTrip(t *testing.T) {
+	labels := map[string]string{"path": `C:\tmp "x"`, "host": "a,b"}
+	key := models.SeriesKey("Disk", labels)
+	assert.Equal(t, `Disk{host="a,b",path="C:\\tmp \"x\""}`, key)
+
+	name, parsed, err := models.ParseSeriesKey(key)
+	assert.NoError(t, err)
+	assert.Equal(t, "Disk", name)
+	assert.Equal(t, labels, parsed)
+
+	assert.Equal(t, "Plain", models.SeriesKey("Plain", nil))
+	_, _, err = models.ParseSeriesKey(`Broken{a="x"`)
+	assert.Error(t, err)
+}
+
+func TestUpdateHandlerJSON_Histogram(t *testing.T) {
+	storage := repository.NewMemStorage()
+	update := updateHandlerJSON(storage)
+
+	post := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/update", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		update(rr, req)
+		res := rr.Result()
+		defer res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, post(`{"id":"GCPause","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[1,2,0],"sum":1.5}}`))
+	assert.Equal(t, http.StatusOK, post(`{"id":"GCPause","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[0,1,3],"sum":7}}`))
+	assert.Equal(t, http.StatusConflict, post(`{"id":"GCPause","type":"histogram","histogram":{"bounds":[0.5],"counts":[1,0],"sum":0.2}}`))
+	assert.Equal(t, http.StatusBadRequest, post(`{"id":"GCPause","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[1],"sum":0}}`))
+	assert.Equal(t, http.StatusBadRequest, post(`{"id":"GCPause","type":"histogram"}`))
+
+	h, ok := storage.GetHistogram(context.Background(), "GCPause")
+	assert.True(t, ok)
+	assert.Equal(t, []uint64{1, 3, 3}, h.Counts)
+	assert.Equal(t, 8.5, h.Sum)
+
+	r := chi.NewRouter()
+	r.Get("/metrics", handler.PrometheusHandler(storage))
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+	out, _ := io.ReadAll(res.Body)
+	assert.Equal(t, "# TYPE GCPause histogram\n"+
+		"GCPause_bucket{le=\"0.1\"} 1\n"+
+		"GCPause_bucket{le=\"1\"} 4\n"+
+		"GCPause_bucket{le=\"+Inf\"} 7\n"+
+		"GCPause_sum 8.5\n"+
+		"GCPause_count 7\n", string(out))
+}
+
+func TestUpdatesHandler_HistogramBatchIsAtomic(t *testing.T) {
+	storage := repository.NewMemStorage()
+	h := handler.UpdatesHandler(storage, "")
+
+	body := `[{"id":"C","type":"counter","delta":1},` +
+		`{"id":"H","type":"histogram","histogram":{"bounds":[1],"counts":[1,0],"sum":0.5}},` +
+		`{"id":"H","type":"histogram","histogram":{"bounds":[2],"counts":[1,0],"sum":0.5}}]`
+	req := httptest.NewRequest(http.MethodPost, "/updates", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	h(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+	_, ok := storage.GetCounter(context.Background(), "C")
+	assert.False(t, ok)
+	_, ok = storage.GetHistogram(context.Background(), "H")
+	assert.False(t, ok)
+}
+
+func TestUpdateHandlerJSON_Summary(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, "metrics.json")
+	walPath := filepath.Join(dir, "metrics.wal")
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	assert.NoError(t, storage.OpenWAL(walPath, repository.WALSyncAlways, true))
+
+	call := func(h http.HandlerFunc, body string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/update", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		h(rr, req)
+		res := rr.Result()
+		defer res.Body.Close()
+		out, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(out)
+	}
+	update := updateHandlerJSON(storage)
+
+	code, _ := call(update, `{"id":"Latency","type":"summary","summary":{"count":2,"sum":3,"quantiles":[{"quantile":0.5,"value":1},{"quantile":0.99,"value":2}]}}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(handler.UpdatesHandler(storage, ""), `[{"id":"Latency","type":"summary","summary":{"count":3,"sum":4,"quantiles":[{"quantile":0.5,"value":1.5},{"quantile":0.99,"value":2.5}]}}]`)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(update, `{"id":"Latency","type":"summary","summary":{"count":1,"sum":1,"quantiles":[{"quantile":0.9,"value":1}]}}`)
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = call(update, `{"id":"Latency","type":"summary","summary":{"count":1,"sum":1,"quantiles":[{"quantile":1.5,"value":1}]}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call(update, `{"id":"Latency","type":"summary"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, body := call(valueHandlerJSON(storage), `{"id":"Latency","type":"summary"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"summary":{"count":5,"sum":7,"quantiles":[{"quantile":0.5,"value":1.5},{"quantile":0.99,"value":2.5}]}`)
+
+	want := "# TYPE Latency summary\n" +
+		"Latency{quantile=\"0.5\"} 1.5\n" +
+		"Latency{quantile=\"0.99\"} 2.5\n" +
+		"Latency_sum 7\n" +
+		"Latency_count 5\n"
+	prom := func(s repository.Storage) string {
+		rr := httptest.NewRecorder()
+		handler.PrometheusHandler(s)(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rr.Body.String()
+	}
+	assert.Equal(t, want, prom(storage))
+
+	// сводка восстанавливается и из журнала, и из снимка
+	assert.NoError(t, storage.CloseWAL())
+	restored := repository.NewMemStorage()
+	assert.NoError(t, restored.OpenWAL(walPath, repository.WALSyncAlways, true))
+	assert.Equal(t, want, prom(restored))
+	assert.NoError(t, restored.SaveToFile(snapshot))
+	assert.NoError(t, restored.CloseWAL())
+
+	fromSnapshot := repository.NewMemStorage()
+	assert.NoError(t, fromSnapshot.LoadFromFile(snapshot))
+	sm, ok := fromSnapshot.GetSummary(ctx, "Latency")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(5), sm.Count)
+	assert.Equal(t, want, prom(fromSnapshot))
+}
+
+func TestTenantIsolation(t *testing.T) {
+	storage := repository.NewMemStorage()
+	reg := tenant.NewRegistry("", map[string]string{"team-a": "key-a", "team-b": "key-b"})
+
+	r := chi.NewRouter()
+	r.Use(middleware.ResolveTenant(reg))
+	r.With(middleware.ValidateHashSHA256("")).Post("/updates", handler.UpdatesHandler(storage, ""))
+	r.With(middleware.ValidateHashSHA256("")).Post("/update/{type}/{name}/{value}", updateHandler(storage))
+	r.With(middleware.ValidateHashSHA256("")).Get("/value/{type}/{name}", valueHandler(storage))
+
+	do := func(method, path, tenantID, key, body string) (int, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if tenantID != "" {
+			req.Header.Set(tenant.Header, tenantID)
+		}
+		if key != "" {
+			ts, nonce := time.Now().Unix(), cryptohelpers.NewNonce()
+			req.Header.Set("HashSHA256", cryptohelpers.SignRequest([]byte(body), key, ts, nonce))
+			req.Header.Set(cryptohelpers.HeaderTimestamp, strconv.FormatInt(ts, 10))
+			req.Header.Set(cryptohelpers.HeaderNonce, nonce)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		res := rr.Result()
+		defer res.Body.Close()
+		resBody, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(resBody)
+	}
+	post := func(tenantID, key, body string) int {
+		code, _ := do(http.MethodPost, "/updates", tenantID, key, body)
+		return code
+	}
+	get := func(tenantID, key string) string {
+		_, body := do(http.MethodGet, "/value/counter/PollCount", tenantID, key, "")
+		return body
+	}
+
+	body := `[{"id":"PollCount","type":"counter","delta":5}]`
+	assert.Equal(t, http.StatusOK, post("team-a", "key-a", body))
+	assert.Equal(t, http.StatusOK, post("team-b", "key-b", body))
+	assert.Equal(t, http.StatusOK, post("team-b", "key-b", body))
+
+	// подпись чужим ключом и неизвестный арендатор отклоняются
+	assert.Equal(t, http.StatusBadRequest, post("team-a", "key-b", body))
+	assert.Equal(t, http.StatusForbidden, post("team-c", "key-a", body))
+
+	// без подписи ключом арендатора в его раздел не записать ни через /updates, ни через URL,
+	// и подпись только тела (без метки времени и nonce) тоже не подходит
+	assert.Equal(t, http.StatusUnauthorized, post("team-a", "", body))
+	code, _ := do(http.MethodPost, "/update/counter/PollCount/100", "team-a", "", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	legacy := httptest.NewRequest(http.MethodPost, "/updates", strings.NewReader(body))
+	legacy.Header.Set(tenant.Header, "team-a")
+	legacy.Header.Set("HashSHA256", cryptohelpers.Sign([]byte(body), "key-a"))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, legacy)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	code, _ = do(http.MethodPost, "/update/counter/PollCount/1", "team-a", "key-a", "")
+	assert.Equal(t, http.StatusOK, code)
+
+	// чтение данных арендатора — тоже только с его подписью
+	assert.Equal(t, "6", get("team-a", "key-a"))
+	assert.Equal(t, "10", get("team-b", "key-b"))
+	assert.Contains(t, get("team-b", ""), "tenant requests must be signed")
+	assert.Contains(t, get("team-b", "key-a"), "invalid signature")
+	assert.Contains(t, get("", ""), "not found")
+
+	// снапшот сохраняет разделение по арендаторам
+	path := t.TempDir() + "/metrics.json"
+	assert.NoError(t, storage.SaveToFile(path))
+	restored := repository.NewMemStorage()
+	assert.NoError(t, restored.LoadFromFile(path))
+	ctxB := tenant.WithTenant(context.Background(), tenant.Tenant{ID: "team-b"})
+	v, ok := restored.GetCounter(ctxB, "PollCount")
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), v)
+	_, ok = restored.GetCounter(context.Background(), "PollCount")
+	assert.False(t, ok)
+}
+
+func TestRequireHashSHA256_Modes(t *testing.T) {
+	body := `{"id":"Alloc","type":"gauge","value":1.5}`
+
+	tests := []struct {
+		name     string
+		mode     middleware.SignMode
+		sign     string
+		wantCode int
+		wantStat map[string]int64
+	}{
+		{name: "optional unsigned", mode: middleware.SignOptional, wantCode: http.StatusOK,
+			wantStat: map[string]int64{"server_unsigned_requests_accepted": 0, "server_unsigned_requests_rejected": 0}},
+		{name: "grace unsigned", mode: middleware.SignGrace, wantCode: http.StatusOK,
+			wantStat: map[string]int64{"server_unsigned_requests_accepted": 1}},
+		{name: "strict unsigned", mode: middleware.SignStrict, wantCode: http.StatusUnauthorized,
+			wantStat: map[string]int64{"server_unsigned_requests_rejected": 1}},
+		{name: "strict signed", mode: middleware.SignStrict, sign: "secret", wantCode: http.StatusOK,
+			wantStat: map[string]int64{"server_unsigned_requests_rejected": 0}},
+		{name: "strict wrong key", mode: middleware.SignStrict, sign: "other", wantCode: http.StatusBadRequest,
+			wantStat: map[string]int64{"server_invalid_signatures_rejected": 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := repository.NewMemStorage()
+			stats := &middleware.SignatureStats{}
+			r := chi.NewRouter()
+			r.With(middleware.RequireHashSHA256("secret", tt.mode, stats, nil)).Post("/update", updateHandlerJSON(storage))
+			r.Get("/metrics", handler.PrometheusHandler(storage, stats.Counters))
+
+			req := httptest.NewRequest(http.MethodPost, "/update", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.sign != "" {
+				req.Header.Set("HashSHA256", cryptohelpers.Sign([]byte(body), tt.sign))
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			assert.Equal(t, tt.wantCode, rr.Code)
+
+			counters := stats.Counters()
+			for name, want := range tt.wantStat {
+				assert.Equal(t, want, counters[name], name)
+			}
+
+			rr = httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			assert.Contains(t, rr.Body.String(), "# TYPE server_unsigned_requests_rejected counter")
+		})
+	}
+}
+
+func TestParseSignMode(t *testing.T) {
+	m, err := middleware.ParseSignMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, middleware.SignOptional, m)
+
+	m, err = middleware.ParseSignMode("strict")
+	assert.NoError(t, err)
+	assert.Equal(t, middleware.SignStrict, m)
+
+	_, err = middleware.ParseSignMode("always")
+	assert.Error(t, err)
+}
+
+func TestRequireHashSHA256_LegacyReplay(t *testing.T) {
+	body := `[{"id":"PollCount","type":"counter","delta":1}]`
+
+	tests := []struct {
+		mode         middleware.SignMode
+		wantCode     int
+		wantCounter  int64
+		wantAccepted int64
+		wantRejected int64
+	}{
+		{mode: middleware.SignOptional, wantCode: http.StatusOK, wantCounter: 2, wantAccepted: 2},
+		{mode: middleware.SignGrace, wantCode: http.StatusOK, wantCounter: 2, wantAccepted: 2},
+		{mode: middleware.SignStrict, wantCode: http.StatusUnauthorized, wantRejected: 2},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			storage := repository.NewMemStorage()
+			stats := &middleware.SignatureStats{}
+			r := chi.NewRouter()
+			r.With(middleware.RequireHashSHA256("secret", tt.mode, stats, middleware.NewReplayGuard(time.Minute))).
+				Post("/updates", handler.UpdatesHandler(storage, "secret"))
+
+			// один и тот же запрос с подписью только тела, отправленный дважды: защита от повторов
+			// его не ловит, поэтому он учитывается как неподписанный, а не как подписанный
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/updates", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("HashSHA256", cryptohelpers.Sign([]byte(body), "secret"))
+				rr := httptest.NewRecorder()
+				r.ServeHTTP(rr, req)
+				assert.Equal(t, tt.wantCode, rr.Code)
+			}
+
+			v, _ := storage.GetCounter(context.Background(), "PollCount")
+			assert.Equal(t, tt.wantCounter, v)
+			counters := stats.Counters()
+			assert.Equal(t, tt.wantAccepted, counters["server_unsigned_requests_accepted"])
+			assert.Equal(t, tt.wantRejected, counters["server_unsigned_requests_rejected"])
+			assert.Equal(t, int64(0), counters["server_replayed_requests_rejected"])
+		})
+	}
+}
+
+func TestRequireHashSHA256_Replay(t *testing.T) {
+	storage := repository.NewMemStorage()
+	stats := &middleware.SignatureStats{}
+	r := chi.NewRouter()
+	r.With(middleware.RequireHashSHA256("secret", middleware.SignStrict, stats, middleware.NewReplayGuard(time.Minute))).
+		Post("/updates", handler.UpdatesHandler(storage, "secret"))
+
+	body := `[{"id":"PollCount","type":"counter","delta":1}]`
+	post := func(ts int64, nonce string, legacy bool) int {
+		req := httptest.NewRequest(http.MethodPost, "/updates", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if legacy {
+			req.Header.Set("HashSHA256", cryptohelpers.Sign([]byte(body), "secret"))
+		} else {
+			req.Header.Set("HashSHA256", cryptohelpers.SignRequest([]byte(body), "secret", ts, nonce))
+			req.Header.Set(cryptohelpers.HeaderTimestamp, strconv.FormatInt(ts, 10))
+			req.Header.Set(cryptohelpers.HeaderNonce, nonce)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	now := time.Now().Unix()
+	assert.Equal(t, http.StatusOK, post(now, "a1", false))
+	assert.Equal(t, http.StatusConflict, post(now, "a1", false), "повтор того же запроса")
+	assert.Equal(t, http.StatusOK, post(now, "a2", false))
+	assert.Equal(t, http.StatusUnauthorized, post(now-int64(2*time.Minute/time.Second), "a3", false), "устаревшая метка времени")
+	assert.Equal(t, http.StatusUnauthorized, post(0, "", true), "подпись только тела в strict")
+
+	// метку времени нельзя подменить без ключа
+	req := httptest.NewRequest(http.MethodPost, "/updates", strings.NewReader(body))
+	req.Header.Set("HashSHA256", cryptohelpers.SignRequest([]byte(body), "secret", now, "a4"))
+	req.Header.Set(cryptohelpers.HeaderTimestamp, strconv.FormatInt(now+1, 10))
+	req.Header.Set(cryptohelpers.HeaderNonce, "a4")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// nonce не из алфавита NewNonce отклоняется до HMAC и кеша повторов, даже с верной подписью
+	for name, nonce := range map[string]string{
+		"пустой":          "",
+		"слишком длинный": strings.Repeat("a", cryptohelpers.MaxNonceLen+1),
+		"не hex":          "nonce-1",
+		"заглавные буквы": "ABCDEF",
+		"перевод строки":  "a5\nfake",
+	} {
+		assert.Equal(t, http.StatusBadRequest, post(now, nonce, false), name)
+	}
+	assert.Equal(t, http.StatusOK, post(now, strings.Repeat("b", cryptohelpers.MaxNonceLen), false), "nonce предельной длины")
+
+	v, _ := storage.GetCounter(context.Background(), "PollCount")
+	assert.Equal(t, int64(3), v)
+
+	counters := stats.Counters()
+	assert.Equal(t, int64(1), counters["server_replayed_requests_rejected"])
+	assert.Equal(t, int64(1), counters["server_stale_requests_rejected"])
+	assert.Equal(t, int64(6), counters["server_invalid_signatures_rejected"])
+}
+
+func TestIdempotentUpdates(t *testing.T) {
+	storage := repository.NewMemStorage()
+	r := chi.NewRouter()
+	r.Post("/updates", handler.UpdatesHandler(storage, ""))
+	r.Post("/update", updateHandlerJSON(storage))
+
+	post := func(path, body, idemKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if idemKey != "" {
+			req.Header.Set(handler.IdempotencyKeyHeader, idemKey)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	batch := `[{"id":"PollCount","type":"counter","delta":3}]`
+	first := post("/updates", batch, "batch-1")
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Empty(t, first.Header().Get(handler.IdempotentReplayedHeader))
+
+	// ретрай того же батча: тот же ответ, но счётчик не удваивается
+	retried := post("/updates", batch, "batch-1")
+	assert.Equal(t, http.StatusOK, retried.Code)
+	assert.Equal(t, "true", retried.Header().Get(handler.IdempotentReplayedHeader))
+	assert.Equal(t, first.Body.String(), retried.Body.String())
+
+	single := `{"id":"PollCount","type":"counter","delta":2}`
+	assert.Equal(t, http.StatusOK, post("/update", single, "one-1").Code)
+	assert.Equal(t, http.StatusOK, post("/update", single, "one-1").Code)
+
+	// без ключа — прежнее поведение
+	assert.Equal(t, http.StatusOK, post("/updates", batch, "").Code)
+
+	v, _ := storage.GetCounter(context.Background(), "PollCount")
+	assert.Equal(t, int64(3+2+3), v)
+
+	// ключи разных арендаторов не пересекаются
+	one := int64(1)
+	ctxA := tenant.WithTenant(context.Background(), tenant.Tenant{ID: "team-a"})
+	applied, err := storage.UpdateBatchOnce(ctxA, "batch-1", []models.Metrics{{ID: "PollCount", MType: "counter", Delta: &one}})
+	assert.NoError(t, err)
+	assert.True(t, applied)
+
+	// батч с ошибкой не запоминает ключ
+	bad := `[{"id":"h","type":"histogram","histogram":{"bounds":[1],"counts":[1,0],"sum":1}},` +
+		`{"id":"h","type":"histogram","histogram":{"bounds":[2],"counts":[1,0],"sum":2}}]`
+	assert.Equal(t, http.StatusConflict, post("/updates", bad, "bad-1").Code)
+	good := `[{"id":"h","type":"histogram","histogram":{"bounds":[1],"counts":[1,0],"sum":1}}]`
+	resp := post("/updates", good, "bad-1")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get(handler.IdempotentReplayedHeader))
+}
+
+func TestCumulativeCounters(t *testing.T) {
+	storage := repository.NewMemStorage()
+	tracker := counters.NewTracker(time.Hour)
+	serverStarted := time.Now()
+
+	r := chi.NewRouter()
+	r.Use(middleware.ResolveTenant(tenant.NewRegistry("", nil)))
+	r.Use(middleware.CumulativeCounters(tracker))
+	r.Post("/updates", handler.UpdatesHandler(storage, ""))
+	r.Post("/update", updateHandlerJSON(storage))
+	r.Post("/update/{type}/{name}/{value}", updateHandler(storage))
+
+	post := func(r http.Handler, path, body, instance string, started time.Time) int {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(counters.ModeHeader, counters.ModeCumulative)
+		req.Header.Set(counters.InstanceHeader, instance)
+		req.Header.Set(counters.StartedHeader, started.Format(time.RFC3339Nano))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	total := func(v int) string {
+		return fmt.Sprintf(`[{"id":"PollCount","type":"counter","delta":%d}]`, v)
+	}
+	counter := func() int64 {
+		v, _ := storage.GetCounter(context.Background(), "PollCount")
+		return v
+	}
+
+	run1 := serverStarted.Add(time.Second)
+	steps := []struct {
+		name     string
+		path     string
+		body     string
+		instance string
+		started  time.Time
+		want     int64
+	}{
+		{"new agent counts from zero", "/updates", total(5), "a", run1, 5},
+		{"increase", "/updates", total(8), "a", run1, 8},
+		{"same total is not added again", "/update", `{"id":"PollCount","type":"counter","delta":8}`, "a", run1, 8},
+		{"late smaller total is ignored", "/updates", total(6), "a", run1, 8},
+		{"other instance is tracked separately", "/update/counter/PollCount/4", "", "b", run1, 12},
+		{"restart resets the total", "/updates", total(3), "a", run1.Add(time.Minute), 15},
+		{"batch of the previous run is ignored", "/updates", total(9), "a", run1, 15},
+		{"agent started before server sets a baseline", "/updates", total(100), "c", serverStarted.Add(-time.Hour), 15},
+		{"and counts from it", "/updates", total(101), "c", serverStarted.Add(-time.Hour), 16},
+	}
+	for _, s := range steps {
+		assert.Equal(t, http.StatusOK, post(r, s.path, s.body, s.instance, s.started), s.name)
+		assert.Equal(t, s.want, counter(), s.name)
+	}
+
+	// обычные приращения по-прежнему складываются
+	req := httptest.NewRequest(http.MethodPost, "/updates", strings.NewReader(total(2)))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, int64(18), counter())
+
+	// без -cumulative-counters и без обязательных заголовков — 400
+	disabled := chi.NewRouter()
+	disabled.Use(middleware.CumulativeCounters(nil))
+	disabled.Post("/updates", handler.UpdatesHandler(storage, ""))
+	assert.Equal(t, http.StatusBadRequest, post(disabled, "/updates", total(1), "a", run1))
+	assert.Equal(t, http.StatusBadRequest, post(r, "/updates", total(1), "", run1))
+	assert.Equal(t, int64(18), counter())
+
+	// батч, который хранилище не применило, итог не сдвигает: повтор того же итога прибавляет приращение
+	assert.Equal(t, http.StatusOK, post(r, "/updates", total(10), "d", run1))
+	assert.Equal(t, int64(28), counter())
+	assert.NoError(t, storage.UpdateHistogram(context.Background(), "Latency",
+		&models.HistogramData{Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 1}))
+	mismatch := `[{"id":"PollCount","type":"counter","delta":15},` +
+		`{"id":"Latency","type":"histogram","histogram":{"bounds":[5],"counts":[1,0],"sum":1}}]`
+	assert.Equal(t, http.StatusConflict, post(r, "/updates", mismatch, "d", run1))
+	assert.Equal(t, int64(28), counter())
+	assert.Equal(t, http.StatusOK, post(r, "/updates", total(15), "d", run1))
+	assert.Equal(t, int64(33), counter())
+
+	// повтор батча по ключу идемпотентности не применяется и итог тоже не сдвигает
+	postOnce := func(body, key string) {
+		req := httptest.NewRequest(http.MethodPost, "/updates", strings.NewReader(body))
+		req.Header.Set(counters.ModeHeader, counters.ModeCumulative)
+		req.Header.Set(counters.InstanceHeader, "d")
+		req.Header.Set(counters.StartedHeader, run1.Format(time.RFC3339Nano))
+		req.Header.Set(handler.IdempotencyKeyHeader, key)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+	postOnce(total(17), "batch-1")
+	assert.Equal(t, int64(35), counter())
+	postOnce(total(20), "batch-1")
+	assert.Equal(t, int64(35), counter())
+	assert.Equal(t, http.StatusOK, post(r, "/updates", total(20), "d", run1))
+	assert.Equal(t, int64(38), counter())
+}
+
+// writeTestCert выпускает сертификат, подписанный parent (nil — самоподписанный CA), и пишет PEM в dir
+func writeTestCert(t *testing.T, dir, name string, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test-ca"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: notAfter,
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeTestCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "metrics-server"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: notAfter,
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeTestCert(t, dir, "agent", &x509.Certificate{
+		SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "agent-1", Organization: []string{"team-a"}},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: notAfter,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	serverCfg, err := tlsconfig.Server(path("server.crt"), path("server.key"), path("ca.crt"))
+	assert.NoError(t, err)
+
+	core, logs := observer.New(zap.InfoLevel)
+	oldLog := logger.Log
+	logger.Log = zap.New(core)
+	defer func() { logger.Log = oldLog }()
+
+	srv := httptest.NewUnstartedServer(logger.RequestLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, tlsconfig.PeerIdentity(r.TLS))
+	})))
+	srv.TLS = serverCfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	// агент с клиентским сертификатом
+	clientCfg, err := tlsconfig.Client(path("ca.crt"), path("agent.crt"), path("agent.key"))
+	assert.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg}}
+	resp, err := client.Get(srv.URL)
+	if assert.NoError(t, err) {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "agent-1", string(body))
+	}
+	entries := logs.FilterField(zap.String("agent", "agent-1")).All()
+	assert.Len(t, entries, 1)
+
+	// без клиентского сертификата сервер рвёт рукопожатие
+	noCertCfg, err := tlsconfig.Client(path("ca.crt"), "", "")
+	assert.NoError(t, err)
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: noCertCfg}}
+	if resp, err := client.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("request without client certificate must fail")
+	}
+
+	_, err = tlsconfig.Client("", path("agent.crt"), "")
+	assert.Error(t, err)
+}
+
+// writeTestKeys пишет пару ключей в PEM: открытый (PKIX) и закрытый (PKCS#8)
+func writeTestKeys(t *testing.T, dir, name string, pub, priv any) (string, string) {
+	t.Helper()
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPath, privPath := filepath.Join(dir, name+".pub"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pubPath, privPath
+}
+
+func TestEncryptedPayload(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, rsaPriv := writeTestKeys(t, dir, "rsa", &rsaKey.PublicKey, rsaKey)
+	xPub, xPriv := writeTestKeys(t, dir, "x25519", xKey.PublicKey(), xKey)
+
+	for _, tc := range []struct{ name, pub, priv, alg string }{
+		{"rsa", rsaPub, rsaPriv, payloadcrypto.AlgRSA},
+		{"x25519", xPub, xPriv, payloadcrypto.AlgX25519},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			enc, err := payloadcrypto.LoadPublicKey(tc.pub)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.alg, enc.Alg())
+			dec, err := payloadcrypto.LoadPrivateKey(tc.priv)
+			assert.NoError(t, err)
+
+			storage := repository.NewMemStorage()
+			r := chi.NewRouter()
+			r.Use(gzipRequestMiddleware)
+			r.Use(middleware.DecryptBody(dec))
+			r.With(middleware.ValidateHashSHA256("secret")).Post("/update", updateHandlerJSON(storage))
+
+			// порядок агента: JSON → подпись → шифрование → gzip
+			plain := []byte(`{"id":"PollCount","type":"counter","delta":7}`)
+			ciphertext, err := enc.Encrypt(plain)
+			assert.NoError(t, err)
+			assert.NotContains(t, string(ciphertext), "PollCount")
+
+			send := func(body []byte, alg string) int {
+				var gz bytes.Buffer
+				zw := gzip.NewWriter(&gz)
+				_, _ = zw.Write(body)
+				_ = zw.Close()
+				req := httptest.NewRequest(http.MethodPost, "/update", &gz)
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Content-Encoding", "gzip")
+				req.Header.Set(payloadcrypto.Header, alg)
+				req.Header.Set("HashSHA256", cryptohelpers.Sign(plain, "secret"))
+				rr := httptest.NewRecorder()
+				r.ServeHTTP(rr, req)
+				return rr.Code
+			}
+
+			assert.Equal(t, http.StatusOK, send(ciphertext, tc.alg))
+			v, _ := storage.GetCounter(context.Background(), "PollCount")
+			assert.Equal(t, int64(7), v)
+
+			// испорченный шифротекст и чужой алгоритм отклоняются
+			broken := append([]byte(nil), ciphertext...)
+			broken[len(broken)-1] ^= 0xff
+			assert.Equal(t, http.StatusBadRequest, send(broken, tc.alg))
+			other := payloadcrypto.AlgRSA
+			if tc.alg == payloadcrypto.AlgRSA {
+				other = payloadcrypto.AlgX25519
+			}
+			assert.Equal(t, http.StatusBadRequest, send(ciphertext, other))
+		})
+	}
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	nets, err := middleware.ParseSubnets("10.0.0.0/8, 192.168.1.0/24")
+	assert.NoError(t, err)
+	_, err = middleware.ParseSubnets("10.0.0.0")
+	assert.Error(t, err)
+
+	storage := repository.NewMemStorage()
+	r := chi.NewRouter()
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.TrustedSubnet(nets))
+		r.Post("/update/{type}/{name}/{value}", updateHandler(storage))
+	})
+	r.Get("/value/{type}/{name}", valueHandler(storage))
+
+	do := func(method, target, realIP, remote string) int {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = remote
+		if realIP != "" {
+			req.Header.Set(middleware.RealIPHeader, realIP)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/update/counter/c/1", "10.1.2.3", "203.0.113.5:4000"))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/update/counter/c/1", "172.16.0.1", "10.0.0.1:4000"))
+	// без заголовка — адрес соединения
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/update/counter/c/1", "", "192.168.1.10:4000"))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/update/counter/c/1", "", "203.0.113.5:4000"))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/update/counter/c/1", "not-an-ip", "10.0.0.1:4000"))
+	// чтение доступно откуда угодно
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/value/counter/c", "", "203.0.113.5:4000"))
+
+	v, _ := storage.GetCounter(context.Background(), "c")
+	assert.Equal(t, int64(2), v)
+}
+
+func TestGRPCServer(t *testing.T) {
+	storage := repository.NewMemStorage()
+	nets, _ := middleware.ParseSubnets("10.0.0.0/8")
+	guard := &middleware.GRPCGuard{
+		Tenants: tenant.NewRegistry("", nil),
+		Trusted: nets,
+		Mode:    middleware.SignOptional,
+	}
+	srv := newGRPCServer(storage, guard, nil)
+	lis := bufconn.Listen(1 << 20)
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewMetricsClient(conn)
+
+	trustedCtx := metadata.AppendToOutgoingContext(context.Background(), "x-real-ip", "10.1.1.1")
+	delta, value := int64(4), 2.5
+
+	_, err = client.Update(trustedCtx, &pb.UpdateRequest{Metric: &pb.Metric{Id: "PollCount", Type: "counter", Delta: &delta}})
+	assert.NoError(t, err)
+
+	// изменяющие методы недоступны вне доверенной подсети, чтение — доступно
+	_, err = client.Update(context.Background(), &pb.UpdateRequest{Metric: &pb.Metric{Id: "PollCount", Type: "counter", Delta: &delta}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	stream, err := client.Push(trustedCtx)
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Send(&pb.Metric{Id: "Alloc", Type: "gauge", Value: &value, Labels: map[string]string{"host": "a"}}))
+	assert.NoError(t, stream.Send(&pb.Metric{Id: "PollCount", Type: "counter", Delta: &delta}))
+	pushed, err := stream.CloseAndRecv()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), pushed.GetReceived())
+
+	// ретрай батча с тем же ключом идемпотентности не применяется повторно
+	batchCtx := metadata.AppendToOutgoingContext(trustedCtx, grpcapi.IdempotencyKeyMD, "b-1")
+	batch := &pb.UpdateBatchRequest{Metrics: []*pb.Metric{{Id: "PollCount", Type: "counter", Delta: &delta}}}
+	resp, err := client.UpdateBatch(batchCtx, batch)
+	assert.NoError(t, err)
+	assert.True(t, resp.GetApplied())
+	resp, err = client.UpdateBatch(batchCtx, batch)
+	assert.NoError(t, err)
+	assert.False(t, resp.GetApplied())
+
+	got, err := client.GetValue(context.Background(), &pb.GetValueRequest{Id: "PollCount", Type: "counter"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12), got.GetMetric().GetDelta())
+
+	_, err = client.GetValue(context.Background(), &pb.GetValueRequest{Id: "missing", Type: "gauge"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	summary := &pb.Summary{Count: 2, Sum: 3, Quantiles: []*pb.Quantile{{Quantile: 0.5, Value: 1}}}
+	_, err = client.Update(trustedCtx, &pb.UpdateRequest{Metric: &pb.Metric{Id: "Latency", Type: "summary", Summary: summary}})
+	assert.NoError(t, err)
+	_, err = client.Update(trustedCtx, &pb.UpdateRequest{Metric: &pb.Metric{Id: "Latency", Type: "summary",
+		Summary: &pb.Summary{Count: 1, Quantiles: []*pb.Quantile{{Quantile: 0.9, Value: 1}}}}})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	got, err = client.GetValue(context.Background(), &pb.GetValueRequest{Id: "Latency", Type: "summary"})
+	assert.NoError(t, err)
+	assert.True(t, proto.Equal(summary, got.GetMetric().GetSummary()))
+
+	list, err := client.List(context.Background(), &pb.ListRequest{})
+	assert.NoError(t, err)
+	if assert.Len(t, list.GetMetrics(), 3) {
+		assert.Equal(t, "PollCount", list.GetMetrics()[0].GetId())
+		assert.Equal(t, map[string]string{"host": "a"}, list.GetMetrics()[1].GetLabels())
+	}
+}
+
+func TestGRPCGuard_Signature(t *testing.T) {
+	storage := repository.NewMemStorage()
+	guard := &middleware.GRPCGuard{Key: "secret", Mode: middleware.SignStrict, Replay: middleware.NewReplayGuard(time.Minute)}
+	srv := newGRPCServer(storage, guard, nil)
+	lis := bufconn.Listen(1 << 20)
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewMetricsClient(conn)
+
+	delta := int64(1)
+	req := &pb.UpdateRequest{Metric: &pb.Metric{Id: "PollCount", Type: "counter", Delta: &delta}}
+	signed := func(key, nonce string) context.Context {
+		payload, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := time.Now().Unix()
+		return metadata.AppendToOutgoingContext(context.Background(),
+			"hashsha256", cryptohelpers.SignRequest(payload, key, ts, nonce),
+			"x-request-timestamp", strconv.FormatInt(ts, 10),
+			"x-request-nonce", nonce,
+		)
+	}
+
+	_, err = client.Update(context.Background(), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.Update(signed("other", "a1"), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	ctx := signed("secret", "a2")
+	_, err = client.Update(ctx, req)
+	assert.NoError(t, err)
+	_, err = client.Update(ctx, req)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "повтор с тем же nonce")
+
+	// List не подписывается, как и GET-маршруты
+	_, err = client.List(context.Background(), &pb.ListRequest{})
+	assert.NoError(t, err)
+
+	// в потоке Push подписано каждое сообщение: подписанные применяются,
+	// подменённое после подписи отклоняется, а уже применённые остаются
+	push := func(metrics ...*pb.Metric) error {
+		stream, err := client.Push(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, m := range metrics {
+			_ = stream.Send(m)
+		}
+		_, err = stream.CloseAndRecv()
+		return err
+	}
+	signedMetric := func(d int64, nonce string) *pb.Metric {
+		m := &pb.Metric{Id: "PollCount", Type: "counter", Delta: &d}
+		assert.NoError(t, grpcapi.SignMetric(m, "secret", time.Now().Unix(), nonce))
+		return m
+	}
+
+	assert.NoError(t, push(signedMetric(2, "b1"), signedMetric(3, "b2")))
+	v, _ := storage.GetCounter(context.Background(), "PollCount")
+	assert.Equal(t, int64(6), v)
+
+	tampered := signedMetric(1, "b3")
+	*tampered.Delta = 1000
+	assert.Equal(t, codes.InvalidArgument, status.Code(push(signedMetric(1, "b4"), tampered)))
+	v, _ = storage.GetCounter(context.Background(), "PollCount")
+	assert.Equal(t, int64(7), v)
+
+	// без подписи в strict, повтор сообщения и чужой ключ тоже отклоняются
+	unsigned := int64(1000)
+	assert.Equal(t, codes.Unauthenticated, status.Code(push(&pb.Metric{Id: "PollCount", Type: "counter", Delta: &unsigned})))
+	assert.Equal(t, codes.AlreadyExists, status.Code(push(signedMetric(1, "b1"))), "повтор с тем же nonce")
+	foreign := &pb.Metric{Id: "PollCount", Type: "counter", Delta: &unsigned}
+	assert.NoError(t, grpcapi.SignMetric(foreign, "other", time.Now().Unix(), "b5"))
+	assert.Equal(t, codes.InvalidArgument, status.Code(push(foreign)))
+
+	v, _ = storage.GetCounter(context.Background(), "PollCount")
+	assert.Equal(t, int64(7), v)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	storage := repository.NewMemStorage()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	oldPath, oldTimeout := flagFileStoragePath, flagShutdownTimeout
+	flagFileStoragePath, flagShutdownTimeout = path, 5*time.Second
+	defer func() { flagFileStoragePath, flagShutdownTimeout = oldPath, oldTimeout }()
+
+	// обработчик, который успевает получить сигнал остановки посреди запроса
+	started := make(chan struct{})
+	r := chi.NewRouter()
+	r.Post("/updates", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		handler.UpdatesHandler(storage, "").ServeHTTP(w, r)
+	})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	storeDone := make(chan struct{})
+	go func() {
+		defer close(storeDone)
+		storage.PeriodicStore(ctx, path, time.Hour)
+	}()
+
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, &http.Server{Handler: r}, lis, flagShutdownTimeout) }()
+
+	respCh := make(chan int, 1)
+	go func() {
+		body := `[{"id":"PollCount","type":"counter","delta":7}]`
+		resp, err := http.Post("http://"+lis.Addr().String()+"/updates", "application/json", strings.NewReader(body))
+		if err != nil {
+			respCh <- 0
+			return
+		}
+		resp.Body.Close()
+		respCh <- resp.StatusCode
+	}()
+
+	<-started
+	cancel()
+
+	// начатый запрос доводится до конца, serve возвращается без ошибки
+	assert.Equal(t, http.StatusOK, <-respCh)
+	assert.NoError(t, <-served)
+
+	// новые соединения больше не принимаются
+	_, err = http.Get("http://" + lis.Addr().String() + "/")
+	assert.Error(t, err)
+
+	// PeriodicStore остановлен, а последний снимок записан при остановке
+	shutdown(storage, nil, storeDone)
+	restored := repository.NewMemStorage()
+	assert.NoError(t, restored.LoadFromFile(path))
+	v, ok := restored.GetCounter(context.Background(), "PollCount")
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), v)
+}
+
+func TestSyncStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	storage := repository.NewMemStorage()
+	storage.EnableSyncStore(path)
+	ctx := context.Background()
+
+	restored := func() *repository.MemStorage {
+		s := repository.NewMemStorage()
+		assert.NoError(t, s.LoadFromFile(path))
+		return s
+	}
+
+	// изменение на диске сразу после возврата из метода
+	storage.UpdateGauge(ctx, "Alloc", 1.5)
+	v, ok := restored().GetGauge(ctx, "Alloc")
+	assert.True(t, ok)
+	assert.Equal(t, 1.5, v)
+
+	one := int64(1)
+	assert.NoError(t, storage.UpdateBatch(ctx, []models.Metrics{{ID: "PollCount", MType: "counter", Delta: &one}}))
+	c, ok := restored().GetCounter(ctx, "PollCount")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), c)
+
+	// одновременные обновления объединяются, но ни одно не теряется
+	const n = 100
+	done := make(chan struct{})
+	for i := 0; i < n; i++ {
+		go func() {
+			storage.UpdateCounter(ctx, "PollCount", 1)
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		<-done
+	}
+	c, _ = restored().GetCounter(ctx, "PollCount")
+	assert.Equal(t, int64(n+1), c)
+
+	// ошибка записи возвращается из UpdateBatch
+	storage.EnableSyncStore(filepath.Join(t.TempDir(), "missing", "metrics.json"))
+	assert.Error(t, storage.UpdateBatch(ctx, []models.Metrics{{ID: "PollCount", MType: "counter", Delta: &one}}))
+}
+
+func TestSnapshotGenerations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	storage.SetSnapshotOptions(3, 0o600)
+
+	for i := 1; i <= 4; i++ {
+		storage.UpdateCounter(ctx, "PollCount", 1)
+		assert.NoError(t, storage.SaveToFile(path))
+	}
+
+	// хранится 3 поколения, временных файлов не остаётся
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.ElementsMatch(t, []string{"metrics.json", "metrics.json.1", "metrics.json.2"}, names)
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	load := func() (int64, error) {
+		s := repository.NewMemStorage()
+		if err := s.LoadFromFile(path); err != nil {
+			return 0, err
+		}
+		v, _ := s.GetCounter(ctx, "PollCount")
+		return v, nil
+	}
+
+	v, err := load()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), v)
+
+	// недописанный снимок: берётся предыдущее поколение
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, data[:len(data)/2], 0o600))
+	v, err = load()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), v)
+
+	// испорченное содержимое при целом JSON ловит контрольная сумма
+	data, err = os.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path+".1", bytes.Replace(data, []byte(`"delta":3`), []byte(`"delta":9`), 1), 0o600))
+	v, err = load()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), v)
+
+	// все поколения испорчены — ошибка, а не пустое хранилище молча
+	assert.NoError(t, os.WriteFile(path+".2", []byte("{"), 0o600))
+	_, err = load()
+	assert.Error(t, err)
+
+	// файл старого формата (массив записей) читается как раньше
+	legacy := filepath.Join(t.TempDir(), "legacy.json")
+	assert.NoError(t, os.WriteFile(legacy, []byte(`[{"id":"PollCount","type":"counter","delta":5}]`), 0o644))
+	s := repository.NewMemStorage()
+	assert.NoError(t, s.LoadFromFile(legacy))
+	v, _ = s.GetCounter(ctx, "PollCount")
+	assert.Equal(t, int64(5), v)
+}
+
+func TestWAL(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, "metrics.json")
+	walPath := filepath.Join(dir, "metrics.wal")
+	ctx := context.Background()
+	one := int64(1)
+
+	// restart эмулирует падение и новый запуск: снимок плюс журнал
+	restart := func(old *repository.MemStorage) *repository.MemStorage {
+		if old != nil {
+			assert.NoError(t, old.CloseWAL())
+		}
+		s := repository.NewMemStorage()
+		assert.NoError(t, s.LoadFromFile(snapshot))
+		assert.NoError(t, s.OpenWAL(walPath, repository.WALSyncAlways, true))
+		return s
+	}
+	counter := func(s *repository.MemStorage) int64 {
+		v, _ := s.GetCounter(ctx, "PollCount")
+		return v
+	}
+
+	s := restart(nil)
+	s.UpdateCounter(ctx, "PollCount", 2)
+	s.UpdateGauge(ctx, "Alloc", 3.5)
+	applied, err := s.UpdateBatchOnce(ctx, "batch-1", []models.Metrics{{ID: "PollCount", MType: "counter", Delta: &one}})
+	assert.NoError(t, err)
+	assert.True(t, applied)
+
+	// без снимка всё восстанавливается из журнала, включая ключ идемпотентности
+	s = restart(s)
+	assert.Equal(t, int64(3), counter(s))
+	g, ok := s.GetGauge(ctx, "Alloc")
+	assert.True(t, ok)
+	assert.Equal(t, 3.5, g)
+	applied, err = s.UpdateBatchOnce(ctx, "batch-1", []models.Metrics{{ID: "PollCount", MType: "counter", Delta: &one}})
+	assert.NoError(t, err)
+	assert.False(t, applied)
+
+	// снимок обрезает журнал, а накат после него не удваивает счётчики
+	assert.NoError(t, s.SaveToFile(snapshot))
+	info, err := os.Stat(walPath)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	s.UpdateCounter(ctx, "PollCount", 10)
+	s = restart(s)
+	assert.Equal(t, int64(13), counter(s))
+
+	// оборванная последняя запись отбрасывается, журнал продолжает работать
+	s.UpdateCounter(ctx, "PollCount", 100)
+	assert.NoError(t, s.CloseWAL())
+	f, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{0x40, 0, 0, 0, 1, 2, 3, 4, '{', '"'})
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	s = restart(nil)
+	assert.Equal(t, int64(113), counter(s))
+	s.UpdateCounter(ctx, "PollCount", 1000)
+	s = restart(s)
+	assert.Equal(t, int64(1113), counter(s))
+
+	// без восстановления (-r=false) старый журнал отбрасывается
+	assert.NoError(t, s.CloseWAL())
+	fresh := repository.NewMemStorage()
+	assert.NoError(t, fresh.OpenWAL(walPath, repository.WALSyncNone, false))
+	assert.Equal(t, int64(0), counter(fresh))
+	assert.NoError(t, fresh.CloseWAL())
+	// остался только снимок: изменения после него были в отброшенном журнале
+	s = restart(nil)
+	assert.Equal(t, int64(3), counter(s))
+	assert.NoError(t, s.CloseWAL())
+}
+
+func TestWALOlderSnapshotGeneration(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, "metrics.json")
+	walPath := filepath.Join(dir, "metrics.wal")
+	ctx := context.Background()
+
+	s := repository.NewMemStorage()
+	s.SetSnapshotOptions(2, 0o600)
+	assert.NoError(t, s.OpenWAL(walPath, repository.WALSyncAlways, true))
+	s.UpdateCounter(ctx, "PollCount", 1)
+	assert.NoError(t, s.SaveToFile(snapshot))
+	s.UpdateCounter(ctx, "PollCount", 2)
+	assert.NoError(t, s.SaveToFile(snapshot))
+	s.UpdateCounter(ctx, "PollCount", 4)
+	assert.NoError(t, s.CloseWAL())
+
+	// новейший снимок испорчен: восстановление берёт предыдущее поколение
+	// и докатывает его журналом, который после нового снимка не удалён
+	data, err := os.ReadFile(snapshot)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(snapshot, data[:len(data)/2], 0o600))
+
+	restored := repository.NewMemStorage()
+	restored.SetSnapshotOptions(2, 0o600)
+	assert.NoError(t, restored.LoadFromFile(snapshot))
+	assert.NoError(t, restored.OpenWAL(walPath, repository.WALSyncAlways, true))
+	v, _ := restored.GetCounter(ctx, "PollCount")
+	assert.Equal(t, int64(7), v)
+
+	// журнал, покрытый всеми поколениями, удаляется
+	assert.NoError(t, restored.SaveToFile(snapshot))
+	assert.NoError(t, restored.SaveToFile(snapshot))
+	segments, err := filepath.Glob(walPath + ".*")
+	assert.NoError(t, err)
+	assert.Len(t, segments, 0)
+	assert.NoError(t, restored.CloseWAL())
+}
+
+func TestUpdateWALFailure(t *testing.T) {
+	storage := repository.NewMemStorage()
+	assert.NoError(t, storage.OpenWAL(filepath.Join(t.TempDir(), "metrics.wal"), repository.WALSyncAlways, true))
+	// закрытый журнал не принимает записи: изменение не применяется, а клиент получает ошибку
+	assert.NoError(t, storage.CloseWAL())
+
+	r := chi.NewRouter()
+	r.Post("/update", updateHandlerJSON(storage))
+	r.Post("/update/{type}/{name}/{value}", updateHandler(storage))
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/update/counter/PollCount/1", nil),
+		httptest.NewRequest(http.MethodPost, "/update/gauge/Alloc/1.5", nil),
+		httptest.NewRequest(http.MethodPost, "/update", strings.NewReader(`{"id":"PollCount","type":"counter","delta":1}`)),
+		httptest.NewRequest(http.MethodPost, "/update", strings.NewReader(`{"id":"Alloc","type":"gauge","value":1.5}`)),
+	} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusInternalServerError, rr.Code, req.URL.Path)
+	}
+
+	delta := int64(1)
+	_, err := grpcapi.NewServer(storage).Update(context.Background(),
+		&pb.UpdateRequest{Metric: &pb.Metric{Id: "PollCount", Type: "counter", Delta: &delta}})
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	_, ok := storage.GetCounter(context.Background(), "PollCount")
+	assert.False(t, ok)
+	_, ok = storage.GetGauge(context.Background(), "Alloc")
+	assert.False(t, ok)
+}
+
+func TestSyncStoreFailure(t *testing.T) {
+	// снимок некуда записать: в режиме STORE_INTERVAL=0 одиночное изменение не подтверждается
+	storage := repository.NewMemStorage()
+	storage.EnableSyncStore(filepath.Join(t.TempDir(), "missing", "metrics.json"))
+
+	r := chi.NewRouter()
+	r.Post("/update", updateHandlerJSON(storage))
+	r.Post("/update/{type}/{name}/{value}", updateHandler(storage))
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/update/counter/PollCount/1", nil),
+		httptest.NewRequest(http.MethodPost, "/update", strings.NewReader(`{"id":"Alloc","type":"gauge","value":1.5}`)),
+	} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusInternalServerError, rr.Code, req.URL.Path)
+	}
+}
+
+func TestParseWALSyncPolicy(t *testing.T) {
+	for in, want := range map[string]repository.WALSyncPolicy{
+		"":       repository.WALSyncBatch,
+		"always": repository.WALSyncAlways,
+		"batch":  repository.WALSyncBatch,
+		"none":   repository.WALSyncNone,
+	} {
+		got, err := repository.ParseWALSyncPolicy(in)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := repository.ParseWALSyncPolicy("sometimes")
+	assert.Error(t, err)
+}
+
+func TestBoltStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.bolt")
+	storage, err := repository.NewBoltStorage(path)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	ctxA := tenant.WithTenant(ctx, tenant.Tenant{ID: "team-a"})
+
+	// счётчики накапливаются, gauge перезаписывается — как в остальных хранилищах
+	storage.UpdateCounter(ctx, "PollCount", 2)
+	storage.UpdateCounter(ctx, "PollCount", 3)
+	storage.UpdateGauge(ctx, "Alloc", 1.5)
+	storage.UpdateGauge(ctx, "Alloc", 2.5)
+	storage.UpdateCounter(ctxA, "PollCount", 7)
+
+	one := int64(1)
+	v := 4.0
+	assert.NoError(t, storage.UpdateBatch(ctx, []models.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &one},
+		{ID: "Alloc", MType: "gauge", Value: &v, Labels: map[string]string{"host": "a"}},
+	}))
+
+	// батч с конфликтующей гистограммой не применяется целиком
+	assert.ErrorIs(t, storage.UpdateBatch(ctx, []models.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &one},
+		{ID: "H", MType: models.Histogram, Histogram: &models.HistogramData{Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.5}},
+		{ID: "H", MType: models.Histogram, Histogram: &models.HistogramData{Bounds: []float64{2}, Counts: []uint64{1, 0}, Sum: 0.5}},
+	}), models.ErrBoundsMismatch)
+	_, ok := storage.GetHistogram(ctx, "H")
+	assert.False(t, ok)
+
+	applied, err := storage.UpdateBatchOnce(ctx, "batch-1", []models.Metrics{{ID: "PollCount", MType: "counter", Delta: &one}})
+	assert.NoError(t, err)
+	assert.True(t, applied)
+	applied, err = storage.UpdateBatchOnce(ctx, "batch-1", []models.Metrics{{ID: "PollCount", MType: "counter", Delta: &one}})
+	assert.NoError(t, err)
+	assert.False(t, applied)
+
+	// данные переживают переоткрытие файла
+	assert.NoError(t, storage.Close())
+	storage, err = repository.NewBoltStorage(path)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	gauges, counters := storage.GetAllMetrics(ctx)
+	assert.Equal(t, map[string]float64{"Alloc": 2.5, `Alloc{host="a"}`: 4}, gauges)
+	assert.Equal(t, map[string]int64{"PollCount": 7}, counters)
+	_, counters = storage.GetAllMetrics(ctxA)
+	assert.Equal(t, map[string]int64{"PollCount": 7}, counters)
+
+	history, err := storage.GetHistory(ctx, models.Counter, "PollCount", time.Now().Add(-time.Minute), time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, history, 4)
+	assert.Equal(t, 2.0, history[0].Value)
+}
+
+func TestStorageKind(t *testing.T) {
+	for _, tt := range []struct {
+		kind, dsn, want string
+	}{
+		{"", "", storageMemory},
+		{"", "postgres://localhost/db", storagePostgres},
+		{"bolt", "postgres://localhost/db", storageBolt},
+		{"memory", "", storageMemory},
+	} {
+		got, err := storageKind(tt.kind, tt.dsn)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, got)
+	}
+	_, err := storageKind("postgres", "")
+	assert.Error(t, err)
+	_, err = storageKind("redis", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,223 @@
+// Package counters переводит накопительные значения счётчиков в приращения.
+//
+// Обычно клиент присылает в Delta приращение, и хранилище его прибавляет. В накопительном режиме
+// (заголовок X-Counter-Mode: cumulative) клиент присылает текущий итог с начала своей работы,
+// а сервер сам вычисляет приращение относительно предыдущего итога того же клиента.
+package counters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tenant"
+)
+
+// Заголовки накопительного режима (в gRPC — одноимённые метаданные в нижнем регистре)
+const (
+	// ModeHeader — режим счётчиков запроса: delta (по умолчанию) или cumulative
+	ModeHeader = "X-Counter-Mode"
+	// InstanceHeader — идентификатор клиента, итоги которого сравниваются между собой
+	InstanceHeader = "X-Agent-Instance"
+	// StartedHeader — время запуска клиента (RFC 3339): с него начался отсчёт итогов
+	StartedHeader = "X-Agent-Started"
+)
+
+// Режимы счётчиков
+const (
+	ModeDelta      = "delta"
+	ModeCumulative = "cumulative"
+)
+
+// Source — клиент, присылающий накопительные значения. Новое время запуска у того же Instance
+// означает, что клиент перезапустился и его итоги начались с нуля.
+type Source struct {
+	Instance string
+	Started  time.Time
+}
+
+// ParseSource разбирает заголовки запроса. cumulative=false — запрос в обычном режиме.
+func ParseSource(mode, instance, started string) (src Source, cumulative bool, err error) {
+	switch mode {
+	case "", ModeDelta:
+		return Source{}, false, nil
+	case ModeCumulative:
+	default:
+		return Source{}, false, fmt.Errorf("unknown counter mode %q", mode)
+	}
+	if instance == "" {
+		return Source{}, false, errors.New("cumulative counters require " + InstanceHeader)
+	}
+	ts, err := time.Parse(time.RFC3339Nano, started)
+	if err != nil {
+		return Source{}, false, fmt.Errorf("invalid %s: %w", StartedHeader, err)
+	}
+	return Source{Instance: instance, Started: ts}, true, nil
+}
+
+// series — последний учтённый итог серии клиента
+type series struct {
+	started time.Time
+	total   int64
+	seen    time.Time
+}
+
+// Tracker помнит последние итоги накопительных счётчиков по арендатору, клиенту и серии.
+// Состояние живёт в памяти: после перезапуска сервера первый итог клиента, запущенного раньше,
+// только задаёт точку отсчёта — иначе всё, что уже было учтено до перезапуска, прибавилось бы повторно.
+type Tracker struct {
+	mu        sync.Mutex
+	started   time.Time
+	ttl       time.Duration // серии, не обновлявшиеся дольше ttl, забываются
+	series    map[string]series
+	lastSweep time.Time
+	sources   map[string]*sourceLock
+}
+
+// sourceLock упорядочивает запросы одного клиента: между вычислением приращений и commit
+// другой запрос того же клиента посчитал бы приращения от того же итога
+type sourceLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// NewTracker создаёт трекер; ttl — сколько помнить серию без обновлений
+func NewTracker(ttl time.Duration) *Tracker {
+	now := time.Now()
+	return &Tracker{
+		started:   now,
+		ttl:       ttl,
+		series:    make(map[string]series),
+		lastSweep: now,
+		sources:   make(map[string]*sourceLock),
+	}
+}
+
+type ctxKey struct{}
+
+type binding struct {
+	t   *Tracker
+	src Source
+}
+
+// Bind помечает запрос как накопительный: ToDeltas в этом контексте пересчитает счётчики через t
+func (t *Tracker) Bind(ctx context.Context, src Source) context.Context {
+	return context.WithValue(ctx, ctxKey{}, binding{t: t, src: src})
+}
+
+// ToDeltas возвращает копию batch, в которой итоги счётчиков заменены приращениями, если контекст
+// помечен через Bind; иначе — сам batch. Арендатор берётся из контекста.
+//
+// Новые итоги запоминаются только вызовом commit(true) после того, как хранилище применило батч:
+// если применение не удалось или батч с этим ключом идемпотентности уже был применён, вызывается
+// commit(false), и повтор с тем же итогом снова даст приращение. commit нужно вызвать обязательно —
+// до него следующие запросы того же клиента ждут; повторные вызовы ничего не делают.
+func ToDeltas(ctx context.Context, batch []models.Metrics) (deltas []models.Metrics, commit func(applied bool)) {
+	b, ok := ctx.Value(ctxKey{}).(binding)
+	if !ok {
+		return batch, func(bool) {}
+	}
+	t := b.t
+	source := tenant.IDFromContext(ctx) + "\x00" + b.src.Instance
+	lock := t.lockSource(source)
+
+	deltas = make([]models.Metrics, len(batch))
+	copy(deltas, batch)
+	next := make(map[string]series)
+	t.mu.Lock()
+	for i, m := range deltas {
+		if m.MType != models.Counter || m.Delta == nil {
+			continue
+		}
+		key := source + "\x00" + m.Key()
+		prev, seen := next[key]
+		if !seen {
+			prev, seen = t.series[key]
+		}
+		d, s, update := t.delta(prev, seen, b.src.Started, *m.Delta)
+		if update {
+			next[key] = s
+		}
+		deltas[i].Delta = &d
+	}
+	t.mu.Unlock()
+
+	var once sync.Once
+	return deltas, func(applied bool) {
+		once.Do(func() {
+			if applied {
+				now := time.Now()
+				t.mu.Lock()
+				for key, s := range next {
+					s.seen = now
+					t.series[key] = s
+				}
+				t.sweep(now)
+				t.mu.Unlock()
+			}
+			t.unlockSource(source, lock)
+		})
+	}
+}
+
+// delta вычисляет приращение для нового итога серии; update — итог нужно запомнить
+func (t *Tracker) delta(prev series, ok bool, started time.Time, total int64) (d int64, next series, update bool) {
+	next = series{started: started, total: total}
+	switch {
+	case !ok:
+		// клиент запущен раньше сервера: что из его итога уже учтено, неизвестно
+		if !started.Before(t.started) {
+			d = total
+		}
+		return d, next, true
+	case started.Before(prev.started):
+		// запоздавший батч прошлого запуска клиента: его итог уже перекрыт
+		return 0, prev, false
+	case started.After(prev.started):
+		// клиент перезапустился: итог считается с нуля
+		return total, next, true
+	case total < prev.total:
+		// тот же запуск, но итог меньше: батчи пришли не по порядку, больший уже учтён
+		return 0, prev, false
+	}
+	return total - prev.total, next, true
+}
+
+func (t *Tracker) lockSource(source string) *sourceLock {
+	t.mu.Lock()
+	l, ok := t.sources[source]
+	if !ok {
+		l = &sourceLock{}
+		t.sources[source] = l
+	}
+	l.refs++
+	t.mu.Unlock()
+	l.mu.Lock()
+	return l
+}
+
+func (t *Tracker) unlockSource(source string, l *sourceLock) {
+	l.mu.Unlock()
+	t.mu.Lock()
+	if l.refs--; l.refs == 0 {
+		delete(t.sources, source)
+	}
+	t.mu.Unlock()
+}
+
+// sweep забывает серии, не обновлявшиеся дольше ttl; проходит по карте не чаще раза в ttl.
+// Вызывать под t.mu.
+func (t *Tracker) sweep(now time.Time) {
+	if t.ttl <= 0 || now.Sub(t.lastSweep) < t.ttl {
+		return
+	}
+	t.lastSweep = now
+	for key, s := range t.series {
+		if now.Sub(s.seen) > t.ttl {
+			delete(t.series, key)
+		}
+	}
+}
@@ -2,8 +2,10 @@ package cryptohelpers
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"strconv"
 )
 
 // Sign возвращает HMAC-SHA256 (в hex) от данных data с ключом key.
@@ -19,3 +21,52 @@ func Compare(data []byte, key string, signedHex string) bool {
 	expected := Sign(data, key)
 	return hmac.Equal([]byte(expected), []byte(signedHex))
 }
+
+// Заголовки, которые агент добавляет к подписанному запросу для защиты от повторов
+const (
+	HeaderTimestamp = "X-Request-Timestamp" // unix-время отправки в секундах
+	HeaderNonce     = "X-Request-Nonce"     // случайная одноразовая строка
+)
+
+// SignRequest возвращает HMAC-SHA256 (в hex) от метки времени, nonce и тела запроса.
+// В отличие от Sign подпись привязана к моменту отправки, и перехваченный запрос нельзя повторить.
+func SignRequest(data []byte, key string, timestamp int64, nonce string) string {
+	return Sign(requestMaterial(data, timestamp, nonce), key)
+}
+
+// CompareRequest проверяет подпись, полученную через SignRequest.
+func CompareRequest(data []byte, key string, timestamp int64, nonce string, signedHex string) bool {
+	return Compare(requestMaterial(data, timestamp, nonce), key, signedHex)
+}
+
+// NewNonce возвращает случайный nonce: 16 байт в hex.
+func NewNonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// MaxNonceLen — самый длинный nonce, который принимает сервер (NewNonce даёт 32 символа)
+const MaxNonceLen = 64
+
+// ValidNonce сообщает, похож ли nonce на выданный NewNonce: непустой, не длиннее MaxNonceLen
+// и только из строчных hex-цифр. Сервер проверяет это до HMAC и до кеша повторов.
+func ValidNonce(nonce string) bool {
+	if nonce == "" || len(nonce) > MaxNonceLen {
+		return false
+	}
+	for i := 0; i < len(nonce); i++ {
+		c := nonce[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func requestMaterial(data []byte, timestamp int64, nonce string) []byte {
+	prefix := strconv.FormatInt(timestamp, 10) + "\n" + nonce + "\n"
+	material := make([]byte, 0, len(prefix)+len(data))
+	material = append(material, prefix...)
+	return append(material, data...)
+}
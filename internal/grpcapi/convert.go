@@ -0,0 +1,57 @@
+// Package grpcapi — gRPC-сервис метрик поверх тех же хранилищ, что и HTTP API.
+package grpcapi
+
+import (
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	pb "github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/proto"
+)
+
+// ToProto переводит метрику в сообщение gRPC
+func ToProto(m models.Metrics) *pb.Metric {
+	out := &pb.Metric{
+		Id:     m.ID,
+		Type:   m.MType,
+		Delta:  m.Delta,
+		Value:  m.Value,
+		Labels: m.Labels,
+	}
+	if m.Histogram != nil {
+		out.Histogram = &pb.Histogram{
+			Bounds: m.Histogram.Bounds,
+			Counts: m.Histogram.Counts,
+			Sum:    m.Histogram.Sum,
+		}
+	}
+	if m.Summary != nil {
+		out.Summary = &pb.Summary{Count: m.Summary.Count, Sum: m.Summary.Sum}
+		for _, q := range m.Summary.Quantiles {
+			out.Summary.Quantiles = append(out.Summary.Quantiles, &pb.Quantile{Quantile: q.Quantile, Value: q.Value})
+		}
+	}
+	return out
+}
+
+// FromProto переводит сообщение gRPC в метрику
+func FromProto(m *pb.Metric) models.Metrics {
+	out := models.Metrics{
+		ID:     m.GetId(),
+		MType:  m.GetType(),
+		Delta:  m.Delta,
+		Value:  m.Value,
+		Labels: m.GetLabels(),
+	}
+	if h := m.GetHistogram(); h != nil {
+		out.Histogram = &models.HistogramData{
+			Bounds: h.GetBounds(),
+			Counts: h.GetCounts(),
+			Sum:    h.GetSum(),
+		}
+	}
+	if sm := m.GetSummary(); sm != nil {
+		out.Summary = &models.SummaryData{Count: sm.GetCount(), Sum: sm.GetSum()}
+		for _, q := range sm.GetQuantiles() {
+			out.Summary.Quantiles = append(out.Summary.Quantiles, models.Quantile{Quantile: q.GetQuantile(), Value: q.GetValue()})
+		}
+	}
+	return out
+}
@@ -0,0 +1,286 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/counters"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	pb "github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/proto"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+)
+
+// IdempotencyKeyMD — ключ метаданных с ключом идемпотентности (как заголовок Idempotency-Key у HTTP)
+const IdempotencyKeyMD = "idempotency-key"
+
+const maxIdempotencyKeyLen = 128
+
+// Полные имена методов сервиса, для настройки перехватчиков
+const (
+	MethodUpdate      = "/metrics.Metrics/Update"
+	MethodUpdateBatch = "/metrics.Metrics/UpdateBatch"
+	MethodGetValue    = "/metrics.Metrics/GetValue"
+	MethodList        = "/metrics.Metrics/List"
+	MethodPush        = "/metrics.Metrics/Push"
+)
+
+// Server реализует pb.MetricsServer поверх repository.Storage
+type Server struct {
+	pb.UnimplementedMetricsServer
+	storage repository.Storage
+}
+
+// NewServer создаёт gRPC-сервис метрик
+func NewServer(storage repository.Storage) *Server {
+	return &Server{storage: storage}
+}
+
+func (s *Server) Update(ctx context.Context, req *pb.UpdateRequest) (*pb.UpdateResponse, error) {
+	if req.GetMetric() == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing metric")
+	}
+	m := FromProto(req.GetMetric())
+	if err := s.validate(m); err != nil {
+		return nil, err
+	}
+	batch, commit := counters.ToDeltas(ctx, []models.Metrics{m})
+	defer commit(false)
+	applied, err := s.apply(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+	commit(applied)
+	return &pb.UpdateResponse{Metric: req.GetMetric()}, nil
+}
+
+func (s *Server) UpdateBatch(ctx context.Context, req *pb.UpdateBatchRequest) (*pb.UpdateBatchResponse, error) {
+	if len(req.GetMetrics()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "empty batch")
+	}
+	batch := make([]models.Metrics, 0, len(req.GetMetrics()))
+	for _, pm := range req.GetMetrics() {
+		m := FromProto(pm)
+		if err := s.validate(m); err != nil {
+			return nil, err
+		}
+		batch = append(batch, m)
+	}
+	batch, commit := counters.ToDeltas(ctx, batch)
+	defer commit(false)
+	applied, err := s.apply(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+	commit(applied)
+	return &pb.UpdateBatchResponse{Applied: applied}, nil
+}
+
+func (s *Server) GetValue(ctx context.Context, req *pb.GetValueRequest) (*pb.GetValueResponse, error) {
+	m := models.Metrics{ID: req.GetId(), MType: req.GetType(), Labels: req.GetLabels()}
+	if err := m.ValidateLabels(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	key := m.Key()
+
+	switch m.MType {
+	case models.Gauge:
+		v, ok := s.storage.GetGauge(ctx, key)
+		if !ok {
+			return nil, status.Error(codes.NotFound, "metric not found")
+		}
+		m.Value = &v
+	case models.Counter:
+		v, ok := s.storage.GetCounter(ctx, key)
+		if !ok {
+			return nil, status.Error(codes.NotFound, "metric not found")
+		}
+		m.Delta = &v
+	case models.Histogram:
+		hs, ok := s.storage.(repository.HistogramStorage)
+		if !ok {
+			return nil, status.Error(codes.Unimplemented, "histograms are not supported by storage")
+		}
+		h, ok := hs.GetHistogram(ctx, key)
+		if !ok {
+			return nil, status.Error(codes.NotFound, "metric not found")
+		}
+		m.Histogram = h
+	case models.Summary:
+		ss, ok := s.storage.(repository.SummaryStorage)
+		if !ok {
+			return nil, status.Error(codes.Unimplemented, "summaries are not supported by storage")
+		}
+		sm, ok := ss.GetSummary(ctx, key)
+		if !ok {
+			return nil, status.Error(codes.NotFound, "metric not found")
+		}
+		m.Summary = sm
+	default:
+		return nil, status.Error(codes.Unimplemented, "unknown metric type")
+	}
+	return &pb.GetValueResponse{Metric: ToProto(m)}, nil
+}
+
+// List возвращает все метрики арендатора, отсортированные по типу и ключу серии
+func (s *Server) List(ctx context.Context, _ *pb.ListRequest) (*pb.ListResponse, error) {
+	gauges, counters := s.storage.GetAllMetrics(ctx)
+	var metrics []models.Metrics
+	for key, v := range gauges {
+		id, labels := models.SplitSeriesKey(key)
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Gauge, Value: &v, Labels: labels})
+	}
+	for key, d := range counters {
+		id, labels := models.SplitSeriesKey(key)
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Counter, Delta: &d, Labels: labels})
+	}
+	if hs, ok := s.storage.(repository.HistogramStorage); ok {
+		for key, h := range hs.GetAllHistograms(ctx) {
+			id, labels := models.SplitSeriesKey(key)
+			metrics = append(metrics, models.Metrics{ID: id, MType: models.Histogram, Histogram: h, Labels: labels})
+		}
+	}
+	if ss, ok := s.storage.(repository.SummaryStorage); ok {
+		for key, sm := range ss.GetAllSummaries(ctx) {
+			id, labels := models.SplitSeriesKey(key)
+			metrics = append(metrics, models.Metrics{ID: id, MType: models.Summary, Summary: sm, Labels: labels})
+		}
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType < metrics[j].MType
+		}
+		return metrics[i].Key() < metrics[j].Key()
+	})
+
+	resp := &pb.ListResponse{Metrics: make([]*pb.Metric, 0, len(metrics))}
+	for _, m := range metrics {
+		resp.Metrics = append(resp.Metrics, ToProto(m))
+	}
+	return resp, nil
+}
+
+// Push применяет метрики из потока по одной; при ошибке уже применённые метрики остаются
+func (s *Server) Push(stream pb.Metrics_PushServer) error {
+	var received uint64
+	for {
+		pm, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&pb.PushResponse{Received: received})
+		}
+		if err != nil {
+			return err
+		}
+		m := FromProto(pm)
+		if err := s.validate(m); err != nil {
+			return err
+		}
+		batch, commit := counters.ToDeltas(stream.Context(), []models.Metrics{m})
+		err = s.applyOne(stream.Context(), batch[0])
+		commit(err == nil)
+		if err != nil {
+			return err
+		}
+		received++
+	}
+}
+
+// validate повторяет проверки HTTP-обработчиков /update и /updates
+func (s *Server) validate(m models.Metrics) error {
+	if err := m.ValidateLabels(); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	switch m.MType {
+	case models.Gauge:
+		if m.Value == nil {
+			return status.Error(codes.InvalidArgument, "missing gauge value")
+		}
+	case models.Counter:
+		if m.Delta == nil {
+			return status.Error(codes.InvalidArgument, "missing counter delta")
+		}
+	case models.Histogram:
+		if _, ok := s.storage.(repository.HistogramStorage); !ok {
+			return status.Error(codes.Unimplemented, "histograms are not supported by storage")
+		}
+		if m.Histogram == nil {
+			return status.Error(codes.InvalidArgument, "missing histogram")
+		}
+		if err := m.Histogram.Validate(); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	case models.Summary:
+		if _, ok := s.storage.(repository.SummaryStorage); !ok {
+			return status.Error(codes.Unimplemented, "summaries are not supported by storage")
+		}
+		if m.Summary == nil {
+			return status.Error(codes.InvalidArgument, "missing summary")
+		}
+		if err := m.Summary.Validate(); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	default:
+		return status.Error(codes.Unimplemented, "unknown metric type")
+	}
+	return nil
+}
+
+// apply применяет проверенный батч: с ключом идемпотентности — не больше одного раза,
+// иначе атомарно через BatchUpdater или поштучно. false — батч с этим ключом уже был применён.
+func (s *Server) apply(ctx context.Context, batch []models.Metrics) (bool, error) {
+	if idemKey := idempotencyKey(ctx); idemKey != "" {
+		if iu, ok := s.storage.(repository.IdempotentBatchUpdater); ok {
+			if len(idemKey) > maxIdempotencyKeyLen {
+				return false, status.Error(codes.InvalidArgument, "idempotency key too long")
+			}
+			applied, err := iu.UpdateBatchOnce(ctx, idemKey, batch)
+			return applied, storageError(err)
+		}
+	}
+	if bu, ok := s.storage.(repository.BatchUpdater); ok {
+		return true, storageError(bu.UpdateBatch(ctx, batch))
+	}
+	for _, m := range batch {
+		if err := s.applyOne(ctx, m); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (s *Server) applyOne(ctx context.Context, m models.Metrics) error {
+	switch m.MType {
+	case models.Gauge:
+		return storageError(repository.UpdateGauge(ctx, s.storage, m.Key(), *m.Value))
+	case models.Counter:
+		return storageError(repository.UpdateCounter(ctx, s.storage, m.Key(), *m.Delta))
+	case models.Histogram:
+		return storageError(s.storage.(repository.HistogramStorage).UpdateHistogram(ctx, m.Key(), m.Histogram))
+	case models.Summary:
+		return storageError(s.storage.(repository.SummaryStorage).UpdateSummary(ctx, m.Key(), m.Summary))
+	}
+	return nil
+}
+
+func storageError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, models.ErrBoundsMismatch):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.Internal, "storage error")
+}
+
+func idempotencyKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(IdempotencyKeyMD); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
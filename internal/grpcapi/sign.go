@@ -0,0 +1,31 @@
+package grpcapi
+
+import (
+	"google.golang.org/protobuf/proto"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/cryptohelpers"
+	pb "github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/proto"
+)
+
+// MetricPayload возвращает то, что подписывается у метрики потока Push:
+// детерминированную сериализацию метрики без поля signature
+func MetricPayload(m *pb.Metric) ([]byte, error) {
+	unsigned := proto.Clone(m).(*pb.Metric)
+	unsigned.Signature = nil
+	return proto.MarshalOptions{Deterministic: true}.Marshal(unsigned)
+}
+
+// SignMetric подписывает метрику потока Push ключом key с меткой времени ts и nonce.
+// Метаданные потока передаются один раз, поэтому каждое сообщение несёт свою подпись.
+func SignMetric(m *pb.Metric, key string, ts int64, nonce string) error {
+	payload, err := MetricPayload(m)
+	if err != nil {
+		return err
+	}
+	m.Signature = &pb.Signature{
+		Hash:      cryptohelpers.SignRequest(payload, key, ts, nonce),
+		Timestamp: ts,
+		Nonce:     nonce,
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tenant"
+	"github.com/go-chi/chi/v5"
+)
+
+// ограничение на число точек в одном ответе, чтобы маленький step не раздувал ответ
+const maxHistoryPoints = 11000
+
+// окно по умолчанию, если from не задан
+const defaultHistoryWindow = time.Hour
+
+// HistoryPoint — точка ответа /history
+type HistoryPoint struct {
+	Timestamp time.Time `json:"ts"`
+	Value     float64   `json:"value"`
+}
+
+// HistoryHandler обрабатывает GET /history/{type}/{name}?from=...&to=...&step=...&agg=...
+//
+// from/to — RFC3339 или unix-время в секундах (по умолчанию последний час),
+// step — длительность ("30s", "5m") или число секунд; без step точки отдаются как есть.
+// Для gauge agg выбирает агрегат внутри шага: avg (по умолчанию), min, max, last.
+// Для counter значение точки — прирост счётчика за шаг.
+func HistoryHandler(storage repository.Storage, key string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hr, ok := storage.(repository.HistoryReader)
+		if !ok {
+			http.Error(w, "history is not supported by storage", http.StatusNotImplemented)
+			return
+		}
+
+		metricType := chi.URLParam(r, "type")
+		name := chi.URLParam(r, "name")
+		if metricType != models.Gauge && metricType != models.Counter {
+			http.Error(w, "invalid metric type", http.StatusBadRequest)
+			return
+		}
+
+		q := r.URL.Query()
+
+		to := time.Now()
+		if v := q.Get("to"); v != "" {
+			t, err := parseHistoryTime(v)
+			if err != nil {
+				http.Error(w, "invalid to", http.StatusBadRequest)
+				return
+			}
+			to = t
+		}
+		from := to.Add(-defaultHistoryWindow)
+		if v := q.Get("from"); v != "" {
+			t, err := parseHistoryTime(v)
+			if err != nil {
+				http.Error(w, "invalid from", http.StatusBadRequest)
+				return
+			}
+			from = t
+		}
+		if from.After(to) {
+			http.Error(w, "from is after to", http.StatusBadRequest)
+			return
+		}
+
+		var step time.Duration
+		if v := q.Get("step"); v != "" {
+			d, err := parseHistoryStep(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid step", http.StatusBadRequest)
+				return
+			}
+			if int64(to.Sub(from)/d) >= maxHistoryPoints {
+				http.Error(w, "too many points, increase step", http.StatusBadRequest)
+				return
+			}
+			step = d
+		}
+
+		agg := q.Get("agg")
+		if agg == "" {
+			agg = "avg"
+		}
+		if metricType == models.Gauge && !isGaugeAgg(agg) {
+			http.Error(w, "invalid agg", http.StatusBadRequest)
+			return
+		}
+
+		samples, err := hr.GetHistory(r.Context(), metricType, name, from, to)
+		if err != nil {
+			if errors.Is(err, repository.ErrUnknownMetricType) {
+				http.Error(w, "invalid metric type", http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "storage error", http.StatusInternalServerError)
+			return
+		}
+
+		var points []HistoryPoint
+		if metricType == models.Counter {
+			points = downsample(samples, from, step, sumValues)
+		} else {
+			points = downsample(samples, from, step, gaugeAggs[agg])
+		}
+
+		_ = WriteSignedJSONResponse(w, points, tenant.KeyOr(r.Context(), key))
+	}
+}
+
+// downsample группирует точки по шагам [from+i*step, from+(i+1)*step) и сворачивает
+// каждую группу функцией agg. Пустые шаги пропускаются; при step == 0 точки не группируются.
+func downsample(samples []models.Sample, from time.Time, step time.Duration, agg func([]float64) float64) []HistoryPoint {
+	points := make([]HistoryPoint, 0, len(samples))
+	if step == 0 {
+		for _, s := range samples {
+			points = append(points, HistoryPoint{Timestamp: s.Timestamp, Value: s.Value})
+		}
+		return points
+	}
+
+	var (
+		bucket int64 = -1
+		values []float64
+	)
+	flush := func() {
+		if len(values) == 0 {
+			return
+		}
+		points = append(points, HistoryPoint{
+			Timestamp: from.Add(time.Duration(bucket) * step),
+			Value:     agg(values),
+		})
+		values = values[:0]
+	}
+
+	for _, s := range samples {
+		b := int64(s.Timestamp.Sub(from) / step)
+		if b != bucket {
+			flush()
+			bucket = b
+		}
+		values = append(values, s.Value)
+	}
+	flush()
+	return points
+}
+
+var gaugeAggs = map[string]func([]float64) float64{
+	"avg": func(v []float64) float64 { return sumValues(v) / float64(len(v)) },
+	"min": func(v []float64) float64 {
+		m := math.Inf(1)
+		for _, x := range v {
+			m = math.Min(m, x)
+		}
+		return m
+	},
+	"max": func(v []float64) float64 {
+		m := math.Inf(-1)
+		for _, x := range v {
+			m = math.Max(m, x)
+		}
+		return m
+	},
+	"last": func(v []float64) float64 { return v[len(v)-1] },
+}
+
+func isGaugeAgg(agg string) bool {
+	_, ok := gaugeAggs[agg]
+	return ok
+}
+
+func sumValues(v []float64) float64 {
+	var sum float64
+	for _, x := range v {
+		sum += x
+	}
+	return sum
+}
+
+// parseHistoryTime принимает RFC3339 или unix-время в секундах
+func parseHistoryTime(v string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse time %q: %w", v, err)
+	}
+	return t, nil
+}
+
+// parseHistoryStep принимает длительность в формате time.ParseDuration или число секунд
+func parseHistoryStep(v string) (time.Duration, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		// произведение не должно переполниться: иначе огромный step превратится в произвольный
+		if sec > math.MaxInt64/int64(time.Second) || sec < math.MinInt64/int64(time.Second) {
+			return 0, fmt.Errorf("step %q is out of range", v)
+		}
+		return time.Duration(sec) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
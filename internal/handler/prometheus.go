@@ -0,0 +1,277 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+)
+
+const (
+	contentTypePrometheus  = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// promSample — одна серия в выводе /metrics
+type promSample struct {
+	name   string // исходное имя метрики
+	family string // санитизированное имя семейства
+	mtype  string
+	labels string // отрендеренные метки вместе с фигурными скобками или пустая строка
+	value  string
+	lines  []string // готовые строки для типов из нескольких сэмплов (histogram, summary)
+}
+
+// CounterSource отдаёт служебные счётчики сервера (не из хранилища) для /metrics
+type CounterSource func() map[string]int64
+
+// PrometheusHandler обрабатывает GET /metrics: отдаёт все gauge, counter, histogram и summary
+// в текстовом формате Prometheus 0.0.4, а при Accept: application/openmetrics-text — в OpenMetrics.
+// Серии с метками группируются в одно семейство с общей строкой # TYPE.
+// Счётчики из sources выводятся вместе с метриками хранилища.
+//
+// Семейство — это имя и тип метрики. Если после санитизации имени семейства совпадают (gauge и counter
+// с одним ID, a.b и a_b, counter foo_total и gauge foo в OpenMetrics), выводится первое по порядку,
+// а остальные пропускаются и пишутся в лог: Prometheus отклонил бы весь ответ.
+func PrometheusHandler(storage repository.Storage, sources ...CounterSource) http.HandlerFunc {
+	var warned sync.Map // семейства, о пропуске которых уже написано в лог
+	return func(w http.ResponseWriter, r *http.Request) {
+		gauges, counters := storage.GetAllMetrics(r.Context())
+		openMetrics := acceptsOpenMetrics(r.Header.Get("Accept"))
+
+		samples := make([]promSample, 0, len(gauges)+len(counters))
+		for key, val := range gauges {
+			samples = append(samples, newPromSample(key, "gauge", formatPromFloat(val)))
+		}
+		for key, val := range counters {
+			samples = append(samples, newPromSample(key, "counter", strconv.FormatInt(val, 10)))
+		}
+		if hs, ok := storage.(repository.HistogramStorage); ok {
+			for key, h := range hs.GetAllHistograms(r.Context()) {
+				samples = append(samples, newPromHistogram(key, h))
+			}
+		}
+		if ss, ok := storage.(repository.SummaryStorage); ok {
+			for key, sm := range ss.GetAllSummaries(r.Context()) {
+				samples = append(samples, newPromSummary(key, sm))
+			}
+		}
+		for _, src := range sources {
+			for key, val := range src() {
+				samples = append(samples, newPromSample(key, "counter", strconv.FormatInt(val, 10)))
+			}
+		}
+		sort.Slice(samples, func(i, j int) bool {
+			a, b := samples[i], samples[j]
+			if a.family != b.family {
+				return a.family < b.family
+			}
+			if a.mtype != b.mtype {
+				return a.mtype < b.mtype
+			}
+			if a.name != b.name {
+				return a.name < b.name
+			}
+			return a.labels < b.labels
+		})
+
+		var buf bytes.Buffer
+		claimed := make(map[string]string) // имя в выводе → семейство, которое его заняло
+		var lastGroup string
+		var skip bool
+		for _, s := range samples {
+			family, names := promFamilyNames(s, openMetrics)
+			if group := s.mtype + " " + s.name; group != lastGroup {
+				lastGroup = group
+				skip = false
+				for _, n := range names {
+					if owner, ok := claimed[n]; ok {
+						skip = true
+						if _, seen := warned.LoadOrStore(group, true); !seen {
+							logger.Log.Warn("metric family collides with another one after sanitizing, skipped in /metrics",
+								zap.String("metric", s.name), zap.String("type", s.mtype),
+								zap.String("name", n), zap.String("taken_by", owner))
+						}
+						break
+					}
+				}
+				if skip {
+					continue
+				}
+				for _, n := range names {
+					claimed[n] = group
+				}
+				fmt.Fprintf(&buf, "# TYPE %s %s\n", family, s.mtype)
+			}
+			if skip {
+				continue
+			}
+			if s.lines != nil {
+				for _, l := range s.lines {
+					buf.WriteString(l)
+					buf.WriteByte('\n')
+				}
+				continue
+			}
+			fmt.Fprintf(&buf, "%s%s %s\n", names[len(names)-1], s.labels, s.value)
+		}
+
+		if openMetrics {
+			buf.WriteString("# EOF\n")
+			w.Header().Set("Content-Type", contentTypeOpenMetrics)
+		} else {
+			w.Header().Set("Content-Type", contentTypePrometheus)
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(buf.Bytes())
+	}
+}
+
+// promFamilyNames возвращает имя семейства в строке # TYPE и все имена, которые семейство занимает
+// в выводе; последнее из них — имя сэмпла gauge и counter
+func promFamilyNames(s promSample, openMetrics bool) (string, []string) {
+	switch {
+	case s.mtype == "histogram":
+		return s.family, []string{s.family, s.family + "_bucket", s.family + "_sum", s.family + "_count"}
+	case s.mtype == "summary":
+		return s.family, []string{s.family, s.family + "_sum", s.family + "_count"}
+	case s.mtype == "counter" && openMetrics:
+		// в OpenMetrics у counter семейство без суффикса, а сэмпл — с суффиксом _total
+		family := strings.TrimSuffix(s.family, "_total")
+		return family, []string{family, family + "_total"}
+	}
+	return s.family, []string{s.family}
+}
+
+func newPromSample(key, mtype, value string) promSample {
+	name, labels := models.SplitSeriesKey(key)
+	s := promSample{
+		name:   name,
+		family: SanitizePromName(name),
+		mtype:  mtype,
+		value:  value,
+	}
+	if len(labels) > 0 {
+		// SeriesKey уже даёт нотацию Prometheus: отсортированные метки с экранированием
+		s.labels = models.SeriesKey("", labels)
+	}
+	return s
+}
+
+// newPromHistogram рендерит гистограмму как семейство _bucket (накопительно, с меткой le), _sum и _count
+func newPromHistogram(key string, h *models.HistogramData) promSample {
+	name, labels := models.SplitSeriesKey(key)
+	s := promSample{
+		name:   name,
+		family: SanitizePromName(name),
+		mtype:  "histogram",
+	}
+	if len(labels) > 0 {
+		s.labels = models.SeriesKey("", labels)
+	}
+
+	withLE := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		withLE[k] = v
+	}
+	var cumulative uint64
+	for i, c := range h.Counts {
+		cumulative += c
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = formatPromFloat(h.Bounds[i])
+		}
+		withLE["le"] = le
+		s.lines = append(s.lines, fmt.Sprintf("%s_bucket%s %d", s.family, models.SeriesKey("", withLE), cumulative))
+	}
+	s.lines = append(s.lines,
+		fmt.Sprintf("%s_sum%s %s", s.family, s.labels, formatPromFloat(h.Sum)),
+		fmt.Sprintf("%s_count%s %d", s.family, s.labels, cumulative),
+	)
+	return s
+}
+
+// newPromSummary рендерит сводку как сэмплы с меткой quantile, _sum и _count
+func newPromSummary(key string, sm *models.SummaryData) promSample {
+	name, labels := models.SplitSeriesKey(key)
+	s := promSample{
+		name:   name,
+		family: SanitizePromName(name),
+		mtype:  "summary",
+	}
+	if len(labels) > 0 {
+		s.labels = models.SeriesKey("", labels)
+	}
+
+	withQuantile := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		withQuantile[k] = v
+	}
+	for _, q := range sm.Quantiles {
+		withQuantile["quantile"] = formatPromFloat(q.Quantile)
+		s.lines = append(s.lines, fmt.Sprintf("%s%s %s", s.family, models.SeriesKey("", withQuantile), formatPromFloat(q.Value)))
+	}
+	s.lines = append(s.lines,
+		fmt.Sprintf("%s_sum%s %s", s.family, s.labels, formatPromFloat(sm.Sum)),
+		fmt.Sprintf("%s_count%s %d", s.family, s.labels, sm.Count),
+	)
+	return s
+}
+
+// SanitizePromName приводит имя метрики к алфавиту Prometheus: [a-zA-Z_:][a-zA-Z0-9_:]*.
+// Недопустимые символы заменяются на '_', перед ведущей цифрой добавляется '_'.
+func SanitizePromName(name string) string {
+	if name == "" {
+		return "_"
+	}
+	var b strings.Builder
+	b.Grow(len(name) + 1)
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+			b.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(c)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+func formatPromFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// acceptsOpenMetrics проверяет, запросил ли клиент формат OpenMetrics в заголовке Accept
+func acceptsOpenMetrics(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediaType == "application/openmetrics-text" {
+			return true
+		}
+	}
+	return false
+}
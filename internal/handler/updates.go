@@ -2,13 +2,58 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/counters"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tenant"
 )
 
+// IdempotencyKeyHeader — заголовок с ключом идемпотентности запроса. Агент генерирует ключ
+// на батч и повторяет его при ретраях; повтор с тем же ключом получает тот же успешный ответ,
+// но метрики повторно не применяются (если хранилище реализует IdempotentBatchUpdater).
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader выставляется в ответе, если батч с этим ключом уже был применён раньше
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+const maxIdempotencyKeyLen = 128
+
+// ApplyOnce применяет batch через IdempotentBatchUpdater, если в запросе есть ключ идемпотентности
+// и хранилище его поддерживает. handled=false — ключа нет или хранилище его не поддерживает,
+// батч нужно применить обычным способом. applied=false — батч с этим ключом уже был применён раньше.
+// Ответ об ошибке ApplyOnce пишет сам.
+func ApplyOnce(w http.ResponseWriter, r *http.Request, storage repository.Storage, batch []models.Metrics) (handled, applied, ok bool) {
+	idemKey := r.Header.Get(IdempotencyKeyHeader)
+	if idemKey == "" {
+		return false, false, false
+	}
+	iu, supported := storage.(repository.IdempotentBatchUpdater)
+	if !supported {
+		return false, false, false
+	}
+	if len(idemKey) > maxIdempotencyKeyLen {
+		http.Error(w, "idempotency key too long", http.StatusBadRequest)
+		return true, false, false
+	}
+	applied, err := iu.UpdateBatchOnce(r.Context(), idemKey, batch)
+	if err != nil {
+		if errors.Is(err, models.ErrBoundsMismatch) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return true, false, false
+		}
+		http.Error(w, "storage error", http.StatusInternalServerError)
+		return true, false, false
+	}
+	if !applied {
+		w.Header().Set(IdempotentReplayedHeader, "true")
+	}
+	return true, applied, true
+}
+
 func UpdatesHandler(storage repository.Storage, key string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
@@ -30,40 +75,127 @@ func UpdatesHandler(storage repository.Storage, key string) http.HandlerFunc {
 			http.Error(w, "empty batch", http.StatusBadRequest)
 			return
 		}
-
-		// Если хранилище умеет атомарный батч — используем его
-		if bu, ok := storage.(repository.BatchUpdater); ok {
-			if err := bu.UpdateBatch(r.Context(), batch); err != nil {
-				http.Error(w, "storage error", http.StatusInternalServerError)
+		for _, m := range batch {
+			if err := m.ValidateLabels(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-		} else {
-			// Фолбэк: поштучно
-			for _, m := range batch {
-				switch m.MType {
-				case "gauge":
-					if m.Value == nil {
-						http.Error(w, "gauge without value", http.StatusBadRequest)
-						return
-					}
-					storage.UpdateGauge(r.Context(), m.ID, *m.Value)
-				case "counter":
-					if m.Delta == nil {
-						http.Error(w, "counter without delta", http.StatusBadRequest)
-						return
-					}
-					storage.UpdateCounter(r.Context(), m.ID, *m.Delta)
-				default:
-					http.Error(w, "unknown mtype", http.StatusBadRequest)
+			if m.MType == models.Histogram {
+				if _, ok := storage.(repository.HistogramStorage); !ok {
+					http.Error(w, "histograms are not supported by storage", http.StatusNotImplemented)
+					return
+				}
+				if m.Histogram == nil {
+					http.Error(w, "histogram without data", http.StatusBadRequest)
+					return
+				}
+				if err := m.Histogram.Validate(); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
 					return
 				}
 			}
+			if m.MType == models.Summary {
+				if _, ok := storage.(repository.SummaryStorage); !ok {
+					http.Error(w, "summaries are not supported by storage", http.StatusNotImplemented)
+					return
+				}
+				if m.Summary == nil {
+					http.Error(w, "summary without data", http.StatusBadRequest)
+					return
+				}
+				if err := m.Summary.Validate(); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		// в накопительном режиме итоги счётчиков заменяются приращениями;
+		// новые итоги запоминаются, только если батч действительно применён
+		batch, commit := counters.ToDeltas(r.Context(), batch)
+		defer commit(false)
+
+		// Батч с ключом идемпотентности применяется не больше одного раза
+		handled, applied, ok := ApplyOnce(w, r, storage, batch)
+		if handled && !ok {
+			return
+		}
+		if !handled {
+			if !applyBatch(w, r, storage, batch) {
+				return
+			}
+			applied = true
 		}
+		commit(applied)
 
 		// w.Header().Set("Content-Type", "application/json")
 		// w.WriteHeader(http.StatusOK)
 		// _, _ = w.Write([]byte(`{"status":"ok"}`))
 
-		_ = WriteSignedJSONResponse(w, []byte(`{"status":"ok"}`), key)
+		_ = WriteSignedJSONResponse(w, []byte(`{"status":"ok"}`), tenant.KeyOr(r.Context(), key))
+	}
+}
+
+// applyBatch применяет батч атомарно, если хранилище это умеет, иначе поштучно.
+// false — ответ с ошибкой уже записан.
+func applyBatch(w http.ResponseWriter, r *http.Request, storage repository.Storage, batch []models.Metrics) bool {
+	// Если хранилище умеет атомарный батч — используем его
+	if bu, ok := storage.(repository.BatchUpdater); ok {
+		if err := bu.UpdateBatch(r.Context(), batch); err != nil {
+			if errors.Is(err, models.ErrBoundsMismatch) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return false
+			}
+			http.Error(w, "storage error", http.StatusInternalServerError)
+			return false
+		}
+	} else {
+		// Фолбэк: поштучно
+		for _, m := range batch {
+			switch m.MType {
+			case "gauge":
+				if m.Value == nil {
+					http.Error(w, "gauge without value", http.StatusBadRequest)
+					return false
+				}
+				if err := repository.UpdateGauge(r.Context(), storage, m.Key(), *m.Value); err != nil {
+					http.Error(w, "storage error", http.StatusInternalServerError)
+					return false
+				}
+			case "counter":
+				if m.Delta == nil {
+					http.Error(w, "counter without delta", http.StatusBadRequest)
+					return false
+				}
+				if err := repository.UpdateCounter(r.Context(), storage, m.Key(), *m.Delta); err != nil {
+					http.Error(w, "storage error", http.StatusInternalServerError)
+					return false
+				}
+			case models.Histogram:
+				hs := storage.(repository.HistogramStorage)
+				if err := hs.UpdateHistogram(r.Context(), m.Key(), m.Histogram); err != nil {
+					if errors.Is(err, models.ErrBoundsMismatch) {
+						http.Error(w, err.Error(), http.StatusConflict)
+						return false
+					}
+					http.Error(w, "storage error", http.StatusInternalServerError)
+					return false
+				}
+			case models.Summary:
+				ss := storage.(repository.SummaryStorage)
+				if err := ss.UpdateSummary(r.Context(), m.Key(), m.Summary); err != nil {
+					if errors.Is(err, models.ErrBoundsMismatch) {
+						http.Error(w, err.Error(), http.StatusConflict)
+						return false
+					}
+					http.Error(w, "storage error", http.StatusInternalServerError)
+					return false
+				}
+			default:
+				http.Error(w, "unknown mtype", http.StatusBadRequest)
+				return false
+			}
+		}
 	}
+	return true
 }
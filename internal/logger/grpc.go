@@ -0,0 +1,47 @@
+package logger
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tlsconfig"
+)
+
+// UnaryRequestLogger — аналог RequestLogger для унарных вызовов gRPC
+func UnaryRequestLogger(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logCall(ctx, info.FullMethod, err, time.Since(start))
+	return resp, err
+}
+
+// StreamRequestLogger — аналог RequestLogger для потоковых вызовов gRPC
+func StreamRequestLogger(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	logCall(ss.Context(), info.FullMethod, err, time.Since(start))
+	return err
+}
+
+func logCall(ctx context.Context, method string, err error, duration time.Duration) {
+	fields := []zap.Field{
+		zap.String("method", method),
+		zap.String("code", status.Code(err).String()),
+		zap.Duration("duration", duration),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		// при mTLS — агент, которому выдан клиентский сертификат
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if agent := tlsconfig.PeerIdentity(&info.State); agent != "" {
+				fields = append(fields, zap.String("agent", agent))
+			}
+		}
+	}
+	Log.Info("incoming grpc call", fields...)
+}
@@ -6,6 +6,7 @@ import (
 
 	"go.uber.org/zap"
 
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tlsconfig"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
@@ -46,14 +47,20 @@ func RequestLogger(next http.Handler) http.Handler {
 		next.ServeHTTP(ww, r)
 		duration := time.Since(start)
 
-		//logger.
-		Log.Info("incoming request",
+		fields := []zap.Field{
 			zap.String("method", r.Method),
 			zap.String("uri", r.RequestURI),
 			zap.Int("status", ww.Status()),
 			zap.Int("size", ww.BytesWritten()),
 			zap.Duration("duration", duration),
-		)
+		}
+		// при mTLS — агент, которому выдан клиентский сертификат
+		if agent := tlsconfig.PeerIdentity(r.TLS); agent != "" {
+			fields = append(fields, zap.String("agent", agent))
+		}
+
+		//logger.
+		Log.Info("incoming request", fields...)
 
 	})
 }
@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/counters"
+)
+
+// CumulativeCounters помечает запросы с X-Counter-Mode: cumulative, чтобы обработчики пересчитали
+// итоги счётчиков в приращения (см. counters.ToDeltas). t == nil — режим выключен, такие запросы получают 400.
+// Должен стоять после ResolveTenant: итоги разделены по арендаторам.
+func CumulativeCounters(t *counters.Tracker) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			src, cumulative, err := counters.ParseSource(r.Header.Get(counters.ModeHeader),
+				r.Header.Get(counters.InstanceHeader), r.Header.Get(counters.StartedHeader))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !cumulative {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if t == nil {
+				http.Error(w, "cumulative counters are disabled", http.StatusBadRequest)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(t.Bind(r.Context(), src)))
+		})
+	}
+}
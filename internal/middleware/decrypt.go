@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/payloadcrypto"
+)
+
+// maxEncryptedBody ограничивает тело, которое расшифровывается целиком в памяти
+const maxEncryptedBody = 10 << 20
+
+// DecryptBody расшифровывает тело запроса с заголовком payloadcrypto.Header закрытым ключом сервера.
+// Ставится после распаковки gzip и до проверки подписи: агент подписывает исходный JSON,
+// затем шифрует и только потом сжимает. Запросы без заголовка проходят как есть.
+func DecryptBody(dec *payloadcrypto.Decryptor) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			alg := r.Header.Get(payloadcrypto.Header)
+			if alg == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if dec == nil {
+				http.Error(w, "encrypted payloads are not configured", http.StatusBadRequest)
+				return
+			}
+
+			data, err := io.ReadAll(io.LimitReader(r.Body, maxEncryptedBody))
+			if err != nil {
+				http.Error(w, "unable to read body", http.StatusBadRequest)
+				return
+			}
+			plaintext, err := dec.Decrypt(alg, data)
+			if err != nil {
+				http.Error(w, "unable to decrypt body", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(plaintext))
+			r.ContentLength = int64(len(plaintext))
+			r.Header.Del(payloadcrypto.Header)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
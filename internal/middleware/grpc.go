@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/counters"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/cryptohelpers"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/grpcapi"
+	pb "github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/proto"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tenant"
+)
+
+// Ключи метаданных gRPC совпадают с заголовками HTTP (метаданные всегда в нижнем регистре)
+var (
+	mdHash      = strings.ToLower("HashSHA256")
+	mdTimestamp = strings.ToLower(cryptohelpers.HeaderTimestamp)
+	mdNonce     = strings.ToLower(cryptohelpers.HeaderNonce)
+	mdTenant    = strings.ToLower(tenant.Header)
+	mdRealIP    = strings.ToLower(RealIPHeader)
+
+	mdCounterMode = strings.ToLower(counters.ModeHeader)
+	mdInstance    = strings.ToLower(counters.InstanceHeader)
+	mdStarted     = strings.ToLower(counters.StartedHeader)
+)
+
+// GRPCGuard — те же проверки, что у HTTP-маршрутов, для gRPC: арендатор, доверенная подсеть и подпись.
+//
+// Подпись унарного вызова — HMAC от детерминированно сериализованного запроса (proto.MarshalOptions{Deterministic: true})
+// вместе с меткой времени и nonce, как у HTTP. Метаданные потока передаются один раз и присланные метрики
+// не покрывают, поэтому в потоке Push подписано каждое сообщение (поле signature, см. grpcapi.SignMetric),
+// и проверяется оно при получении — с той же защитой от повторов.
+type GRPCGuard struct {
+	Tenants *tenant.Registry
+	Trusted []*net.IPNet
+	Key     string
+	Mode    SignMode
+	Stats   *SignatureStats
+	Replay  *ReplayGuard
+	// Counters пересчитывает накопительные счётчики (метаданные x-counter-mode: cumulative);
+	// nil — такие вызовы отклоняются, как у CumulativeCounters
+	Counters *counters.Tracker
+
+	// Mutating — полные имена методов (/metrics.Metrics/Update), которые изменяют данные:
+	// к ним применяется доверенная подсеть
+	Mutating map[string]bool
+	// Signed — методы, для которых проверяется подпись; у арендатора не по умолчанию — у всех методов
+	Signed map[string]bool
+}
+
+// Unary возвращает перехватчик унарных вызовов
+func (g *GRPCGuard) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := g.check(ctx, info.FullMethod, func() ([]byte, error) {
+			msg, ok := req.(proto.Message)
+			if !ok {
+				return nil, status.Error(codes.Internal, "request is not a protobuf message")
+			}
+			return proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Stream возвращает перехватчик потоковых вызовов; подпись проверяется у каждого сообщения (см. guardedStream)
+func (g *GRPCGuard) Stream() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := g.check(ss.Context(), info.FullMethod, nil)
+		if err != nil {
+			return err
+		}
+		gs := &guardedStream{ServerStream: ss, ctx: ctx}
+		if g.Signed[info.FullMethod] || tenant.IDFromContext(ctx) != tenant.Default {
+			gs.verifier = g.verifier()
+			gs.method = info.FullMethod
+		}
+		return handler(srv, gs)
+	}
+}
+
+func (g *GRPCGuard) verifier() *signatureVerifier {
+	v := &signatureVerifier{key: g.Key, mode: g.Mode, stats: g.Stats, replay: g.Replay}
+	if v.stats == nil {
+		v.stats = &SignatureStats{}
+	}
+	return v
+}
+
+// check выполняет проверки и возвращает контекст с арендатором.
+// body == nil — подпись вызова не проверяется: у потока она проверяется по сообщениям.
+func (g *GRPCGuard) check(ctx context.Context, method string, body func() ([]byte, error)) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if g.Tenants != nil {
+		t, ok := g.Tenants.Lookup(firstMD(md, mdTenant))
+		if !ok {
+			return ctx, status.Error(codes.PermissionDenied, "unknown tenant")
+		}
+		ctx = tenant.WithTenant(ctx, t)
+	}
+
+	src, cumulative, err := counters.ParseSource(firstMD(md, mdCounterMode), firstMD(md, mdInstance), firstMD(md, mdStarted))
+	if err != nil {
+		return ctx, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if cumulative {
+		if g.Counters == nil {
+			return ctx, status.Error(codes.InvalidArgument, "cumulative counters are disabled")
+		}
+		ctx = g.Counters.Bind(ctx, src)
+	}
+
+	if len(g.Trusted) > 0 && g.Mutating[method] {
+		ip := grpcClientIP(ctx, md)
+		if ip == nil || !containsIP(g.Trusted, ip) {
+			return ctx, status.Error(codes.PermissionDenied, "ip is not in trusted subnet")
+		}
+	}
+
+	// арендатор не по умолчанию подтверждается подписью на любом методе, в том числе на чтении
+	if body != nil && (g.Signed[method] || tenant.IDFromContext(ctx) != tenant.Default) {
+		err := g.verifier().verify(ctx, signedRequest{
+			hash:      firstMD(md, mdHash),
+			timestamp: firstMD(md, mdTimestamp),
+			nonce:     firstMD(md, mdNonce),
+			body:      body,
+			logFields: []zap.Field{zap.String("method", method), zap.String("remote", peerAddr(ctx))},
+		})
+		if err != nil {
+			return ctx, status.Error(grpcCode(err.status), err.msg)
+		}
+	}
+	return ctx, nil
+}
+
+// guardedStream подменяет контекст потока контекстом с арендатором и, если задан verifier,
+// проверяет подпись каждого полученного сообщения
+type guardedStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	verifier *signatureVerifier
+	method   string
+}
+
+func (s *guardedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *guardedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil || s.verifier == nil {
+		return err
+	}
+	msg, ok := m.(*pb.Metric)
+	if !ok {
+		return status.Error(codes.Internal, "stream message cannot be signed")
+	}
+	sig := msg.GetSignature()
+	var ts string
+	if sig.GetTimestamp() != 0 {
+		ts = strconv.FormatInt(sig.GetTimestamp(), 10)
+	}
+	err := s.verifier.verify(s.ctx, signedRequest{
+		hash:      sig.GetHash(),
+		timestamp: ts,
+		nonce:     sig.GetNonce(),
+		body:      func() ([]byte, error) { return grpcapi.MetricPayload(msg) },
+		logFields: []zap.Field{zap.String("method", s.method), zap.String("remote", peerAddr(s.ctx))},
+	})
+	if err != nil {
+		return status.Error(grpcCode(err.status), err.msg)
+	}
+	return nil
+}
+
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// grpcClientIP возвращает IP агента: из метаданных x-real-ip или из адреса соединения
+func grpcClientIP(ctx context.Context, md metadata.MD) net.IP {
+	if h := strings.TrimSpace(firstMD(md, mdRealIP)); h != "" {
+		return net.ParseIP(h)
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func firstMD(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// grpcCode переводит код HTTP из signatureError в код gRPC
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	}
+	return codes.Internal
+}
@@ -2,46 +2,218 @@ package middleware
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
 
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/cryptohelpers"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tenant"
+)
+
+// SignMode — как поступать с запросами без подписи, если ключ задан
+type SignMode string
+
+const (
+	// SignOptional — запросы без подписи пропускаются (для автотестов и обратной совместимости)
+	SignOptional SignMode = "optional"
+	// SignGrace — запросы без подписи пропускаются, но логируются и считаются: переходный период
+	SignGrace SignMode = "grace"
+	// SignStrict — запросы без подписи отклоняются с 401
+	SignStrict SignMode = "strict"
 )
 
+// ParseSignMode разбирает значение флага -sign-mode; пустая строка — SignOptional
+func ParseSignMode(s string) (SignMode, error) {
+	switch m := SignMode(s); m {
+	case "":
+		return SignOptional, nil
+	case SignOptional, SignGrace, SignStrict:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown sign mode %q (want optional, grace or strict)", s)
+}
+
+// SignatureStats — счётчики проверки подписей, отдаются в /metrics
+type SignatureStats struct {
+	unsignedAccepted atomic.Int64
+	unsignedRejected atomic.Int64
+	invalidRejected  atomic.Int64
+	staleRejected    atomic.Int64
+	replayRejected   atomic.Int64
+}
+
+// Counters возвращает текущие значения счётчиков по именам метрик
+func (s *SignatureStats) Counters() map[string]int64 {
+	return map[string]int64{
+		"server_unsigned_requests_accepted":  s.unsignedAccepted.Load(),
+		"server_unsigned_requests_rejected":  s.unsignedRejected.Load(),
+		"server_invalid_signatures_rejected": s.invalidRejected.Load(),
+		"server_stale_requests_rejected":     s.staleRejected.Load(),
+		"server_replayed_requests_rejected":  s.replayRejected.Load(),
+	}
+}
+
+// ValidateHashSHA256 проверяет подпись тела ключом арендатора из контекста (см. ResolveTenant);
+// если арендатор не определён, используется key. Запросы без подписи пропускаются,
+// кроме запросов арендатора не по умолчанию — без подписи с меткой времени и nonce они всегда получают 401.
 func ValidateHashSHA256(key string) func(http.Handler) http.Handler {
+	return RequireHashSHA256(key, SignOptional, nil, nil)
+}
+
+// RequireHashSHA256 как ValidateHashSHA256, но поведение для запросов без подписи задаётся mode.
+// Если запрос несёт заголовки метки времени и nonce (cryptohelpers.HeaderTimestamp/HeaderNonce),
+// они входят в подпись, а replay отклоняет устаревшие (401) и повторные (409) запросы.
+// При заданном replay подпись только тела считается отсутствующей в любом режиме: её можно
+// повторять бесконечно, поэтому strict её отклоняет, а grace и optional пропускают и считают.
+// stats и replay могут быть nil.
+func RequireHashSHA256(key string, mode SignMode, stats *SignatureStats, replay *ReplayGuard) func(http.Handler) http.Handler {
+	v := signatureVerifier{key: key, mode: mode, stats: stats, replay: replay}
+	if v.stats == nil {
+		v.stats = &SignatureStats{}
+	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// если ключ не задан — ничего не проверяем
-			if key == "" {
-				next.ServeHTTP(w, r)
-				return
-			}
-
-			// читаем подпись только из правильного заголовка
-			sentHash := r.Header.Get("HashSHA256")
-
-			// пропускаем запросы без подписи (для автотестов и обратной совместимости)
-			if sentHash == "" {
-				next.ServeHTTP(w, r)
-				return
+			// тело читаем, только если подпись действительно нужно сверить
+			readBody := func() ([]byte, error) {
+				// после gzip-мидлвари тут уже распаковано
+				bodyBytes, err := io.ReadAll(r.Body)
+				if err != nil {
+					return nil, err
+				}
+				// возвращаем тело в r.Body для последующих обработчиков
+				r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+				return bodyBytes, nil
 			}
 
-			// читаем тело (после gzip-мидлвари тут уже распаковано)
-			bodyBytes, err := io.ReadAll(r.Body)
+			err := v.verify(r.Context(), signedRequest{
+				hash:      r.Header.Get("HashSHA256"),
+				timestamp: r.Header.Get(cryptohelpers.HeaderTimestamp),
+				nonce:     r.Header.Get(cryptohelpers.HeaderNonce),
+				body:      readBody,
+				logFields: []zap.Field{zap.String("uri", r.RequestURI), zap.String("remote", r.RemoteAddr)},
+			})
 			if err != nil {
-				http.Error(w, "unable to read body", http.StatusInternalServerError)
+				http.Error(w, err.msg, err.status)
 				return
 			}
-			// возвращаем тело в r.Body для последующих обработчиков
-			r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-			// сверяем HMAC от "сырых" данных (до сжатия)
-			if !cryptohelpers.Compare(bodyBytes, key, sentHash) {
-				http.Error(w, "invalid signature", http.StatusBadRequest)
-				return
+// signedRequest — то, что нужно для проверки подписи, независимо от транспорта (HTTP или gRPC)
+type signedRequest struct {
+	hash      string
+	timestamp string
+	nonce     string
+	body      func() ([]byte, error)
+	logFields []zap.Field
+}
+
+// signatureError — отказ в проверке подписи; status — код HTTP, для gRPC он переводится в codes.Code
+type signatureError struct {
+	status int
+	msg    string
+}
+
+type signatureVerifier struct {
+	key    string
+	mode   SignMode
+	stats  *SignatureStats
+	replay *ReplayGuard
+}
+
+// verify проверяет подпись запроса ключом арендатора из контекста; nil — запрос можно обрабатывать
+func (v signatureVerifier) verify(ctx context.Context, req signedRequest) *signatureError {
+	key := tenant.KeyOr(ctx, v.key)
+
+	// если ключ не задан — ничего не проверяем
+	if key == "" {
+		return nil
+	}
+
+	legacy := req.hash != "" && req.timestamp == "" && req.nonce == ""
+
+	// арендатор выбирается заголовком, который может прислать кто угодно: не по умолчанию
+	// он подтверждается только подписью его ключом с меткой времени и nonce, в любом режиме.
+	// Подпись только тела не годится: у запроса на чтение с пустым телом она всегда одна и та же.
+	if (req.hash == "" || legacy) && tenant.IDFromContext(ctx) != tenant.Default {
+		v.stats.unsignedRejected.Add(1)
+		return &signatureError{http.StatusUnauthorized, "tenant requests must be signed with the tenant key, timestamp and nonce"}
+	}
+
+	// без подписи, а при защите от повторов — и с подписью без метки времени
+	if req.hash == "" || (legacy && v.replay != nil) {
+		switch v.mode {
+		case SignStrict:
+			v.stats.unsignedRejected.Add(1)
+			return &signatureError{http.StatusUnauthorized, "signature with timestamp and nonce required"}
+		case SignGrace:
+			v.stats.unsignedAccepted.Add(1)
+			fields := append([]zap.Field{
+				zap.String("tenant", tenant.IDFromContext(ctx)),
+				zap.Bool("body_only_signature", legacy),
+			}, req.logFields...)
+			logger.Log.Warn("unsigned request accepted during grace period", fields...)
+		default:
+			// в optional без подписи пропускается молча, но повторяемую подпись видно по счётчику:
+			// иначе её нельзя отличить от защищённой от повторов
+			if legacy {
+				v.stats.unsignedAccepted.Add(1)
 			}
+		}
+		if req.hash == "" {
+			return nil
+		}
+	}
 
-			next.ServeHTTP(w, r)
-		})
+	// nonce входит в подписываемую строку и в ключ кеша повторов: длина и алфавит проверяются
+	// до чтения тела и HMAC, чтобы мусорные заголовки не раздували ни работу, ни память
+	var ts int64
+	if !legacy {
+		var err error
+		ts, err = strconv.ParseInt(req.timestamp, 10, 64)
+		if err != nil || !cryptohelpers.ValidNonce(req.nonce) {
+			v.stats.invalidRejected.Add(1)
+			return &signatureError{http.StatusBadRequest, "invalid request timestamp or nonce"}
+		}
+	}
+
+	body, err := req.body()
+	if err != nil {
+		return &signatureError{http.StatusInternalServerError, "unable to read body"}
+	}
+
+	// сверяем HMAC от "сырых" данных (до сжатия)
+	var valid bool
+	if legacy {
+		valid = cryptohelpers.Compare(body, key, req.hash)
+	} else {
+		valid = cryptohelpers.CompareRequest(body, key, ts, req.nonce, req.hash)
+	}
+	if !valid {
+		v.stats.invalidRejected.Add(1)
+		return &signatureError{http.StatusBadRequest, "invalid signature"}
+	}
+
+	// nonce проверяем только после подписи, чтобы чужие запросы не засоряли кеш
+	if v.replay != nil && !legacy {
+		switch err := v.replay.Check(tenant.IDFromContext(ctx)+"/"+req.nonce, time.Unix(ts, 0)); {
+		case errors.Is(err, errStaleRequest):
+			v.stats.staleRejected.Add(1)
+			return &signatureError{http.StatusUnauthorized, err.Error()}
+		case errors.Is(err, errReplayedRequest):
+			v.stats.replayRejected.Add(1)
+			return &signatureError{http.StatusConflict, err.Error()}
+		}
 	}
+	return nil
 }
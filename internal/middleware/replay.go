@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultReplayWindow — допустимое расхождение часов агента и сервера по умолчанию
+const DefaultReplayWindow = 5 * time.Minute
+
+var (
+	errStaleRequest    = errors.New("request timestamp outside allowed window")
+	errReplayedRequest = errors.New("request nonce already used")
+)
+
+// ReplayGuard отклоняет подписанные запросы со слишком старой (или будущей) меткой времени
+// и повторно использованные nonce. Nonce хранятся, пока их метка времени не выйдет из окна:
+// более старый запрос всё равно будет отклонён по времени.
+type ReplayGuard struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	seen      map[string]time.Time // nonce -> метка времени запроса
+	lastSweep time.Time
+}
+
+// NewReplayGuard создаёт проверку с окном ±window; window <= 0 — DefaultReplayWindow
+func NewReplayGuard(window time.Duration) *ReplayGuard {
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+	return &ReplayGuard{
+		window: window,
+		now:    time.Now,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Check проверяет метку времени и запоминает nonce. nonce должен учитывать арендатора,
+// если у арендаторов разные ключи.
+func (g *ReplayGuard) Check(nonce string, ts time.Time) error {
+	now := g.now()
+	if ts.Before(now.Add(-g.window)) || ts.After(now.Add(g.window)) {
+		return errStaleRequest
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.sweep(now)
+	if _, ok := g.seen[nonce]; ok {
+		return errReplayedRequest
+	}
+	g.seen[nonce] = ts
+	return nil
+}
+
+// sweep удаляет nonce, вышедшие за окно; выполняется не чаще раза в пол-окна. Вызывать под g.mu
+func (g *ReplayGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < g.window/2 {
+		return
+	}
+	g.lastSweep = now
+	cutoff := now.Add(-g.window)
+	for n, ts := range g.seen {
+		if ts.Before(cutoff) {
+			delete(g.seen, n)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tenant"
+)
+
+// ResolveTenant определяет арендатора по заголовку X-Tenant-ID и кладёт его в контекст.
+// Запрос без заголовка относится к арендатору по умолчанию, неизвестный арендатор — 403.
+func ResolveTenant(reg *tenant.Registry) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := reg.Lookup(r.Header.Get(tenant.Header))
+			if !ok {
+				http.Error(w, "unknown tenant", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(tenant.WithTenant(r.Context(), t)))
+		})
+	}
+}
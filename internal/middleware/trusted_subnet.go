@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RealIPHeader — заголовок, в котором агент передаёт свой IP
+const RealIPHeader = "X-Real-IP"
+
+// ParseSubnets разбирает список CIDR через запятую: "10.0.0.0/8,192.168.1.0/24"
+func ParseSubnets(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted subnet %q: %w", part, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// TrustedSubnet пропускает только запросы с IP из доверенных подсетей, остальным — 403.
+// IP берётся из заголовка X-Real-IP, а если его нет — из адреса соединения.
+// Пустой список подсетей отключает проверку.
+func TrustedSubnet(nets []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(nets) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r)
+			if ip == nil {
+				http.Error(w, "cannot determine client ip", http.StatusForbidden)
+				return
+			}
+			if !containsIP(nets, ip) {
+				http.Error(w, "ip is not in trusted subnet", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIP возвращает IP агента: из X-Real-IP или из RemoteAddr
+func clientIP(r *http.Request) net.IP {
+	if h := strings.TrimSpace(r.Header.Get(RealIPHeader)); h != "" {
+		return net.ParseIP(h)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ErrBoundsMismatch — попытка слить гистограммы с разными границами бакетов
+var ErrBoundsMismatch = errors.New("histogram bucket bounds mismatch")
+
+// HistogramData — распределение наблюдений по бакетам.
+// Bounds — возрастающие верхние границы бакетов (включительно), последний бакет (+Inf) в Bounds не входит.
+// Counts — число наблюдений в каждом бакете (не накопительно), len(Counts) == len(Bounds)+1.
+// Гистограммы с одинаковыми границами складываются, поэтому агент отправляет
+// наблюдения за интервал, а сервер копит их.
+type HistogramData struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    float64   `json:"sum"`
+}
+
+// NewHistogramData создаёт пустую гистограмму с заданными границами
+func NewHistogramData(bounds []float64) *HistogramData {
+	b := append([]float64(nil), bounds...)
+	return &HistogramData{
+		Bounds: b,
+		Counts: make([]uint64, len(b)+1),
+	}
+}
+
+// Observe добавляет одно наблюдение
+func (h *HistogramData) Observe(v float64) {
+	i := sort.SearchFloat64s(h.Bounds, v) // первый бакет с границей >= v
+	h.Counts[i]++
+	h.Sum += v
+}
+
+// Count возвращает общее число наблюдений
+func (h *HistogramData) Count() uint64 {
+	var n uint64
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+// Validate проверяет, что границы возрастают и число бакетов согласовано с ними
+func (h *HistogramData) Validate() error {
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("histogram must have %d counts for %d bounds, got %d", len(h.Bounds)+1, len(h.Bounds), len(h.Counts))
+	}
+	for i, b := range h.Bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("histogram bound %v is not finite", b)
+		}
+		if i > 0 && b <= h.Bounds[i-1] {
+			return errors.New("histogram bounds must be strictly increasing")
+		}
+	}
+	return nil
+}
+
+// SameBounds сообщает, можно ли слить гистограммы
+func (h *HistogramData) SameBounds(other *HistogramData) bool {
+	if len(h.Bounds) != len(other.Bounds) {
+		return false
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != other.Bounds[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge прибавляет к h наблюдения из other
+func (h *HistogramData) Merge(other *HistogramData) error {
+	if !h.SameBounds(other) {
+		return ErrBoundsMismatch
+	}
+	for i, c := range other.Counts {
+		h.Counts[i] += c
+	}
+	h.Sum += other.Sum
+	return nil
+}
+
+// Clone возвращает независимую копию
+func (h *HistogramData) Clone() *HistogramData {
+	return &HistogramData{
+		Bounds: append([]float64(nil), h.Bounds...),
+		Counts: append([]uint64(nil), h.Counts...),
+		Sum:    h.Sum,
+	}
+}
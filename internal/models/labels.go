@@ -0,0 +1,157 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Хранилища различают ряды по ключу серии: имя метрики плюс отсортированный набор меток
+// в нотации Prometheus — `name{host="a",mount="/"}`. У метрики без меток ключ совпадает с ID,
+// поэтому клиенты без меток работают как раньше.
+
+var errBadSeriesKey = errors.New("malformed series key")
+
+// Key возвращает ключ серии метрики
+func (m Metrics) Key() string {
+	return SeriesKey(m.ID, m.Labels)
+}
+
+// ValidateLabels проверяет имена меток и то, что ID с метками не сломает разбор ключа серии
+func (m Metrics) ValidateLabels() error {
+	if len(m.Labels) == 0 {
+		return nil
+	}
+	if strings.ContainsAny(m.ID, "{}") {
+		return fmt.Errorf("metric id %q must not contain braces when labels are set", m.ID)
+	}
+	for name := range m.Labels {
+		if !isLabelName(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	return nil
+}
+
+// SeriesKey строит ключ серии из имени и меток; метки сортируются по имени
+func SeriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// ParseSeriesKey разбирает ключ серии обратно на имя и метки.
+// Для ключа без меток возвращает nil вместо пустой карты.
+func ParseSeriesKey(key string) (string, map[string]string, error) {
+	open := strings.IndexByte(key, '{')
+	if open < 0 {
+		return key, nil, nil
+	}
+	if !strings.HasSuffix(key, "}") {
+		return "", nil, errBadSeriesKey
+	}
+
+	name := key[:open]
+	rest := key[open+1 : len(key)-1]
+	labels := make(map[string]string)
+	for rest != "" {
+		eq := strings.Index(rest, `="`)
+		if eq < 0 {
+			return "", nil, errBadSeriesKey
+		}
+		label := rest[:eq]
+		if !isLabelName(label) {
+			return "", nil, errBadSeriesKey
+		}
+		rest = rest[eq+2:]
+
+		var val strings.Builder
+		closed := false
+		for i := 0; i < len(rest); i++ {
+			c := rest[i]
+			if c == '\\' && i+1 < len(rest) {
+				i++
+				switch rest[i] {
+				case 'n':
+					val.WriteByte('\n')
+				default:
+					val.WriteByte(rest[i])
+				}
+				continue
+			}
+			if c == '"' {
+				rest = rest[i+1:]
+				closed = true
+				break
+			}
+			val.WriteByte(c)
+		}
+		if !closed {
+			return "", nil, errBadSeriesKey
+		}
+		labels[label] = val.String()
+
+		if rest != "" {
+			if rest[0] != ',' {
+				return "", nil, errBadSeriesKey
+			}
+			rest = rest[1:]
+		}
+	}
+	return name, labels, nil
+}
+
+// SplitSeriesKey как ParseSeriesKey, но ключ, который не удалось разобрать,
+// целиком считается именем метрики без меток.
+func SplitSeriesKey(key string) (string, map[string]string) {
+	name, labels, err := ParseSeriesKey(key)
+	if err != nil {
+		return key, nil
+	}
+	return name, labels
+}
+
+func escapeLabelValue(v string) string {
+	if !strings.ContainsAny(v, "\\\"\n") {
+		return v
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return r.Replace(v)
+}
+
+// isLabelName проверяет имя метки на соответствие [a-zA-Z_][a-zA-Z0-9_]*
+func isLabelName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
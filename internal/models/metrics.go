@@ -1,8 +1,12 @@
 package models
 
+import "time"
+
 const (
-	Counter = "counter"
-	Gauge   = "gauge"
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
+	Summary   = "summary"
 )
 
 // NOTE: Не усложняем пример, вводя иерархическую вложенность структур.
@@ -10,10 +14,23 @@ const (
 // Delta и Value объявлены через указатели,
 // что бы отличать значение "0", от не заданного значения
 // и соответственно не кодировать в структуру.
+// Labels — необязательные измерения метрики (host, cpu, mount...);
+// серии с одним ID, но разными метками хранятся раздельно.
+// Histogram заполняется только для MType == "histogram", Summary — только для MType == "summary".
 type Metrics struct {
-	ID    string   `json:"id"`
-	MType string   `json:"type"`
-	Delta *int64   `json:"delta,omitempty"`
-	Value *float64 `json:"value,omitempty"`
-	Hash  string   `json:"hash,omitempty"`
+	ID        string            `json:"id"`
+	MType     string            `json:"type"`
+	Delta     *int64            `json:"delta,omitempty"`
+	Value     *float64          `json:"value,omitempty"`
+	Hash      string            `json:"hash,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Histogram *HistogramData    `json:"histogram,omitempty"`
+	Summary   *SummaryData      `json:"summary,omitempty"`
+}
+
+// Sample — одна точка истории метрики.
+// Для gauge Value — установленное значение, для counter — применённое приращение (delta).
+type Sample struct {
+	Timestamp time.Time `json:"ts"`
+	Value     float64   `json:"value"`
 }
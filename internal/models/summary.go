@@ -0,0 +1,88 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrQuantilesMismatch — попытка слить сводки с разными наборами квантилей.
+// errors.Is(err, ErrBoundsMismatch) для неё тоже истинно: для клиента это тот же конфликт формы метрики (409).
+var ErrQuantilesMismatch error = quantilesMismatchError{}
+
+type quantilesMismatchError struct{}
+
+func (quantilesMismatchError) Error() string { return "summary quantiles mismatch" }
+
+func (quantilesMismatchError) Is(target error) bool { return target == ErrBoundsMismatch }
+
+// Quantile — значение квантиля φ (0 ≤ φ ≤ 1)
+type Quantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// SummaryData — сводка наблюдений: их число, сумма и квантили.
+// Квантили считает агент по наблюдениям своего интервала, и слить квантили разных интервалов нельзя,
+// поэтому сервер копит Count и Sum, а квантили заменяет последними присланными (как summary в Prometheus:
+// квантили — за недавнее окно, сумма и число — за всё время).
+type SummaryData struct {
+	Count     uint64     `json:"count"`
+	Sum       float64    `json:"sum"`
+	Quantiles []Quantile `json:"quantiles"`
+}
+
+// Validate проверяет, что φ лежат в [0, 1] и строго возрастают, а значения конечны
+func (s *SummaryData) Validate() error {
+	for i, q := range s.Quantiles {
+		if math.IsNaN(q.Quantile) || q.Quantile < 0 || q.Quantile > 1 {
+			return fmt.Errorf("summary quantile %v is out of [0, 1]", q.Quantile)
+		}
+		if i > 0 && q.Quantile <= s.Quantiles[i-1].Quantile {
+			return errors.New("summary quantiles must be strictly increasing")
+		}
+		if math.IsNaN(q.Value) || math.IsInf(q.Value, 0) {
+			return fmt.Errorf("summary quantile %v value is not finite", q.Quantile)
+		}
+	}
+	if math.IsNaN(s.Sum) || math.IsInf(s.Sum, 0) {
+		return errors.New("summary sum is not finite")
+	}
+	return nil
+}
+
+// SameQuantiles сообщает, можно ли слить сводки
+func (s *SummaryData) SameQuantiles(other *SummaryData) bool {
+	if len(s.Quantiles) != len(other.Quantiles) {
+		return false
+	}
+	for i := range s.Quantiles {
+		if s.Quantiles[i].Quantile != other.Quantiles[i].Quantile {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge прибавляет к s число и сумму наблюдений other и берёт его квантили;
+// интервал без наблюдений квантили не меняет
+func (s *SummaryData) Merge(other *SummaryData) error {
+	if !s.SameQuantiles(other) {
+		return ErrQuantilesMismatch
+	}
+	s.Count += other.Count
+	s.Sum += other.Sum
+	if other.Count > 0 {
+		copy(s.Quantiles, other.Quantiles)
+	}
+	return nil
+}
+
+// Clone возвращает независимую копию
+func (s *SummaryData) Clone() *SummaryData {
+	return &SummaryData{
+		Count:     s.Count,
+		Sum:       s.Sum,
+		Quantiles: append([]Quantile(nil), s.Quantiles...),
+	}
+}
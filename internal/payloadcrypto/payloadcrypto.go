@@ -0,0 +1,236 @@
+// Package payloadcrypto шифрует тела запросов агента открытым ключом сервера (RSA или X25519).
+//
+// Шифрование гибридное: тело шифруется AES-256-GCM случайным ключом, а ключ передаётся
+//   - для RSA — зашифрованным RSA-OAEP (SHA-256): [2 байта длины][обёрнутый ключ][nonce][шифротекст];
+//   - для X25519 — выводится через ECDH с одноразовой парой и HKDF-SHA256: [32 байта эфемерного ключа][nonce][шифротекст].
+//
+// Алгоритм передаётся в заголовке Header.
+package payloadcrypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Header — заголовок с алгоритмом шифрования тела
+const Header = "X-Encryption"
+
+// Значения заголовка Header
+const (
+	AlgRSA    = "rsa-oaep-aes256gcm"
+	AlgX25519 = "x25519-aes256gcm"
+)
+
+// hkdfInfo отделяет ключи этого протокола от других применений той же пары
+const hkdfInfo = "metrics payload v1"
+
+var (
+	// ErrUnsupportedKey — ключ не RSA и не X25519
+	ErrUnsupportedKey = errors.New("payloadcrypto: unsupported key type, want RSA or X25519")
+	// ErrAlgMismatch — тело зашифровано не тем алгоритмом, что ключ сервера
+	ErrAlgMismatch = errors.New("payloadcrypto: algorithm does not match server key")
+
+	errShortPayload = errors.New("payloadcrypto: payload too short")
+)
+
+// Encryptor шифрует тела открытым ключом сервера
+type Encryptor struct {
+	rsaKey    *rsa.PublicKey
+	x25519Key *ecdh.PublicKey
+}
+
+// Decryptor расшифровывает тела закрытым ключом сервера
+type Decryptor struct {
+	rsaKey    *rsa.PrivateKey
+	x25519Key *ecdh.PrivateKey
+}
+
+// LoadPublicKey читает открытый ключ сервера из PEM (PKIX, "PUBLIC KEY")
+func LoadPublicKey(path string) (*Encryptor, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("payloadcrypto: parse public key: %w", err)
+	}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return &Encryptor{rsaKey: k}, nil
+	case *ecdh.PublicKey:
+		if k.Curve() == ecdh.X25519() {
+			return &Encryptor{x25519Key: k}, nil
+		}
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// LoadPrivateKey читает закрытый ключ сервера из PEM (PKCS#8 "PRIVATE KEY" или PKCS#1 "RSA PRIVATE KEY")
+func LoadPrivateKey(path string) (*Decryptor, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("payloadcrypto: parse private key: %w", err)
+		}
+		return &Decryptor{rsaKey: k}, nil
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("payloadcrypto: parse private key: %w", err)
+	}
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		return &Decryptor{rsaKey: k}, nil
+	case *ecdh.PrivateKey:
+		if k.Curve() == ecdh.X25519() {
+			return &Decryptor{x25519Key: k}, nil
+		}
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// Alg возвращает значение заголовка Header для зашифрованных этим ключом тел
+func (e *Encryptor) Alg() string {
+	if e.rsaKey != nil {
+		return AlgRSA
+	}
+	return AlgX25519
+}
+
+// Encrypt шифрует plaintext
+func (e *Encryptor) Encrypt(plaintext []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	var prefix []byte
+
+	if e.rsaKey != nil {
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, e.rsaKey, key, nil)
+		if err != nil {
+			return nil, fmt.Errorf("payloadcrypto: wrap key: %w", err)
+		}
+		prefix = binary.BigEndian.AppendUint16(nil, uint16(len(wrapped)))
+		prefix = append(prefix, wrapped...)
+	} else {
+		eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := eph.ECDH(e.x25519Key)
+		if err != nil {
+			return nil, err
+		}
+		prefix = eph.PublicKey().Bytes()
+		if key, err = deriveKey(shared, prefix, e.x25519Key.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(prefix, nonce...)
+	return aead.Seal(out, nonce, plaintext, nil), nil
+}
+
+// Decrypt расшифровывает тело, зашифрованное алгоритмом alg (значение заголовка Header)
+func (d *Decryptor) Decrypt(alg string, data []byte) ([]byte, error) {
+	var key []byte
+	switch {
+	case alg == AlgRSA && d.rsaKey != nil:
+		if len(data) < 2 {
+			return nil, errShortPayload
+		}
+		n := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+n {
+			return nil, errShortPayload
+		}
+		var err error
+		key, err = rsa.DecryptOAEP(sha256.New(), nil, d.rsaKey, data[2:2+n], nil)
+		if err != nil {
+			return nil, fmt.Errorf("payloadcrypto: unwrap key: %w", err)
+		}
+		data = data[2+n:]
+	case alg == AlgX25519 && d.x25519Key != nil:
+		if len(data) < 32 {
+			return nil, errShortPayload
+		}
+		ephBytes := data[:32]
+		eph, err := ecdh.X25519().NewPublicKey(ephBytes)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := d.x25519Key.ECDH(eph)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = deriveKey(shared, ephBytes, d.x25519Key.PublicKey().Bytes()); err != nil {
+			return nil, err
+		}
+		data = data[32:]
+	default:
+		return nil, ErrAlgMismatch
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errShortPayload
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("payloadcrypto: decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+// deriveKey выводит ключ AES из общего секрета ECDH; соль — оба открытых ключа
+func deriveKey(shared, ephPub, serverPub []byte) ([]byte, error) {
+	salt := append(append([]byte(nil), ephPub...), serverPub...)
+	return hkdf.Key(sha256.New, shared, salt, hkdfInfo, 32)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("payloadcrypto: read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("payloadcrypto: no PEM block in %s", path)
+	}
+	return block, nil
+}
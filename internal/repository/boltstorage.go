@@ -0,0 +1,460 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tenant"
+)
+
+// Бакеты файла bbolt. Ключ значения — арендатор, \x00 и ключ серии (см. boltKey);
+// в *_samples на каждую серию свой вложенный бакет с точками по порядку записи.
+var (
+	boltGauges         = []byte("gauges")
+	boltCounters       = []byte("counters")
+	boltHistograms     = []byte("histograms")
+	boltSummaries      = []byte("summaries")
+	boltGaugeSamples   = []byte("gauge_samples")
+	boltCounterSamples = []byte("counter_samples")
+	boltIdempotency    = []byte("idempotency_keys")
+)
+
+// BoltStorage — хранилище во встроенной базе bbolt (один файл, без внешних сервисов).
+// Каждое изменение — отдельная транзакция с fsync, батч применяется одной транзакцией.
+type BoltStorage struct {
+	db *bolt.DB
+
+	// сколько точек истории хранить на серию, как в MemStorage
+	historyLimit int
+	idemTTL      time.Duration
+	idemPurgedAt time.Time // под транзакцией записи: bbolt допускает только одну
+}
+
+// NewBoltStorage открывает (создавая при необходимости) файл базы path
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, DefaultSnapshotPerm, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltGauges, boltCounters, boltHistograms, boltSummaries, boltGaugeSamples, boltCounterSamples, boltIdempotency} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStorage{
+		db:           db,
+		historyLimit: DefaultHistoryLimit,
+		idemTTL:      DefaultIdempotencyTTL,
+	}, nil
+}
+
+// Close закрывает файл базы
+func (b *BoltStorage) Close() error {
+	return b.db.Close()
+}
+
+// boltKey — ключ серии с префиксом арендатора
+func boltKey(tenantID, key string) []byte {
+	return append([]byte(tenantID+"\x00"), key...)
+}
+
+func boltTenantPrefix(ctx context.Context) []byte {
+	return []byte(tenant.IDFromContext(ctx) + "\x00")
+}
+
+func encodeFloat(v float64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(v))
+	return buf
+}
+
+func decodeFloat(buf []byte) float64 {
+	return math.Float64frombits(binary.BigEndian.Uint64(buf))
+}
+
+func encodeInt(v int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(v))
+	return buf
+}
+
+func decodeInt(buf []byte) int64 {
+	return int64(binary.BigEndian.Uint64(buf))
+}
+
+func (b *BoltStorage) UpdateGauge(ctx context.Context, key string, value float64) {
+	_ = b.UpdateGaugeChecked(ctx, key, value)
+}
+
+func (b *BoltStorage) UpdateCounter(ctx context.Context, key string, delta int64) {
+	_ = b.UpdateCounterChecked(ctx, key, delta)
+}
+
+func (b *BoltStorage) UpdateGaugeChecked(ctx context.Context, key string, value float64) error {
+	tenantID := tenant.IDFromContext(ctx)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return b.setGauge(tx, boltKey(tenantID, key), value, time.Now())
+	})
+	if err != nil {
+		logger.Log.Error("update gauge failed", zap.Error(err))
+	}
+	return err
+}
+
+func (b *BoltStorage) UpdateCounterChecked(ctx context.Context, key string, delta int64) error {
+	tenantID := tenant.IDFromContext(ctx)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return b.addCounter(tx, boltKey(tenantID, key), delta, time.Now())
+	})
+	if err != nil {
+		logger.Log.Error("update counter failed", zap.Error(err))
+	}
+	return err
+}
+
+// setGauge и addCounter применяют изменение и пишут точку в историю в транзакции tx
+func (b *BoltStorage) setGauge(tx *bolt.Tx, k []byte, value float64, ts time.Time) error {
+	if err := tx.Bucket(boltGauges).Put(k, encodeFloat(value)); err != nil {
+		return err
+	}
+	return b.pushSample(tx.Bucket(boltGaugeSamples), k, ts, value)
+}
+
+func (b *BoltStorage) addCounter(tx *bolt.Tx, k []byte, delta int64, ts time.Time) error {
+	bucket := tx.Bucket(boltCounters)
+	var cur int64
+	if v := bucket.Get(k); v != nil {
+		cur = decodeInt(v)
+	}
+	if err := bucket.Put(k, encodeInt(cur+delta)); err != nil {
+		return err
+	}
+	return b.pushSample(tx.Bucket(boltCounterSamples), k, ts, float64(delta))
+}
+
+// pushSample дописывает точку в бакет серии и удаляет самые старые сверх historyLimit.
+// Ключ точки — её порядковый номер, значение — время (unix-наносекунды) и значение.
+func (b *BoltStorage) pushSample(samples *bolt.Bucket, k []byte, ts time.Time, value float64) error {
+	series, err := samples.CreateBucketIfNotExists(k)
+	if err != nil {
+		return err
+	}
+	seq, err := series.NextSequence()
+	if err != nil {
+		return err
+	}
+	val := make([]byte, 16)
+	binary.BigEndian.PutUint64(val[0:8], uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint64(val[8:16], math.Float64bits(value))
+	if err := series.Put(encodeInt(int64(seq)), val); err != nil {
+		return err
+	}
+	if seq <= uint64(b.historyLimit) {
+		return nil
+	}
+	oldest := encodeInt(int64(seq - uint64(b.historyLimit)))
+	c := series.Cursor()
+	for sk, _ := c.First(); sk != nil && bytes.Compare(sk, oldest) <= 0; sk, _ = c.Next() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BoltStorage) GetGauge(ctx context.Context, key string) (val float64, ok bool) {
+	_ = b.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltGauges).Get(boltKey(tenant.IDFromContext(ctx), key)); v != nil {
+			val, ok = decodeFloat(v), true
+		}
+		return nil
+	})
+	return val, ok
+}
+
+func (b *BoltStorage) GetCounter(ctx context.Context, key string) (val int64, ok bool) {
+	_ = b.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltCounters).Get(boltKey(tenant.IDFromContext(ctx), key)); v != nil {
+			val, ok = decodeInt(v), true
+		}
+		return nil
+	})
+	return val, ok
+}
+
+func (b *BoltStorage) GetAllMetrics(ctx context.Context) (map[string]float64, map[string]int64) {
+	gauges := make(map[string]float64)
+	counters := make(map[string]int64)
+	prefix := boltTenantPrefix(ctx)
+
+	_ = b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltGauges).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			gauges[string(k[len(prefix):])] = decodeFloat(v)
+		}
+		c = tx.Bucket(boltCounters).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			counters[string(k[len(prefix):])] = decodeInt(v)
+		}
+		return nil
+	})
+	return gauges, counters
+}
+
+// UpdateBatch применяет батч одной транзакцией: при ошибке не применяется ничего
+func (b *BoltStorage) UpdateBatch(ctx context.Context, batch []models.Metrics) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return b.applyBatch(tx, tenant.IDFromContext(ctx), batch)
+	})
+}
+
+// UpdateBatchOnce применяет батч в одной транзакции с записью ключа идемпотентности
+func (b *BoltStorage) UpdateBatchOnce(ctx context.Context, idemKey string, batch []models.Metrics) (bool, error) {
+	tenantID := tenant.IDFromContext(ctx)
+	applied := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(boltIdempotency)
+		now := time.Now()
+		k := boltKey(tenantID, idemKey)
+		if v := keys.Get(k); v != nil && now.Sub(time.Unix(0, decodeInt(v))) < b.idemTTL {
+			return nil
+		}
+		if err := b.applyBatch(tx, tenantID, batch); err != nil {
+			return err
+		}
+		if err := b.purgeIdempotencyKeys(keys, now); err != nil {
+			return err
+		}
+		applied = true
+		return keys.Put(k, encodeInt(now.UnixNano()))
+	})
+	if err != nil {
+		return false, err
+	}
+	return applied, nil
+}
+
+// purgeIdempotencyKeys удаляет протухшие ключи не чаще раза в минуту; вызывать в транзакции записи
+func (b *BoltStorage) purgeIdempotencyKeys(keys *bolt.Bucket, now time.Time) error {
+	if now.Sub(b.idemPurgedAt) < time.Minute {
+		return nil
+	}
+	c := keys.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if now.Sub(time.Unix(0, decodeInt(v))) >= b.idemTTL {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+	}
+	b.idemPurgedAt = now
+	return nil
+}
+
+// applyBatch пишет метрики батча в транзакции tx
+func (b *BoltStorage) applyBatch(tx *bolt.Tx, tenantID string, batch []models.Metrics) error {
+	now := time.Now()
+	for _, m := range batch {
+		k := boltKey(tenantID, m.Key())
+		var err error
+		switch m.MType {
+		case "gauge":
+			if m.Value == nil {
+				continue
+			}
+			err = b.setGauge(tx, k, *m.Value, now)
+		case "counter":
+			if m.Delta == nil {
+				continue
+			}
+			err = b.addCounter(tx, k, *m.Delta, now)
+		case models.Histogram:
+			if m.Histogram == nil {
+				continue
+			}
+			err = mergeBoltHistogram(tx.Bucket(boltHistograms), k, m.Histogram)
+		case models.Summary:
+			if m.Summary == nil {
+				continue
+			}
+			err = mergeBoltSummary(tx.Bucket(boltSummaries), k, m.Summary)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeBoltHistogram сливает h с гистограммой под ключом k
+func mergeBoltHistogram(bucket *bolt.Bucket, k []byte, h *models.HistogramData) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	merged := h.Clone()
+	if v := bucket.Get(k); v != nil {
+		var cur models.HistogramData
+		if err := json.Unmarshal(v, &cur); err != nil {
+			return err
+		}
+		if err := cur.Merge(h); err != nil {
+			return err
+		}
+		merged = &cur
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(k, data)
+}
+
+// UpdateHistogram сливает наблюдения h с накопленной гистограммой
+func (b *BoltStorage) UpdateHistogram(ctx context.Context, key string, h *models.HistogramData) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return mergeBoltHistogram(tx.Bucket(boltHistograms), boltKey(tenant.IDFromContext(ctx), key), h)
+	})
+}
+
+func (b *BoltStorage) GetHistogram(ctx context.Context, key string) (*models.HistogramData, bool) {
+	var h *models.HistogramData
+	_ = b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltHistograms).Get(boltKey(tenant.IDFromContext(ctx), key))
+		if v == nil {
+			return nil
+		}
+		var cur models.HistogramData
+		if err := json.Unmarshal(v, &cur); err == nil {
+			h = &cur
+		}
+		return nil
+	})
+	return h, h != nil
+}
+
+func (b *BoltStorage) GetAllHistograms(ctx context.Context) map[string]*models.HistogramData {
+	res := make(map[string]*models.HistogramData)
+	prefix := boltTenantPrefix(ctx)
+	_ = b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltHistograms).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var h models.HistogramData
+			if err := json.Unmarshal(v, &h); err == nil {
+				res[string(k[len(prefix):])] = &h
+			}
+		}
+		return nil
+	})
+	return res
+}
+
+// mergeBoltSummary сливает sm со сводкой под ключом k
+func mergeBoltSummary(bucket *bolt.Bucket, k []byte, sm *models.SummaryData) error {
+	if err := sm.Validate(); err != nil {
+		return err
+	}
+	merged := sm.Clone()
+	if v := bucket.Get(k); v != nil {
+		var cur models.SummaryData
+		if err := json.Unmarshal(v, &cur); err != nil {
+			return err
+		}
+		if err := cur.Merge(sm); err != nil {
+			return err
+		}
+		merged = &cur
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(k, data)
+}
+
+// UpdateSummary сливает сводку sm с накопленной
+func (b *BoltStorage) UpdateSummary(ctx context.Context, key string, sm *models.SummaryData) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return mergeBoltSummary(tx.Bucket(boltSummaries), boltKey(tenant.IDFromContext(ctx), key), sm)
+	})
+}
+
+func (b *BoltStorage) GetSummary(ctx context.Context, key string) (*models.SummaryData, bool) {
+	var sm *models.SummaryData
+	_ = b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltSummaries).Get(boltKey(tenant.IDFromContext(ctx), key))
+		if v == nil {
+			return nil
+		}
+		var cur models.SummaryData
+		if err := json.Unmarshal(v, &cur); err == nil {
+			sm = &cur
+		}
+		return nil
+	})
+	return sm, sm != nil
+}
+
+func (b *BoltStorage) GetAllSummaries(ctx context.Context) map[string]*models.SummaryData {
+	res := make(map[string]*models.SummaryData)
+	prefix := boltTenantPrefix(ctx)
+	_ = b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltSummaries).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var sm models.SummaryData
+			if err := json.Unmarshal(v, &sm); err == nil {
+				res[string(k[len(prefix):])] = &sm
+			}
+		}
+		return nil
+	})
+	return res
+}
+
+// GetHistory возвращает точки метрики за интервал [from, to]
+func (b *BoltStorage) GetHistory(ctx context.Context, mtype, key string, from, to time.Time) ([]models.Sample, error) {
+	var bucket []byte
+	switch mtype {
+	case models.Gauge:
+		bucket = boltGaugeSamples
+	case models.Counter:
+		bucket = boltCounterSamples
+	default:
+		return nil, ErrUnknownMetricType
+	}
+
+	samples := make([]models.Sample, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		series := tx.Bucket(bucket).Bucket(boltKey(tenant.IDFromContext(ctx), key))
+		if series == nil {
+			return nil
+		}
+		return series.ForEach(func(_, v []byte) error {
+			ts := time.Unix(0, int64(binary.BigEndian.Uint64(v[0:8])))
+			if ts.Before(from) || ts.After(to) {
+				return nil
+			}
+			samples = append(samples, models.Sample{Timestamp: ts, Value: decodeFloat(v[8:16])})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
@@ -0,0 +1,251 @@
+package repository
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tenant"
+)
+
+// conformanceStorage — то, что проверяет общий набор тестов: Storage с атомарным батчем
+type conformanceStorage interface {
+	Storage
+	BatchUpdater
+}
+
+// runStorageConformance прогоняет общий набор тестов хранилища. newStorage вызывается
+// на каждый подтест и должен возвращать пустое хранилище.
+func runStorageConformance(t *testing.T, newStorage func(t *testing.T) conformanceStorage) {
+	ctx := context.Background()
+	delta := func(v int64) *int64 { return &v }
+	value := func(v float64) *float64 { return &v }
+
+	t.Run("CounterAccumulates", func(t *testing.T) {
+		s := newStorage(t)
+		s.UpdateCounter(ctx, "PollCount", 2)
+		s.UpdateCounter(ctx, "PollCount", 3)
+		require.NoError(t, s.UpdateBatch(ctx, []models.Metrics{
+			{ID: "PollCount", MType: models.Counter, Delta: delta(5)},
+			{ID: "PollCount", MType: models.Counter, Delta: delta(-1)},
+		}))
+
+		v, ok := s.GetCounter(ctx, "PollCount")
+		assert.True(t, ok)
+		assert.Equal(t, int64(9), v)
+	})
+
+	t.Run("GaugeOverwrites", func(t *testing.T) {
+		s := newStorage(t)
+		s.UpdateGauge(ctx, "Alloc", 1.5)
+		s.UpdateGauge(ctx, "Alloc", -2.25)
+		v, ok := s.GetGauge(ctx, "Alloc")
+		assert.True(t, ok)
+		assert.Equal(t, -2.25, v)
+
+		// в батче побеждает последнее значение
+		require.NoError(t, s.UpdateBatch(ctx, []models.Metrics{
+			{ID: "Alloc", MType: models.Gauge, Value: value(3)},
+			{ID: "Alloc", MType: models.Gauge, Value: value(0)},
+		}))
+		v, ok = s.GetGauge(ctx, "Alloc")
+		assert.True(t, ok)
+		assert.Equal(t, 0.0, v)
+	})
+
+	t.Run("LabelsAndTenantsAreSeparateSeries", func(t *testing.T) {
+		s := newStorage(t)
+		ctxA := tenant.WithTenant(ctx, tenant.Tenant{ID: "team-a"})
+		require.NoError(t, s.UpdateBatch(ctx, []models.Metrics{
+			{ID: "Free", MType: models.Gauge, Value: value(1)},
+			{ID: "Free", MType: models.Gauge, Value: value(2), Labels: map[string]string{"mount": "/"}},
+		}))
+		s.UpdateCounter(ctxA, "PollCount", 4)
+
+		gauges, counters := s.GetAllMetrics(ctx)
+		assert.Equal(t, map[string]float64{"Free": 1, `Free{mount="/"}`: 2}, gauges)
+		assert.Empty(t, counters)
+		gauges, counters = s.GetAllMetrics(ctxA)
+		assert.Empty(t, gauges)
+		assert.Equal(t, map[string]int64{"PollCount": 4}, counters)
+	})
+
+	t.Run("BatchAndSingleUpdatesShareSeriesKey", func(t *testing.T) {
+		s := newStorage(t)
+		// ID с метками в нотации ключа серии — та же серия, что и ID с картой меток
+		s.UpdateCounter(ctx, `Reads{disk="sda"}`, 1)
+		require.NoError(t, s.UpdateBatch(ctx, []models.Metrics{
+			{ID: `Reads{disk="sda"}`, MType: models.Counter, Delta: delta(2)},
+			{ID: "Reads", MType: models.Counter, Delta: delta(4), Labels: map[string]string{"disk": "sda"}},
+		}))
+
+		_, counters := s.GetAllMetrics(ctx)
+		assert.Equal(t, map[string]int64{`Reads{disk="sda"}`: 7}, counters)
+	})
+
+	t.Run("BatchIsAtomic", func(t *testing.T) {
+		s := newStorage(t)
+		s.UpdateCounter(ctx, "PollCount", 1)
+		s.UpdateGauge(ctx, "Alloc", 1)
+
+		// последняя метрика невалидна: число бакетов не соответствует границам
+		err := s.UpdateBatch(ctx, []models.Metrics{
+			{ID: "PollCount", MType: models.Counter, Delta: delta(10)},
+			{ID: "Alloc", MType: models.Gauge, Value: value(10)},
+			{ID: "New", MType: models.Gauge, Value: value(10)},
+			{ID: "H", MType: models.Histogram, Histogram: &models.HistogramData{Bounds: []float64{1}, Counts: []uint64{1}}},
+		})
+		assert.Error(t, err)
+
+		c, _ := s.GetCounter(ctx, "PollCount")
+		assert.Equal(t, int64(1), c)
+		g, _ := s.GetGauge(ctx, "Alloc")
+		assert.Equal(t, 1.0, g)
+		_, ok := s.GetGauge(ctx, "New")
+		assert.False(t, ok)
+	})
+
+	t.Run("MissingMetrics", func(t *testing.T) {
+		s := newStorage(t)
+		_, ok := s.GetGauge(ctx, "Unknown")
+		assert.False(t, ok)
+		_, ok = s.GetCounter(ctx, "Unknown")
+		assert.False(t, ok)
+
+		// одноимённые метрики разных типов не смешиваются
+		s.UpdateGauge(ctx, "Mixed", 1)
+		_, ok = s.GetCounter(ctx, "Mixed")
+		assert.False(t, ok)
+
+		gauges, counters := newStorage(t).GetAllMetrics(ctx)
+		assert.NotNil(t, gauges)
+		assert.NotNil(t, counters)
+		assert.Empty(t, gauges)
+		assert.Empty(t, counters)
+	})
+
+	t.Run("ConcurrentWriters", func(t *testing.T) {
+		s := newStorage(t)
+		const writers, perWriter = 8, 25
+
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < perWriter; j++ {
+					if j%2 == 0 {
+						s.UpdateCounter(ctx, "PollCount", 1)
+						continue
+					}
+					assert.NoError(t, s.UpdateBatch(ctx, []models.Metrics{
+						{ID: "PollCount", MType: models.Counter, Delta: delta(1)},
+						{ID: "Alloc", MType: models.Gauge, Value: value(float64(j))},
+					}))
+				}
+			}()
+		}
+		wg.Wait()
+
+		c, ok := s.GetCounter(ctx, "PollCount")
+		assert.True(t, ok)
+		assert.Equal(t, int64(writers*perWriter), c)
+		_, ok = s.GetGauge(ctx, "Alloc")
+		assert.True(t, ok)
+	})
+
+	t.Run("HistoryIsBounded", func(t *testing.T) {
+		s := newStorage(t)
+		hr, ok := s.(HistoryReader)
+		if !ok {
+			t.Skip("storage has no history")
+		}
+		for i := 0; i < DefaultHistoryLimit+5; i++ {
+			s.UpdateGauge(ctx, "Alloc", float64(i))
+		}
+
+		// отдаются только последние DefaultHistoryLimit точек, в хронологическом порядке
+		samples, err := hr.GetHistory(ctx, models.Gauge, "Alloc", time.Time{}, time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		require.Len(t, samples, DefaultHistoryLimit)
+		assert.Equal(t, 5.0, samples[0].Value)
+		assert.Equal(t, float64(DefaultHistoryLimit+4), samples[len(samples)-1].Value)
+	})
+
+	t.Run("SummaryMerges", func(t *testing.T) {
+		s, ok := newStorage(t).(SummaryStorage)
+		require.True(t, ok)
+		quantiles := func(p50, p99 float64) []models.Quantile {
+			return []models.Quantile{{Quantile: 0.5, Value: p50}, {Quantile: 0.99, Value: p99}}
+		}
+
+		require.NoError(t, s.UpdateSummary(ctx, "Latency", &models.SummaryData{Count: 2, Sum: 3, Quantiles: quantiles(1, 2)}))
+		require.NoError(t, s.(BatchUpdater).UpdateBatch(ctx, []models.Metrics{
+			{ID: "Latency", MType: models.Summary, Summary: &models.SummaryData{Count: 3, Sum: 4, Quantiles: quantiles(1.5, 2.5)}},
+		}))
+		// интервал без наблюдений квантили не затирает
+		require.NoError(t, s.UpdateSummary(ctx, "Latency", &models.SummaryData{Quantiles: quantiles(0, 0)}))
+
+		want := &models.SummaryData{Count: 5, Sum: 7, Quantiles: quantiles(1.5, 2.5)}
+		got, ok := s.GetSummary(ctx, "Latency")
+		require.True(t, ok)
+		assert.Equal(t, want, got)
+		assert.Equal(t, map[string]*models.SummaryData{"Latency": want}, s.GetAllSummaries(ctx))
+
+		// другой набор квантилей не сливается и ничего не меняет
+		err := s.UpdateSummary(ctx, "Latency", &models.SummaryData{Count: 1, Sum: 1, Quantiles: []models.Quantile{{Quantile: 0.9, Value: 1}}})
+		assert.ErrorIs(t, err, models.ErrQuantilesMismatch)
+		assert.ErrorIs(t, err, models.ErrBoundsMismatch)
+		got, _ = s.GetSummary(ctx, "Latency")
+		assert.Equal(t, want, got)
+
+		_, ok = s.GetSummary(ctx, "Unknown")
+		assert.False(t, ok)
+	})
+
+	t.Run("GetAllMetricsIsolation", func(t *testing.T) {
+		s := newStorage(t)
+		s.UpdateGauge(ctx, "Alloc", 1)
+		s.UpdateCounter(ctx, "PollCount", 1)
+
+		// изменения возвращённых карт не попадают в хранилище
+		gauges, counters := s.GetAllMetrics(ctx)
+		gauges["Alloc"] = 100
+		gauges["Injected"] = 1
+		counters["PollCount"] = 100
+		g, _ := s.GetGauge(ctx, "Alloc")
+		assert.Equal(t, 1.0, g)
+		_, ok := s.GetGauge(ctx, "Injected")
+		assert.False(t, ok)
+		c, _ := s.GetCounter(ctx, "PollCount")
+		assert.Equal(t, int64(1), c)
+
+		// и наоборот: последующие записи не меняют уже выданные карты
+		gauges, counters = s.GetAllMetrics(ctx)
+		s.UpdateGauge(ctx, "Alloc", 2)
+		s.UpdateCounter(ctx, "PollCount", 1)
+		assert.Equal(t, map[string]float64{"Alloc": 1}, gauges)
+		assert.Equal(t, map[string]int64{"PollCount": 1}, counters)
+	})
+}
+
+func TestMemStorageConformance(t *testing.T) {
+	runStorageConformance(t, func(t *testing.T) conformanceStorage {
+		return NewMemStorage()
+	})
+}
+
+func TestBoltStorageConformance(t *testing.T) {
+	runStorageConformance(t, func(t *testing.T) conformanceStorage {
+		s, err := NewBoltStorage(filepath.Join(t.TempDir(), "metrics.bolt"))
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// DefaultHistoryLimit — сколько последних точек хранилища держат для каждой метрики.
+const DefaultHistoryLimit = 1024
+
+// ErrUnknownMetricType возвращается, если запрошен неизвестный тип метрики.
+var ErrUnknownMetricType = errors.New("unknown metric type")
+
+// HistoryReader — опциональное расширение хранилища: чтение истории метрики.
+// Возвращает точки в хронологическом порядке, from и to включительно.
+type HistoryReader interface {
+	GetHistory(ctx context.Context, mtype, name string, from, to time.Time) ([]models.Sample, error)
+}
+
+// sampleRing — кольцевой буфер фиксированного размера: новые точки вытесняют самые старые.
+type sampleRing struct {
+	buf  []models.Sample
+	next int
+	full bool
+}
+
+func newSampleRing(size int) *sampleRing {
+	if size < 1 {
+		size = 1
+	}
+	return &sampleRing{buf: make([]models.Sample, size)}
+}
+
+func (r *sampleRing) push(s models.Sample) {
+	r.buf[r.next] = s
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// between возвращает копию точек из интервала [from, to] от старых к новым.
+func (r *sampleRing) between(from, to time.Time) []models.Sample {
+	var ordered []models.Sample
+	if r.full {
+		ordered = append(ordered, r.buf[r.next:]...)
+	}
+	ordered = append(ordered, r.buf[:r.next]...)
+
+	res := make([]models.Sample, 0, len(ordered))
+	for _, s := range ordered {
+		if s.Timestamp.Before(from) || s.Timestamp.After(to) {
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
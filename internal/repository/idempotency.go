@@ -0,0 +1,19 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// DefaultIdempotencyTTL — сколько хранилища помнят применённые ключи идемпотентности.
+// Агент повторяет запрос в пределах секунд, так что сутки — с большим запасом.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// IdempotentBatchUpdater — опциональное расширение: батч с ключом идемпотентности
+// применяется не больше одного раза. applied=false — батч с этим ключом уже был применён
+// раньше и сейчас ничего не изменилось. Если применить батч не удалось, ключ не запоминается.
+type IdempotentBatchUpdater interface {
+	UpdateBatchOnce(ctx context.Context, idemKey string, batch []models.Metrics) (applied bool, err error)
+}
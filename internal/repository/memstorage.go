@@ -2,14 +2,12 @@ package repository
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
 	"io/fs"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tenant"
 )
 
 // Storage описывает поведение хранилища метрик
@@ -26,121 +24,496 @@ type BatchUpdater interface {
 	UpdateBatch(ctx context.Context, batch []models.Metrics) error
 }
 
-// MemStorage реализует интерфейс Storage. хранилища в памяти
+// Опциональное расширение: одиночные изменения, которые сообщают, что запись не удалась
+// (журнал, синхронный снимок, база), чтобы клиент не получил успешный ответ на потерянное изменение.
+// UpdateGauge и UpdateCounter таких хранилищ только пишут ошибку в лог.
+type CheckedUpdater interface {
+	UpdateGaugeChecked(ctx context.Context, name string, value float64) error
+	UpdateCounterChecked(ctx context.Context, name string, delta int64) error
+}
+
+// UpdateGauge устанавливает gauge и возвращает ошибку записи, если хранилище умеет её сообщить
+func UpdateGauge(ctx context.Context, s Storage, name string, value float64) error {
+	if cu, ok := s.(CheckedUpdater); ok {
+		return cu.UpdateGaugeChecked(ctx, name, value)
+	}
+	s.UpdateGauge(ctx, name, value)
+	return nil
+}
+
+// UpdateCounter увеличивает counter и возвращает ошибку записи, если хранилище умеет её сообщить
+func UpdateCounter(ctx context.Context, s Storage, name string, delta int64) error {
+	if cu, ok := s.(CheckedUpdater); ok {
+		return cu.UpdateCounterChecked(ctx, name, delta)
+	}
+	s.UpdateCounter(ctx, name, delta)
+	return nil
+}
+
+// Опциональное расширение: хранение гистограмм. Наблюдения сливаются с уже накопленными,
+// гистограмма с другими границами бакетов отклоняется ошибкой models.ErrBoundsMismatch.
+type HistogramStorage interface {
+	UpdateHistogram(ctx context.Context, name string, h *models.HistogramData) error
+	GetHistogram(ctx context.Context, name string) (*models.HistogramData, bool)
+	GetAllHistograms(ctx context.Context) map[string]*models.HistogramData
+}
+
+// Опциональное расширение: хранение сводок (summary). Число и сумма наблюдений копятся,
+// квантили заменяются присланными; сводка с другим набором квантилей отклоняется
+// ошибкой models.ErrQuantilesMismatch.
+type SummaryStorage interface {
+	UpdateSummary(ctx context.Context, name string, sm *models.SummaryData) error
+	GetSummary(ctx context.Context, name string) (*models.SummaryData, bool)
+	GetAllSummaries(ctx context.Context) map[string]*models.SummaryData
+}
+
+// MemStorage реализует интерфейс Storage. хранилища в памяти.
+// Метрики разделены по арендаторам (tenant.IDFromContext): у каждого свой набор серий.
 type MemStorage struct {
-	mu       sync.RWMutex
-	gauges   map[string]float64
-	counters map[string]int64
+	mu         sync.RWMutex
+	partitions map[string]*memPartition
+
+	// история значений: по кольцевому буферу на каждую метрику
+	historyLimit int
+
+	// сколько помнить ключи идемпотентности
+	idemTTL time.Duration
+
+	// синхронная запись снимка на каждое изменение (nil — выключена, см. EnableSyncStore)
+	syncer *syncWriter
+
+	// снимки: сколько поколений хранить, права файлов; saveMu упорядочивает записи
+	snapshotKeep int
+	snapshotPerm fs.FileMode
+	saveMu       sync.Mutex
+	// когда поколения сдвигались в последний раз (см. saveSnapshot)
+	rotatedAt time.Time
+
+	// журнал изменений (nil — выключен, см. OpenWAL) и Seq последней его записи,
+	// вошедшей в восстановленный снимок
+	wal            *writeAheadLog
+	snapshotWALSeq uint64
+}
+
+// memPartition — метрики одного арендатора
+type memPartition struct {
+	gauges     map[string]float64
+	counters   map[string]int64
+	histograms map[string]*models.HistogramData
+	summaries  map[string]*models.SummaryData
+
+	gaugeHistory   map[string]*sampleRing
+	counterHistory map[string]*sampleRing
+
+	// применённые ключи идемпотентности и время применения
+	idemKeys    map[string]time.Time
+	idemSweptAt time.Time
+}
+
+func newMemPartition() *memPartition {
+	return &memPartition{
+		gauges:         make(map[string]float64),
+		counters:       make(map[string]int64),
+		histograms:     make(map[string]*models.HistogramData),
+		summaries:      make(map[string]*models.SummaryData),
+		gaugeHistory:   make(map[string]*sampleRing),
+		counterHistory: make(map[string]*sampleRing),
+		idemKeys:       make(map[string]time.Time),
+	}
 }
 
+// emptyPartition отдаётся на чтение арендаторам, которые ещё ничего не записали
+var emptyPartition = newMemPartition()
+
 // NewMemStorage создаёт новое хранилище
 func NewMemStorage() *MemStorage {
 	return &MemStorage{
-		gauges:   make(map[string]float64),
-		counters: make(map[string]int64),
+		partitions:   make(map[string]*memPartition),
+		historyLimit: DefaultHistoryLimit,
+		idemTTL:      DefaultIdempotencyTTL,
+		snapshotKeep: DefaultSnapshotKeep,
+		snapshotPerm: DefaultSnapshotPerm,
+	}
+}
+
+// readPartition возвращает раздел арендатора для чтения; вызывать под s.mu.RLock
+func (s *MemStorage) readPartition(ctx context.Context) *memPartition {
+	if p, ok := s.partitions[tenant.IDFromContext(ctx)]; ok {
+		return p
 	}
+	return emptyPartition
+}
+
+// writePartition возвращает (создавая при необходимости) раздел арендатора; вызывать под s.mu.Lock
+func (s *MemStorage) writePartition(tenantID string) *memPartition {
+	p, ok := s.partitions[tenantID]
+	if !ok {
+		p = newMemPartition()
+		s.partitions[tenantID] = p
+	}
+	return p
+}
+
+// UpdateGauge устанавливает значение метрики типа gauge; ошибка записи только логируется (см. UpdateGaugeChecked)
+func (s *MemStorage) UpdateGauge(ctx context.Context, name string, value float64) {
+	_ = s.UpdateGaugeChecked(ctx, name, value)
+}
+
+// UpdateCounter увеличивает значение метрики типа counter; ошибка записи только логируется (см. UpdateCounterChecked)
+func (s *MemStorage) UpdateCounter(ctx context.Context, name string, value int64) {
+	_ = s.UpdateCounterChecked(ctx, name, value)
 }
 
-// UpdateGauge устанавливает значение метрики типа gauge
-func (s *MemStorage) UpdateGauge(_ context.Context, name string, value float64) {
+// UpdateGaugeChecked устанавливает значение gauge. Как и батч, изменение без записи в журнал
+// не применяется, иначе после сбоя оно бы молча пропало. Возвращается и ошибка журнала, и ошибка
+// persist (fsync журнала, синхронный снимок): тогда изменение уже в памяти, но на диск не попало.
+func (s *MemStorage) UpdateGaugeChecked(ctx context.Context, name string, value float64) error {
+	tenantID := tenant.IDFromContext(ctx)
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.gauges[name] = value
+	seq, err := s.logWAL(walRecord{Tenant: tenantID, Metrics: []models.Metrics{{ID: name, MType: "gauge", Value: &value}}})
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.setGauge(s.writePartition(tenantID), name, value, time.Now())
+	s.mu.Unlock()
+	return s.persist(seq)
 }
 
-// UpdateCounter увеличивает значение метрики типа counter
-func (s *MemStorage) UpdateCounter(_ context.Context, name string, value int64) {
+// UpdateCounterChecked увеличивает значение counter; ошибки — как у UpdateGaugeChecked
+func (s *MemStorage) UpdateCounterChecked(ctx context.Context, name string, value int64) error {
+	tenantID := tenant.IDFromContext(ctx)
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.counters[name] += value
+	seq, err := s.logWAL(walRecord{Tenant: tenantID, Metrics: []models.Metrics{{ID: name, MType: "counter", Delta: &value}}})
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.addCounter(s.writePartition(tenantID), name, value, time.Now())
+	s.mu.Unlock()
+	return s.persist(seq)
+}
+
+// setGauge и addCounter применяют изменение и пишут точку в историю; вызывать под s.mu.Lock
+func (s *MemStorage) setGauge(p *memPartition, name string, value float64, ts time.Time) {
+	p.gauges[name] = value
+	s.historyRing(p.gaugeHistory, name).push(models.Sample{Timestamp: ts, Value: value})
+}
+
+func (s *MemStorage) addCounter(p *memPartition, name string, delta int64, ts time.Time) {
+	p.counters[name] += delta
+	s.historyRing(p.counterHistory, name).push(models.Sample{Timestamp: ts, Value: float64(delta)})
+}
+
+func (s *MemStorage) historyRing(rings map[string]*sampleRing, name string) *sampleRing {
+	r, ok := rings[name]
+	if !ok {
+		r = newSampleRing(s.historyLimit)
+		rings[name] = r
+	}
+	return r
+}
+
+// GetHistory возвращает точки метрики за интервал [from, to] из кольцевого буфера
+func (s *MemStorage) GetHistory(ctx context.Context, mtype, name string, from, to time.Time) ([]models.Sample, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p := s.readPartition(ctx)
+	var rings map[string]*sampleRing
+	switch mtype {
+	case models.Gauge:
+		rings = p.gaugeHistory
+	case models.Counter:
+		rings = p.counterHistory
+	default:
+		return nil, ErrUnknownMetricType
+	}
+
+	r, ok := rings[name]
+	if !ok {
+		return []models.Sample{}, nil
+	}
+	return r.between(from, to), nil
 }
 
-func (s *MemStorage) GetGauge(_ context.Context, name string) (float64, bool) {
+func (s *MemStorage) GetGauge(ctx context.Context, name string) (float64, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	val, ok := s.gauges[name]
+	val, ok := s.readPartition(ctx).gauges[name]
 	return val, ok
 }
 
-func (s *MemStorage) GetCounter(_ context.Context, name string) (int64, bool) {
+func (s *MemStorage) GetCounter(ctx context.Context, name string) (int64, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	val, ok := s.counters[name]
+	val, ok := s.readPartition(ctx).counters[name]
 	return val, ok
 }
 
-func (s *MemStorage) GetAllMetrics(_ context.Context) (map[string]float64, map[string]int64) {
+func (s *MemStorage) GetAllMetrics(ctx context.Context) (map[string]float64, map[string]int64) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	p := s.readPartition(ctx)
+
 	// создаём копии, чтобы не отдавать оригинальные мапы
-	gaugeCopy := make(map[string]float64, len(s.gauges))
-	for k, v := range s.gauges {
+	gaugeCopy := make(map[string]float64, len(p.gauges))
+	for k, v := range p.gauges {
 		gaugeCopy[k] = v
 	}
-	counterCopy := make(map[string]int64, len(s.counters))
-	for k, v := range s.counters {
+	counterCopy := make(map[string]int64, len(p.counters))
+	for k, v := range p.counters {
 		counterCopy[k] = v
 	}
 	return gaugeCopy, counterCopy
 }
 
-func (s *MemStorage) SaveToFile(filename string) error {
+// UpdateHistogram сливает наблюдения h с накопленной гистограммой
+func (s *MemStorage) UpdateHistogram(ctx context.Context, name string, h *models.HistogramData) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	seq, err := s.updateHistogram(ctx, name, h)
+	if err != nil {
+		return err
+	}
+	return s.persist(seq)
+}
+
+func (s *MemStorage) updateHistogram(ctx context.Context, name string, h *models.HistogramData) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenantID := tenant.IDFromContext(ctx)
+	p := s.writePartition(tenantID)
+	cur, ok := p.histograms[name]
+	if ok && !cur.SameBounds(h) {
+		return 0, models.ErrBoundsMismatch
+	}
+	seq, err := s.logWAL(walRecord{Tenant: tenantID, Metrics: []models.Metrics{{ID: name, MType: models.Histogram, Histogram: h}}})
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		p.histograms[name] = h.Clone()
+		return seq, nil
+	}
+	return seq, cur.Merge(h)
+}
+
+func (s *MemStorage) GetHistogram(ctx context.Context, name string) (*models.HistogramData, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	h, ok := s.readPartition(ctx).histograms[name]
+	if !ok {
+		return nil, false
+	}
+	return h.Clone(), true
+}
+
+func (s *MemStorage) GetAllHistograms(ctx context.Context) map[string]*models.HistogramData {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p := s.readPartition(ctx)
+	res := make(map[string]*models.HistogramData, len(p.histograms))
+	for k, h := range p.histograms {
+		res[k] = h.Clone()
+	}
+	return res
+}
 
-	var metrics []models.Metrics
-	for id, value := range s.gauges {
-		val := value
-		metrics = append(metrics, models.Metrics{
-			ID:    id,
-			MType: "gauge",
-			Value: &val,
-		})
-	}
-	for id, delta := range s.counters {
-		d := delta
-		metrics = append(metrics, models.Metrics{
-			ID:    id,
-			MType: "counter",
-			Delta: &d,
-		})
-	}
-
-	data, err := json.MarshalIndent(metrics, "", "  ")
+// UpdateSummary сливает сводку sm с накопленной
+func (s *MemStorage) UpdateSummary(ctx context.Context, name string, sm *models.SummaryData) error {
+	if err := sm.Validate(); err != nil {
+		return err
+	}
+	seq, err := s.updateSummary(ctx, name, sm)
 	if err != nil {
 		return err
 	}
-
-	return os.WriteFile(filename, data, fs.FileMode(0666))
+	return s.persist(seq)
 }
 
-func (s *MemStorage) LoadFromFile(filename string) error {
+func (s *MemStorage) updateSummary(ctx context.Context, name string, sm *models.SummaryData) (uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	data, err := os.ReadFile(filename)
+	tenantID := tenant.IDFromContext(ctx)
+	p := s.writePartition(tenantID)
+	cur, ok := p.summaries[name]
+	if ok && !cur.SameQuantiles(sm) {
+		return 0, models.ErrQuantilesMismatch
+	}
+	seq, err := s.logWAL(walRecord{Tenant: tenantID, Metrics: []models.Metrics{{ID: name, MType: models.Summary, Summary: sm}}})
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return nil // если файла нет — это не ошибка
-		}
+		return 0, err
+	}
+	if !ok {
+		p.summaries[name] = sm.Clone()
+		return seq, nil
+	}
+	return seq, cur.Merge(sm)
+}
+
+func (s *MemStorage) GetSummary(ctx context.Context, name string) (*models.SummaryData, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sm, ok := s.readPartition(ctx).summaries[name]
+	if !ok {
+		return nil, false
+	}
+	return sm.Clone(), true
+}
+
+func (s *MemStorage) GetAllSummaries(ctx context.Context) map[string]*models.SummaryData {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p := s.readPartition(ctx)
+	res := make(map[string]*models.SummaryData, len(p.summaries))
+	for k, sm := range p.summaries {
+		res[k] = sm.Clone()
+	}
+	return res
+}
+
+// snapshotRecord — запись файла снапшота: метрика и её арендатор.
+// Поля models.Metrics встраиваются, так что файлы без арендаторов читаются как раньше.
+type snapshotRecord struct {
+	Tenant string `json:"tenant,omitempty"`
+	models.Metrics
+}
+
+// SaveToFile атомарно записывает снимок всех арендаторов в filename (см. writeSnapshot).
+// Предыдущие снимки остаются как filename.1, filename.2 и т.д. (см. SetSnapshotOptions).
+func (s *MemStorage) SaveToFile(filename string) error {
+	return s.saveSnapshot(filename, false)
+}
+
+// saveSynced — запись снимка на каждое изменение (см. EnableSyncStore): поколения сдвигаются
+// не чаще DefaultSnapshotRotateInterval, а между сдвигами заменяется только текущий снимок
+func (s *MemStorage) saveSynced(filename string) error {
+	return s.saveSnapshot(filename, true)
+}
+
+func (s *MemStorage) saveSnapshot(filename string, synced bool) error {
+	// записи идут по очереди: иначе более старый снимок мог бы лечь поверх нового
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	records, walSeq, err := s.snapshotRecords()
+	if err != nil {
+		return err
+	}
+	data, err := encodeSnapshot(records, walSeq)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	rotate := !synced || now.Sub(s.rotatedAt) >= DefaultSnapshotRotateInterval
+	if err := writeSnapshot(filename, data, s.snapshotKeep, s.snapshotPerm, rotate); err != nil {
 		return err
 	}
+	if rotate {
+		s.rotatedAt = now
+	}
+	// Журнал удаляется только до самого старого хранимого поколения: если новые снимки окажутся
+	// повреждены, LoadFromFile возьмёт старое, и OpenWAL докатит его журналом до текущего состояния
+	if s.wal != nil {
+		if oldest, ok := oldestGenerationWALSeq(filename, s.snapshotKeep); ok {
+			s.wal.removeSealed(oldest)
+		}
+	}
+	return nil
+}
+
+// snapshotRecords собирает записи снимка по всем арендаторам. Журнал запечатывается
+// в тот же момент, так что walSeq — последняя запись, вошедшая в снимок.
+func (s *MemStorage) snapshotRecords() (metrics []snapshotRecord, walSeq uint64, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.wal != nil {
+		if walSeq, err = s.wal.seal(); err != nil {
+			return nil, 0, err
+		}
+	}
 
-	var metrics []models.Metrics
-	if err := json.Unmarshal(data, &metrics); err != nil {
+	for tenantID, p := range s.partitions {
+		for key, value := range p.gauges {
+			val := value
+			id, labels := models.SplitSeriesKey(key)
+			metrics = append(metrics, snapshotRecord{Tenant: tenantID, Metrics: models.Metrics{
+				ID:     id,
+				MType:  "gauge",
+				Value:  &val,
+				Labels: labels,
+			}})
+		}
+		for key, delta := range p.counters {
+			d := delta
+			id, labels := models.SplitSeriesKey(key)
+			metrics = append(metrics, snapshotRecord{Tenant: tenantID, Metrics: models.Metrics{
+				ID:     id,
+				MType:  "counter",
+				Delta:  &d,
+				Labels: labels,
+			}})
+		}
+		for key, h := range p.histograms {
+			id, labels := models.SplitSeriesKey(key)
+			metrics = append(metrics, snapshotRecord{Tenant: tenantID, Metrics: models.Metrics{
+				ID:        id,
+				MType:     models.Histogram,
+				Labels:    labels,
+				Histogram: h.Clone(),
+			}})
+		}
+		for key, sm := range p.summaries {
+			id, labels := models.SplitSeriesKey(key)
+			metrics = append(metrics, snapshotRecord{Tenant: tenantID, Metrics: models.Metrics{
+				ID:      id,
+				MType:   models.Summary,
+				Labels:  labels,
+				Summary: sm.Clone(),
+			}})
+		}
+	}
+	return metrics, walSeq, nil
+}
+
+// LoadFromFile восстанавливает метрики из самого нового целого снимка: если filename
+// повреждён или не дописан, берётся filename.1 и так далее. Нет ни одного снимка — не ошибка.
+func (s *MemStorage) LoadFromFile(filename string) error {
+	metrics, walSeq, err := readSnapshot(filename, s.snapshotKeep)
+	if err != nil {
 		return err
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshotWALSeq = walSeq
+
 	for _, mtr := range metrics {
+		p := s.writePartition(mtr.Tenant)
 		switch mtr.MType {
 		case "gauge":
 			if mtr.Value != nil {
-				s.gauges[mtr.ID] = *mtr.Value
+				p.gauges[mtr.Key()] = *mtr.Value
 			}
 		case "counter":
 			if mtr.Delta != nil {
-				s.counters[mtr.ID] = *mtr.Delta
+				p.counters[mtr.Key()] = *mtr.Delta
+			}
+		case models.Histogram:
+			if mtr.Histogram != nil && mtr.Histogram.Validate() == nil {
+				p.histograms[mtr.Key()] = mtr.Histogram
+			}
+		case models.Summary:
+			if mtr.Summary != nil && mtr.Summary.Validate() == nil {
+				p.summaries[mtr.Key()] = mtr.Summary
 			}
 		}
 	}
@@ -148,33 +521,174 @@ func (s *MemStorage) LoadFromFile(filename string) error {
 	return nil
 }
 
-func (s *MemStorage) PeriodicStore(filename string, interval time.Duration) {
+// PeriodicStore сохраняет снимок в файл каждые interval, пока не отменён ctx.
+// Финальное сохранение при остановке — забота вызывающего (см. cmd/server).
+func (s *MemStorage) PeriodicStore(ctx context.Context, filename string, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		_ = s.SaveToFile(filename)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = s.SaveToFile(filename)
+		}
 	}
 }
 
 func (s *MemStorage) UpdateBatch(ctx context.Context, batch []models.Metrics) error {
+	tenantID := tenant.IDFromContext(ctx)
+	s.mu.Lock()
+	p := s.writePartition(tenantID)
+	// в журнал попадают только батчи, которые применятся: отклонённый не пишется вовсе
+	merged, err := mergeBatch(p, batch)
+	var seq uint64
+	if err == nil {
+		seq, err = s.logWAL(walRecord{Tenant: tenantID, Metrics: batch})
+	}
+	if err == nil {
+		s.applyMerged(p, batch, merged)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.persist(seq)
+}
+
+// UpdateBatchOnce применяет батч, если ключ idemKey ещё не встречался у арендатора.
+// Если батч применён, но снимок записать не удалось, возвращается applied=true и ошибка:
+// повтор с тем же ключом батч второй раз не применит.
+func (s *MemStorage) UpdateBatchOnce(ctx context.Context, idemKey string, batch []models.Metrics) (bool, error) {
+	applied, seq, err := s.updateBatchOnce(ctx, idemKey, batch)
+	if !applied || err != nil {
+		return applied, err
+	}
+	return true, s.persist(seq)
+}
+
+func (s *MemStorage) updateBatchOnce(ctx context.Context, idemKey string, batch []models.Metrics) (bool, uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	tenantID := tenant.IDFromContext(ctx)
+	p := s.writePartition(tenantID)
+	now := time.Now()
+	if at, ok := p.idemKeys[idemKey]; ok && now.Sub(at) < s.idemTTL {
+		return false, 0, nil
+	}
+	merged, err := mergeBatch(p, batch)
+	if err != nil {
+		return false, 0, err
+	}
+	// ключ пишется в журнал вместе с батчем: после восстановления повтор не применится
+	seq, err := s.logWAL(walRecord{Tenant: tenantID, IdemKey: idemKey, Metrics: batch})
+	if err != nil {
+		return false, 0, err
+	}
+	s.applyMerged(p, batch, merged)
+	// протухшие ключи вычищаем не чаще раза в минуту, чтобы карта не росла бесконечно
+	if now.Sub(p.idemSweptAt) >= time.Minute {
+		for k, at := range p.idemKeys {
+			if now.Sub(at) >= s.idemTTL {
+				delete(p.idemKeys, k)
+			}
+		}
+		p.idemSweptAt = now
+	}
+	p.idemKeys[idemKey] = now
+	return true, seq, nil
+}
+
+// applyBatch применяет батч к разделу; вызывать под s.mu.Lock
+func (s *MemStorage) applyBatch(p *memPartition, batch []models.Metrics) error {
+	merged, err := mergeBatch(p, batch)
+	if err != nil {
+		return err
+	}
+	s.applyMerged(p, batch, merged)
+	return nil
+}
+
+// mergedBatch — гистограммы и сводки батча, уже слитые с копиями текущих
+type mergedBatch struct {
+	histograms map[string]*models.HistogramData
+	summaries  map[string]*models.SummaryData
+}
+
+// mergeBatch проверяет батч и сливает его гистограммы и сводки в копии текущих: при ошибке
+// (несовпадение границ или квантилей, неверные бакеты) раздел не меняется. Вызывать под s.mu.
+func mergeBatch(p *memPartition, batch []models.Metrics) (mergedBatch, error) {
+	merged := mergedBatch{
+		histograms: make(map[string]*models.HistogramData),
+		summaries:  make(map[string]*models.SummaryData),
+	}
+	for _, met := range batch {
+		switch {
+		case met.MType == models.Histogram && met.Histogram != nil:
+			if err := met.Histogram.Validate(); err != nil {
+				return mergedBatch{}, err
+			}
+			key := met.Key()
+			h, ok := merged.histograms[key]
+			if !ok {
+				if cur, exists := p.histograms[key]; exists {
+					h = cur.Clone()
+				} else {
+					h = models.NewHistogramData(met.Histogram.Bounds)
+				}
+				merged.histograms[key] = h
+			}
+			if err := h.Merge(met.Histogram); err != nil {
+				return mergedBatch{}, err
+			}
+		case met.MType == models.Summary && met.Summary != nil:
+			if err := met.Summary.Validate(); err != nil {
+				return mergedBatch{}, err
+			}
+			key := met.Key()
+			sm, ok := merged.summaries[key]
+			if !ok {
+				cur, exists := p.summaries[key]
+				if !exists {
+					// первая сводка серии задаёт её набор квантилей
+					merged.summaries[key] = met.Summary.Clone()
+					continue
+				}
+				sm = cur.Clone()
+				merged.summaries[key] = sm
+			}
+			if err := sm.Merge(met.Summary); err != nil {
+				return mergedBatch{}, err
+			}
+		}
+	}
+	return merged, nil
+}
+
+// applyMerged применяет проверенный батч и слитые гистограммы и сводки (см. mergeBatch); вызывать под s.mu.Lock
+func (s *MemStorage) applyMerged(p *memPartition, batch []models.Metrics, merged mergedBatch) {
+	now := time.Now()
 	for _, met := range batch {
 		switch met.MType {
 		case "gauge":
 			if met.Value == nil {
 				continue
 			}
-			s.gauges[met.ID] = *met.Value
+			s.setGauge(p, met.Key(), *met.Value, now)
 		case "counter":
 			if met.Delta == nil {
 				continue
 			}
 
-			s.counters[met.ID] += *met.Delta
+			s.addCounter(p, met.Key(), *met.Delta, now)
 		}
 	}
-	return nil
+	for key, h := range merged.histograms {
+		p.histograms[key] = h
+	}
+	for key, sm := range merged.summaries {
+		p.summaries[key] = sm
+	}
 }
@@ -10,6 +10,11 @@ import (
 )
 
 func RunMigrations(dsn string) error {
+	return runMigrations(dsn, "file://migrations") // путь к миграциям относительно рабочего каталога
+}
+
+// runMigrations применяет миграции из source (URL источника golang-migrate)
+func runMigrations(dsn, source string) error {
 	db, err := sql.Open("pgx", dsn)
 	if err != nil {
 		return fmt.Errorf("failed to open DB for migration: %w", err)
@@ -22,7 +27,7 @@ func RunMigrations(dsn string) error {
 	}
 
 	m, err := migrate.NewWithDatabaseInstance(
-		"file://migrations", // путь к миграциям
+		source,
 		"postgres",
 		driver,
 	)
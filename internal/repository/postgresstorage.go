@@ -3,32 +3,120 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
 	_ "github.com/jackc/pgx/v5/stdlib"
 
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/pgerrors"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/retry"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/tenant"
 	"go.uber.org/zap"
 )
 
 type PostgresStorage struct {
 	db *sql.DB
+
+	// сколько последних точек хранится в *_samples для каждой серии, как у MemStorage
+	historyLimit int
+
+	// время последней чистки idempotency_keys и *_samples (unix-наносекунды)
+	idemPurgedAt    atomic.Int64
+	samplesPurgedAt atomic.Int64
 }
 
 func NewPostgresStorage(db *sql.DB) *PostgresStorage {
 	return &PostgresStorage{
-		db: db,
+		db:           db,
+		historyLimit: DefaultHistoryLimit,
 	}
 }
 
 var pgDelays = []time.Duration{time.Second, 3 * time.Second, 5 * time.Second}
 
+// Upsert текущего значения и запись точки в историю выполняются одним запросом (CTE),
+// поэтому значение и история не расходятся.
+// Серия определяется тройкой (tenant, name, labels); labels передаются как JSON-объект.
+const (
+	upsertGaugeQuery = `
+		WITH upd AS (
+			INSERT INTO gauge_metrics (tenant, name, labels, value)
+			VALUES ($1, $2, $3::jsonb, $4)
+			ON CONFLICT (tenant, name, labels) DO UPDATE SET value = EXCLUDED.value
+			RETURNING tenant, name, labels, value
+		)
+		INSERT INTO gauge_samples (tenant, name, labels, value)
+		SELECT tenant, name, labels, value FROM upd
+	`
+	upsertCounterQuery = `
+		WITH upd AS (
+			INSERT INTO counter_metrics (tenant, name, labels, value)
+			VALUES ($1, $2, $3::jsonb, $4)
+			ON CONFLICT (tenant, name, labels) DO UPDATE SET value = counter_metrics.value + EXCLUDED.value
+			RETURNING tenant, name, labels
+		)
+		INSERT INTO counter_samples (tenant, name, labels, delta)
+		SELECT tenant, name, labels, $4 FROM upd
+	`
+	// бакеты складываются поэлементно; при других границах строка не обновляется (0 rows affected)
+	upsertHistogramQuery = `
+		INSERT INTO histogram_metrics (tenant, name, labels, bounds, counts, sum)
+		VALUES ($1, $2, $3::jsonb, $4, $5, $6)
+		ON CONFLICT (tenant, name, labels) DO UPDATE SET
+			counts = (
+				SELECT array_agg(a + b ORDER BY i)
+				FROM unnest(histogram_metrics.counts, EXCLUDED.counts) WITH ORDINALITY AS t(a, b, i)
+			),
+			sum = histogram_metrics.sum + EXCLUDED.sum
+		WHERE histogram_metrics.bounds = EXCLUDED.bounds
+	`
+	// число и сумма копятся, квантили заменяются присланными, если за интервал были наблюдения;
+	// при другом наборе квантилей строка не обновляется (0 rows affected)
+	upsertSummaryQuery = `
+		INSERT INTO summary_metrics (tenant, name, labels, quantiles, quantile_values, count, sum)
+		VALUES ($1, $2, $3::jsonb, $4, $5, $6, $7)
+		ON CONFLICT (tenant, name, labels) DO UPDATE SET
+			quantile_values = CASE WHEN EXCLUDED.count > 0
+				THEN EXCLUDED.quantile_values ELSE summary_metrics.quantile_values END,
+			count = summary_metrics.count + EXCLUDED.count,
+			sum = summary_metrics.sum + EXCLUDED.sum
+		WHERE summary_metrics.quantiles = EXCLUDED.quantiles
+	`
+)
+
+// labelsJSON сериализует метки для колонки labels; отсутствие меток — пустой объект
+func labelsJSON(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "{}"
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// seriesArgs возвращает аргументы запроса для серии: арендатор из контекста, имя и метки в JSON
+func seriesArgs(ctx context.Context, key string) (string, string, string) {
+	name, labels := models.SplitSeriesKey(key)
+	return tenant.IDFromContext(ctx), name, labelsJSON(labels)
+}
+
+// seriesKeyFromRow собирает ключ серии из колонок name и labels
+func seriesKeyFromRow(name string, rawLabels []byte) string {
+	var labels map[string]string
+	if err := json.Unmarshal(rawLabels, &labels); err != nil {
+		return name
+	}
+	return models.SeriesKey(name, labels)
+}
+
 func (p *PostgresStorage) execWithRetry(ctx context.Context, query string, args ...any) error {
 	return retry.DoIf(ctx, pgDelays, func(ctx context.Context) error {
 		_, err := p.db.ExecContext(ctx, query, args...)
@@ -39,38 +127,52 @@ func (p *PostgresStorage) execWithRetry(ctx context.Context, query string, args
 	}, pgerrors.IsRetriable)
 }
 
-func (p *PostgresStorage) UpdateGauge(ctx context.Context, name string, value float64) {
-	if err := p.execWithRetry(ctx, `
-		INSERT INTO gauge_metrics (name, value)
-		VALUES ($1, $2)
-		ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value
-	`, name, value); err != nil {
+func (p *PostgresStorage) UpdateGauge(ctx context.Context, key string, value float64) {
+	_ = p.UpdateGaugeChecked(ctx, key, value)
+}
+
+func (p *PostgresStorage) UpdateCounter(ctx context.Context, key string, delta int64) {
+	_ = p.UpdateCounterChecked(ctx, key, delta)
+}
+
+func (p *PostgresStorage) UpdateGaugeChecked(ctx context.Context, key string, value float64) error {
+	p.purgeSamples(ctx)
+	tenantID, name, labels := seriesArgs(ctx, key)
+	if err := p.execWithRetry(ctx, upsertGaugeQuery, tenantID, name, labels, value); err != nil {
 		logger.Log.Error("update gauge failed", zap.Error(err))
+		return err
 	}
+	return nil
 }
 
-func (p *PostgresStorage) UpdateCounter(ctx context.Context, name string, delta int64) {
-	if err := p.execWithRetry(ctx, `
-		INSERT INTO counter_metrics (name, value)
-		VALUES ($1, $2)
-		ON CONFLICT (name) DO UPDATE SET value = counter_metrics.value + EXCLUDED.value
-	`, name, delta); err != nil {
+func (p *PostgresStorage) UpdateCounterChecked(ctx context.Context, key string, delta int64) error {
+	p.purgeSamples(ctx)
+	tenantID, name, labels := seriesArgs(ctx, key)
+	if err := p.execWithRetry(ctx, upsertCounterQuery, tenantID, name, labels, delta); err != nil {
 		logger.Log.Error("update counter failed", zap.Error(err))
+		return err
 	}
+	return nil
 }
 
-func (p *PostgresStorage) GetGauge(ctx context.Context, name string) (float64, bool) {
+func (p *PostgresStorage) GetGauge(ctx context.Context, key string) (float64, bool) {
+	tenantID, name, labels := seriesArgs(ctx, key)
 	var val float64
-	err := p.db.QueryRowContext(ctx, `SELECT value FROM gauge_metrics WHERE name = $1`, name).Scan(&val)
+	err := p.db.QueryRowContext(ctx, `
+		SELECT value FROM gauge_metrics WHERE tenant = $1 AND name = $2 AND labels = $3::jsonb
+	`, tenantID, name, labels).Scan(&val)
 	if errors.Is(err, sql.ErrNoRows) {
 		return 0, false
 	}
 	return val, err == nil
 }
 
-func (p *PostgresStorage) GetCounter(ctx context.Context, name string) (int64, bool) {
+func (p *PostgresStorage) GetCounter(ctx context.Context, key string) (int64, bool) {
+	tenantID, name, labels := seriesArgs(ctx, key)
 	var val int64
-	err := p.db.QueryRowContext(ctx, `SELECT value FROM counter_metrics WHERE name = $1`, name).Scan(&val)
+	err := p.db.QueryRowContext(ctx, `
+		SELECT value FROM counter_metrics WHERE tenant = $1 AND name = $2 AND labels = $3::jsonb
+	`, tenantID, name, labels).Scan(&val)
 	if errors.Is(err, sql.ErrNoRows) {
 		return 0, false
 	}
@@ -80,15 +182,17 @@ func (p *PostgresStorage) GetCounter(ctx context.Context, name string) (int64, b
 func (p *PostgresStorage) GetAllMetrics(ctx context.Context) (map[string]float64, map[string]int64) {
 	gauges := make(map[string]float64)
 	counters := make(map[string]int64)
+	tenantID := tenant.IDFromContext(ctx)
 
-	rows, err := p.db.QueryContext(ctx, `SELECT name, value FROM gauge_metrics`)
+	rows, err := p.db.QueryContext(ctx, `SELECT name, labels, value FROM gauge_metrics WHERE tenant = $1`, tenantID)
 	if err == nil {
 		defer rows.Close()
 		for rows.Next() {
 			var name string
+			var labels []byte
 			var val float64
-			if err := rows.Scan(&name, &val); err == nil {
-				gauges[name] = val
+			if err := rows.Scan(&name, &labels, &val); err == nil {
+				gauges[seriesKeyFromRow(name, labels)] = val
 			}
 			if err := rows.Err(); err != nil {
 				return nil, nil
@@ -96,14 +200,15 @@ func (p *PostgresStorage) GetAllMetrics(ctx context.Context) (map[string]float64
 		}
 	}
 
-	rows, err = p.db.QueryContext(ctx, `SELECT name, value FROM counter_metrics`)
+	rows, err = p.db.QueryContext(ctx, `SELECT name, labels, value FROM counter_metrics WHERE tenant = $1`, tenantID)
 	if err == nil {
 		defer rows.Close()
 		for rows.Next() {
 			var name string
+			var labels []byte
 			var val int64
-			if err := rows.Scan(&name, &val); err == nil {
-				counters[name] = val
+			if err := rows.Scan(&name, &labels, &val); err == nil {
+				counters[seriesKeyFromRow(name, labels)] = val
 			}
 			if err := rows.Err(); err != nil {
 				return nil, nil
@@ -115,36 +220,384 @@ func (p *PostgresStorage) GetAllMetrics(ctx context.Context) (map[string]float64
 }
 
 func (p *PostgresStorage) UpdateBatch(ctx context.Context, batch []models.Metrics) error {
+	p.purgeSamples(ctx)
+
 	tx, err := p.db.BeginTx(ctx, &sql.TxOptions{})
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
+	if err := applyBatch(ctx, tx, batch); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Ключ вставляется или, если прежняя запись старше TTL, обновляется; ноль затронутых строк —
+// ключ свежий, батч уже применён. Конкурентная вставка того же ключа ждёт завершения первой транзакции.
+const claimIdempotencyKeyQuery = `
+	INSERT INTO idempotency_keys (tenant, key) VALUES ($1, $2)
+	ON CONFLICT (tenant, key) DO UPDATE SET applied_at = now()
+	WHERE idempotency_keys.applied_at < now() - make_interval(secs => $3)`
+
+// UpdateBatchOnce применяет батч в одной транзакции с записью ключа идемпотентности
+func (p *PostgresStorage) UpdateBatchOnce(ctx context.Context, idemKey string, batch []models.Metrics) (bool, error) {
+	p.purgeIdempotencyKeys(ctx)
+	p.purgeSamples(ctx)
+
+	tx, err := p.db.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, claimIdempotencyKeyQuery,
+		tenant.IDFromContext(ctx), idemKey, DefaultIdempotencyTTL.Seconds())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	if err := applyBatch(ctx, tx, batch); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// purgeIdempotencyKeys удаляет протухшие ключи не чаще раза в минуту; ошибки не критичны
+func (p *PostgresStorage) purgeIdempotencyKeys(ctx context.Context) {
+	last := p.idemPurgedAt.Load()
+	now := time.Now().UnixNano()
+	if now-last < int64(time.Minute) || !p.idemPurgedAt.CompareAndSwap(last, now) {
+		return
+	}
+	_, _ = p.db.ExecContext(ctx,
+		`DELETE FROM idempotency_keys WHERE applied_at < now() - make_interval(secs => $1)`,
+		DefaultIdempotencyTTL.Seconds())
+}
+
+// Удаляет точки серии сверх последних $1 (по времени, при равенстве — по id)
+const trimSamplesQuery = `
+	DELETE FROM %[1]s WHERE id IN (
+		SELECT id FROM (
+			SELECT id, row_number() OVER (PARTITION BY tenant, name, labels ORDER BY ts DESC, id DESC) AS rn
+			FROM %[1]s
+		) ranked WHERE rn > $1
+	)`
+
+// purgeSamples обрезает историю до historyLimit точек на серию не чаще раза в минуту; ошибки не критичны.
+// Между чистками серия может ненадолго вырасти сверх лимита — GetHistory всё равно отдаёт не больше historyLimit точек.
+func (p *PostgresStorage) purgeSamples(ctx context.Context) {
+	last := p.samplesPurgedAt.Load()
+	now := time.Now().UnixNano()
+	if now-last < int64(time.Minute) || !p.samplesPurgedAt.CompareAndSwap(last, now) {
+		return
+	}
+	if err := p.trimSamples(ctx); err != nil {
+		logger.Log.Warn("trim history samples failed", zap.Error(err))
+	}
+}
+
+// trimSamples удаляет из gauge_samples и counter_samples точки сверх historyLimit на серию
+func (p *PostgresStorage) trimSamples(ctx context.Context) error {
+	for _, table := range []string{"gauge_samples", "counter_samples"} {
+		if _, err := p.db.ExecContext(ctx, fmt.Sprintf(trimSamplesQuery, table), p.historyLimit); err != nil {
+			return fmt.Errorf("trim %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// applyBatch пишет метрики батча в транзакции tx. Имя и метки берутся из ключа серии, как у одиночных
+// обновлений: ID без меток вида cpu{core="0"} попадает в ту же серию, что и через /update.
+func applyBatch(ctx context.Context, tx *sql.Tx, batch []models.Metrics) error {
+	var err error
 	for _, m := range batch {
+		tenantID, name, labels := seriesArgs(ctx, m.Key())
 		switch m.MType {
 		case "gauge":
 			if m.Value == nil {
 				continue
 			}
-			_, err = tx.ExecContext(ctx, `
-				INSERT INTO gauge_metrics (name, value)
-				VALUES ($1, $2)
-				ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value
-			`, m.ID, *m.Value)
+			_, err = tx.ExecContext(ctx, upsertGaugeQuery, tenantID, name, labels, *m.Value)
 		case "counter":
 			if m.Delta == nil {
 				continue
 			}
-			_, err = tx.ExecContext(ctx, `
-				INSERT INTO counter_metrics (name, value)
-				VALUES ($1, $2)
-				ON CONFLICT (name) DO UPDATE SET value = counter_metrics.value + EXCLUDED.value
-			`, m.ID, *m.Delta)
+			_, err = tx.ExecContext(ctx, upsertCounterQuery, tenantID, name, labels, *m.Delta)
+		case models.Histogram:
+			if m.Histogram == nil {
+				continue
+			}
+			if err = m.Histogram.Validate(); err == nil {
+				err = execHistogram(ctx, tx, histogramArgs(tenantID, name, labels, m.Histogram))
+			}
+		case models.Summary:
+			if m.Summary == nil {
+				continue
+			}
+			if err = m.Summary.Validate(); err == nil {
+				err = execSummary(ctx, tx, summaryArgs(tenantID, name, labels, m.Summary))
+			}
 		}
 		if err != nil {
 			return err
 		}
 	}
-	return tx.Commit()
+	return nil
+}
+
+// GetHistory возвращает точки метрики за интервал [from, to] из таблиц *_samples.
+// Как и у MemStorage, отдаётся не больше historyLimit последних точек.
+func (p *PostgresStorage) GetHistory(ctx context.Context, mtype, key string, from, to time.Time) ([]models.Sample, error) {
+	var query string
+	switch mtype {
+	case models.Gauge:
+		query = `SELECT ts, value FROM (
+			SELECT id, ts, value FROM gauge_samples
+			WHERE tenant = $1 AND name = $2 AND labels = $3::jsonb AND ts BETWEEN $4 AND $5
+			ORDER BY ts DESC, id DESC LIMIT $6
+		) last ORDER BY ts, id`
+	case models.Counter:
+		query = `SELECT ts, delta FROM (
+			SELECT id, ts, delta FROM counter_samples
+			WHERE tenant = $1 AND name = $2 AND labels = $3::jsonb AND ts BETWEEN $4 AND $5
+			ORDER BY ts DESC, id DESC LIMIT $6
+		) last ORDER BY ts, id`
+	default:
+		return nil, ErrUnknownMetricType
+	}
+
+	tenantID, name, labels := seriesArgs(ctx, key)
+	rows, err := p.db.QueryContext(ctx, query, tenantID, name, labels, from, to, p.historyLimit)
+	if err != nil {
+		return nil, fmt.Errorf("query history: %w", err)
+	}
+	defer rows.Close()
+
+	samples := make([]models.Sample, 0)
+	for rows.Next() {
+		var s models.Sample
+		if err := rows.Scan(&s.Timestamp, &s.Value); err != nil {
+			return nil, fmt.Errorf("scan history: %w", err)
+		}
+		samples = append(samples, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read history: %w", err)
+	}
+	return samples, nil
+}
+
+// histogramArgs готовит аргументы upsertHistogramQuery
+func histogramArgs(tenantID, name, labels string, h *models.HistogramData) []any {
+	counts := make([]int64, len(h.Counts))
+	for i, c := range h.Counts {
+		counts[i] = int64(c)
+	}
+	return []any{tenantID, name, labels, h.Bounds, counts, h.Sum}
+}
+
+// execHistogram выполняет upsert гистограммы; ни одной затронутой строки — значит границы не совпали
+func execHistogram(ctx context.Context, ex interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}, args []any) error {
+	res, err := ex.ExecContext(ctx, upsertHistogramQuery, args...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", "pg exec", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrBoundsMismatch
+	}
+	return nil
+}
+
+// UpdateHistogram сливает наблюдения h с гистограммой в histogram_metrics
+func (p *PostgresStorage) UpdateHistogram(ctx context.Context, key string, h *models.HistogramData) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	tenantID, name, labels := seriesArgs(ctx, key)
+	args := histogramArgs(tenantID, name, labels, h)
+	return retry.DoIf(ctx, pgDelays, func(ctx context.Context) error {
+		return execHistogram(ctx, p.db, args)
+	}, pgerrors.IsRetriable)
+}
+
+func (p *PostgresStorage) GetHistogram(ctx context.Context, key string) (*models.HistogramData, bool) {
+	tenantID, name, labels := seriesArgs(ctx, key)
+	var bounds, counts []byte
+	var sum float64
+	err := p.db.QueryRowContext(ctx, `
+		SELECT to_jsonb(bounds), to_jsonb(counts), sum FROM histogram_metrics
+		WHERE tenant = $1 AND name = $2 AND labels = $3::jsonb
+	`, tenantID, name, labels).Scan(&bounds, &counts, &sum)
+	if err != nil {
+		return nil, false
+	}
+	h, err := histogramFromRow(bounds, counts, sum)
+	if err != nil {
+		return nil, false
+	}
+	return h, true
+}
+
+func (p *PostgresStorage) GetAllHistograms(ctx context.Context) map[string]*models.HistogramData {
+	res := make(map[string]*models.HistogramData)
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT name, labels, to_jsonb(bounds), to_jsonb(counts), sum FROM histogram_metrics
+		WHERE tenant = $1
+	`, tenant.IDFromContext(ctx))
+	if err != nil {
+		return res
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var labels, bounds, counts []byte
+		var sum float64
+		if err := rows.Scan(&name, &labels, &bounds, &counts, &sum); err != nil {
+			continue
+		}
+		if h, err := histogramFromRow(bounds, counts, sum); err == nil {
+			res[seriesKeyFromRow(name, labels)] = h
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logger.Log.Error("read histograms failed", zap.Error(err))
+	}
+	return res
+}
+
+// массивы читаем через to_jsonb, чтобы не зависеть от поддержки массивов в database/sql
+func histogramFromRow(bounds, counts []byte, sum float64) (*models.HistogramData, error) {
+	h := &models.HistogramData{Sum: sum}
+	if err := json.Unmarshal(bounds, &h.Bounds); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(counts, &h.Counts); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// summaryArgs готовит аргументы upsertSummaryQuery
+func summaryArgs(tenantID, name, labels string, sm *models.SummaryData) []any {
+	quantiles := make([]float64, len(sm.Quantiles))
+	values := make([]float64, len(sm.Quantiles))
+	for i, q := range sm.Quantiles {
+		quantiles[i], values[i] = q.Quantile, q.Value
+	}
+	return []any{tenantID, name, labels, quantiles, values, int64(sm.Count), sm.Sum}
+}
+
+// execSummary выполняет upsert сводки; ни одной затронутой строки — значит квантили не совпали
+func execSummary(ctx context.Context, ex interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}, args []any) error {
+	res, err := ex.ExecContext(ctx, upsertSummaryQuery, args...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", "pg exec", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrQuantilesMismatch
+	}
+	return nil
+}
+
+// UpdateSummary сливает сводку sm со строкой summary_metrics
+func (p *PostgresStorage) UpdateSummary(ctx context.Context, key string, sm *models.SummaryData) error {
+	if err := sm.Validate(); err != nil {
+		return err
+	}
+	tenantID, name, labels := seriesArgs(ctx, key)
+	args := summaryArgs(tenantID, name, labels, sm)
+	return retry.DoIf(ctx, pgDelays, func(ctx context.Context) error {
+		return execSummary(ctx, p.db, args)
+	}, pgerrors.IsRetriable)
+}
+
+func (p *PostgresStorage) GetSummary(ctx context.Context, key string) (*models.SummaryData, bool) {
+	tenantID, name, labels := seriesArgs(ctx, key)
+	var quantiles, values []byte
+	var count int64
+	var sum float64
+	err := p.db.QueryRowContext(ctx, `
+		SELECT to_jsonb(quantiles), to_jsonb(quantile_values), count, sum FROM summary_metrics
+		WHERE tenant = $1 AND name = $2 AND labels = $3::jsonb
+	`, tenantID, name, labels).Scan(&quantiles, &values, &count, &sum)
+	if err != nil {
+		return nil, false
+	}
+	sm, err := summaryFromRow(quantiles, values, count, sum)
+	if err != nil {
+		return nil, false
+	}
+	return sm, true
+}
+
+func (p *PostgresStorage) GetAllSummaries(ctx context.Context) map[string]*models.SummaryData {
+	res := make(map[string]*models.SummaryData)
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT name, labels, to_jsonb(quantiles), to_jsonb(quantile_values), count, sum FROM summary_metrics
+		WHERE tenant = $1
+	`, tenant.IDFromContext(ctx))
+	if err != nil {
+		return res
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var labels, quantiles, values []byte
+		var count int64
+		var sum float64
+		if err := rows.Scan(&name, &labels, &quantiles, &values, &count, &sum); err != nil {
+			continue
+		}
+		if sm, err := summaryFromRow(quantiles, values, count, sum); err == nil {
+			res[seriesKeyFromRow(name, labels)] = sm
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logger.Log.Error("read summaries failed", zap.Error(err))
+	}
+	return res
+}
+
+func summaryFromRow(quantiles, values []byte, count int64, sum float64) (*models.SummaryData, error) {
+	var qs, vs []float64
+	if err := json.Unmarshal(quantiles, &qs); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(values, &vs); err != nil {
+		return nil, err
+	}
+	if len(qs) != len(vs) {
+		return nil, fmt.Errorf("summary has %d quantiles but %d values", len(qs), len(vs))
+	}
+	sm := &models.SummaryData{Count: uint64(count), Sum: sum, Quantiles: make([]models.Quantile, len(qs))}
+	for i := range qs {
+		sm.Quantiles[i] = models.Quantile{Quantile: qs[i], Value: vs[i]}
+	}
+	return sm, nil
 }
@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// findPostgresBin ищет initdb и pg_ctl: в каталоге PG_BIN, затем в PATH,
+// затем в стандартных каталогах пакетов Debian/Ubuntu
+func findPostgresBin() (initdb, pgCtl string, ok bool) {
+	var dirs []string
+	if dir := os.Getenv("PG_BIN"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	if path, err := exec.LookPath("initdb"); err == nil {
+		dirs = append(dirs, filepath.Dir(path))
+	}
+	if matches, err := filepath.Glob("/usr/lib/postgresql/*/bin"); err == nil {
+		dirs = append(dirs, matches...)
+	}
+	for _, dir := range dirs {
+		initdb, pgCtl = filepath.Join(dir, "initdb"), filepath.Join(dir, "pg_ctl")
+		if _, err := os.Stat(initdb); err != nil {
+			continue
+		}
+		if _, err := os.Stat(pgCtl); err == nil {
+			return initdb, pgCtl, true
+		}
+	}
+	return "", "", false
+}
+
+// startLocalPostgres запускает временный кластер PostgreSQL, слушающий только unix-сокет,
+// применяет миграции и возвращает DSN. Кластер останавливается и удаляется по окончании теста.
+// Без установленного PostgreSQL тест пропускается.
+func startLocalPostgres(t *testing.T) string {
+	t.Helper()
+	initdb, pgCtl, ok := findPostgresBin()
+	if !ok {
+		t.Skip("initdb/pg_ctl not found; set PG_BIN to run PostgresStorage tests")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("postgres refuses to run as root")
+	}
+
+	dataDir := t.TempDir()
+	// путь к сокету ограничен ~100 байтами, а t.TempDir() бывает длинным
+	sockDir, err := os.MkdirTemp("", "pg")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(sockDir) })
+
+	run := func(name string, args ...string) {
+		out, err := exec.Command(name, args...).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	run(initdb, "-D", dataDir, "-U", "postgres", "-A", "trust", "--no-sync")
+	run(pgCtl, "-D", dataDir, "-l", filepath.Join(dataDir, "server.log"), "-w",
+		"-o", "-k "+sockDir+" -c listen_addresses= -F", "start")
+	t.Cleanup(func() {
+		_ = exec.Command(pgCtl, "-D", dataDir, "-m", "immediate", "-w", "stop").Run()
+	})
+
+	dsn := "host=" + sockDir + " user=postgres dbname=postgres sslmode=disable"
+	require.NoError(t, runMigrations(dsn, "file://../../migrations"))
+	return dsn
+}
+
+func TestPostgresStorageConformance(t *testing.T) {
+	dsn := startLocalPostgres(t)
+	db, err := sql.Open("pgx", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	runStorageConformance(t, func(t *testing.T) conformanceStorage {
+		_, err := db.Exec(`TRUNCATE gauge_metrics, counter_metrics, gauge_samples, counter_samples,
+			histogram_metrics, summary_metrics, idempotency_keys`)
+		require.NoError(t, err)
+		return NewPostgresStorage(db)
+	})
+}
+
+func TestPostgresStorage_TrimSamples(t *testing.T) {
+	dsn := startLocalPostgres(t)
+	db, err := sql.Open("pgx", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	ctx := context.Background()
+	p := NewPostgresStorage(db)
+	p.historyLimit = 3
+	for i := 0; i < 5; i++ {
+		p.UpdateGauge(ctx, "Alloc", float64(i))
+		p.UpdateCounter(ctx, "PollCount", int64(i))
+	}
+	p.UpdateGauge(ctx, `Alloc{core="0"}`, 1)
+	require.NoError(t, p.trimSamples(ctx))
+
+	count := func(query string) int {
+		var n int
+		require.NoError(t, db.QueryRow(query).Scan(&n))
+		return n
+	}
+	// лимит действует на каждую серию отдельно и оставляет самые свежие точки
+	assert.Equal(t, 4, count(`SELECT count(*) FROM gauge_samples`))
+	assert.Equal(t, 3, count(`SELECT count(*) FROM counter_samples`))
+	assert.Equal(t, 2, count(`SELECT min(value)::int FROM gauge_samples WHERE labels = '{}'::jsonb`))
+}
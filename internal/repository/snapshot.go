@@ -0,0 +1,244 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+)
+
+const (
+	// DefaultSnapshotKeep — сколько поколений снимка хранить, считая текущий
+	DefaultSnapshotKeep = 3
+	// DefaultSnapshotPerm — права файлов снимка
+	DefaultSnapshotPerm fs.FileMode = 0o644
+	// DefaultSnapshotRotateInterval — синхронная запись (STORE_INTERVAL=0) сдвигает поколения не чаще,
+	// иначе все поколения оказались бы снимками с разницей в миллисекунды
+	DefaultSnapshotRotateInterval = time.Minute
+)
+
+const snapshotVersion = 1
+
+// errSnapshotChecksum — содержимое снимка не совпадает с записанной контрольной суммой
+var errSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+// snapshotFile — формат файла снимка: записи и SHA-256 от их компактного JSON.
+// Файлы старого формата (просто массив записей) читаются без проверки суммы.
+type snapshotFile struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	WALSeq   uint64          `json:"wal_seq,omitempty"` // последняя запись журнала, вошедшая в снимок
+	Metrics  json.RawMessage `json:"metrics"`
+}
+
+// SetSnapshotOptions задаёт число хранимых поколений снимка (не меньше 1) и права его файлов
+func (s *MemStorage) SetSnapshotOptions(keep int, perm fs.FileMode) {
+	if keep < 1 {
+		keep = 1
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.snapshotKeep = keep
+	s.snapshotPerm = perm
+}
+
+// generationPath — путь к поколению снимка: 0 — сам filename, i — filename.i
+func generationPath(filename string, i int) string {
+	if i == 0 {
+		return filename
+	}
+	return filename + "." + strconv.Itoa(i)
+}
+
+func encodeSnapshot(records []snapshotRecord, walSeq uint64) ([]byte, error) {
+	metrics, err := json.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(metrics)
+	return json.Marshal(snapshotFile{
+		Version:  snapshotVersion,
+		Checksum: hex.EncodeToString(sum[:]),
+		WALSeq:   walSeq,
+		Metrics:  metrics,
+	})
+}
+
+func decodeSnapshot(data []byte) ([]snapshotRecord, uint64, error) {
+	var records []snapshotRecord
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '[' {
+		// старый формат без контрольной суммы
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, 0, err
+		}
+		return records, 0, nil
+	}
+
+	var f snapshotFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, 0, err
+	}
+	if f.Version != snapshotVersion {
+		return nil, 0, fmt.Errorf("unsupported snapshot version %d", f.Version)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, f.Metrics); err != nil {
+		return nil, 0, err
+	}
+	sum := sha256.Sum256(compact.Bytes())
+	if hex.EncodeToString(sum[:]) != f.Checksum {
+		return nil, 0, errSnapshotChecksum
+	}
+	if err := json.Unmarshal(compact.Bytes(), &records); err != nil {
+		return nil, 0, err
+	}
+	return records, f.WALSeq, nil
+}
+
+// writeSnapshot пишет data во временный файл рядом с filename, сбрасывает его на диск
+// и переименованием ставит на место filename. С rotate прежние поколения сдвигаются:
+// filename → filename.1 → filename.2 …, всего остаётся keep файлов; без rotate заменяется
+// только filename. Если процесс упадёт между сдвигом и переименованием, readSnapshot возьмёт filename.1.
+func writeSnapshot(filename string, data []byte, keep int, perm fs.FileMode, rotate bool) error {
+	dir := filepath.Dir(filename)
+	tmp, err := os.CreateTemp(dir, filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(tmpName)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	for i := keep - 1; rotate && i >= 1; i-- {
+		if err := os.Rename(generationPath(filename, i-1), generationPath(filename, i)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(tmpName, filename); err != nil {
+		return err
+	}
+	committed = true
+
+	// переименования попадут на диск только вместе с каталогом
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// oldestGenerationWALSeq возвращает наименьший WALSeq среди поколений снимка filename:
+// журнал после него нужен, чтобы восстановиться и из самого старого поколения.
+// Поколения, у которых заголовок не читается, для восстановления непригодны и не учитываются.
+func oldestGenerationWALSeq(filename string, keep int) (uint64, bool) {
+	var oldest uint64
+	found := false
+	for i := 0; i < keep || i == 0; i++ {
+		seq, err := readSnapshotWALSeq(generationPath(filename, i))
+		if err != nil {
+			continue
+		}
+		if !found || seq < oldest {
+			oldest, found = seq, true
+		}
+	}
+	return oldest, found
+}
+
+// readSnapshotWALSeq читает WALSeq из заголовка файла снимка, не разбирая записи:
+// encodeSnapshot пишет wal_seq перед metrics. У файлов старого формата и снимков без журнала — 0.
+func readSnapshotWALSeq(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return 0, nil
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return 0, err
+		}
+		switch key {
+		case "wal_seq":
+			var seq uint64
+			err := dec.Decode(&seq)
+			return seq, err
+		case "metrics":
+			return 0, nil
+		}
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+// readSnapshot читает самый новый целый снимок из поколений filename. Повреждённые
+// пропускаются с предупреждением; если нет ни одного файла, возвращает nil без ошибки.
+func readSnapshot(filename string, keep int) ([]snapshotRecord, uint64, error) {
+	var firstErr error
+	for i := 0; i < keep || i == 0; i++ {
+		path := generationPath(filename, i)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			records, walSeq, decodeErr := decodeSnapshot(data)
+			if decodeErr == nil {
+				if firstErr != nil {
+					logger.Log.Warn("restored metrics from an older snapshot", zap.String("path", path))
+				}
+				return records, walSeq, nil
+			}
+			err = decodeErr
+		}
+		logger.Log.Warn("skipping unreadable snapshot", zap.String("path", path), zap.Error(err))
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil, 0, firstErr
+}
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncStoreRotatesGenerationsByAge(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+	exists := func(i int) bool {
+		_, err := os.Stat(generationPath(snapshot, i))
+		return err == nil
+	}
+	counterIn := func(i int) int64 {
+		s := NewMemStorage()
+		require.NoError(t, s.LoadFromFile(generationPath(snapshot, i)))
+		v, _ := s.GetCounter(ctx, "PollCount")
+		return v
+	}
+
+	s := NewMemStorage()
+	s.EnableSyncStore(snapshot)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, s.UpdateCounterChecked(ctx, "PollCount", 1))
+	}
+	// частые синхронные записи заменяют текущий снимок, а не сдвигают поколения
+	assert.True(t, exists(0))
+	assert.False(t, exists(1))
+	assert.Equal(t, int64(5), counterIn(0))
+
+	// периодическое (или финальное) сохранение сдвигает поколения всегда
+	require.NoError(t, s.SaveToFile(snapshot))
+	assert.True(t, exists(1))
+	require.NoError(t, s.UpdateCounterChecked(ctx, "PollCount", 1))
+	assert.False(t, exists(2))
+
+	// прошло DefaultSnapshotRotateInterval — синхронная запись тоже начинает новое поколение
+	s.rotatedAt = time.Now().Add(-DefaultSnapshotRotateInterval)
+	require.NoError(t, s.UpdateCounterChecked(ctx, "PollCount", 1))
+	assert.True(t, exists(2))
+	assert.Equal(t, int64(7), counterIn(0))
+	assert.Equal(t, int64(6), counterIn(1))
+	assert.Equal(t, int64(5), counterIn(2))
+}
@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+)
+
+// syncWriter — синхронная запись снимка MemStorage после каждого изменения (STORE_INTERVAL=0).
+// Одновременные изменения объединяются: пока идёт запись, остальные ждут её окончания,
+// и следующая запись покрывает их все разом, а не переписывает файл на каждое.
+type syncWriter struct {
+	path string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	changes uint64 // номер последнего изменения
+	saved   uint64 // изменения с номерами до saved включительно уже на диске
+	saving  bool   // запись идёт прямо сейчас
+}
+
+func newSyncWriter(path string) *syncWriter {
+	w := &syncWriter{path: path}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// commit регистрирует изменение, уже применённое в памяти, и возвращается, когда снимок,
+// включающий его, записан на диск. save вызывается не больше чем одной горутиной одновременно.
+func (w *syncWriter) commit(save func(filename string) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.changes++
+	gen := w.changes
+	for w.saved < gen {
+		if w.saving {
+			w.cond.Wait()
+			continue
+		}
+		// снимок будет сделан после этой точки, значит, покроет все изменения до target
+		target := w.changes
+		w.saving = true
+		w.mu.Unlock()
+		err := save(w.path)
+		w.mu.Lock()
+		w.saving = false
+		w.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		w.saved = target
+	}
+	return nil
+}
+
+// EnableSyncStore включает синхронную запись: каждое изменение сохраняется в filename
+// до возврата из UpdateGauge, UpdateCounter, UpdateHistogram, UpdateSummary и UpdateBatch.
+// Вызывать до начала обслуживания запросов (после LoadFromFile).
+func (s *MemStorage) EnableSyncStore(filename string) {
+	s.syncer = newSyncWriter(filename)
+}
+
+// persist делает изменение долговечным: ждёт fsync журнала до записи seq (WALSyncAlways)
+// и запись снимка, если включена синхронная запись; вызывать без s.mu
+func (s *MemStorage) persist(seq uint64) error {
+	if seq > 0 && s.wal.policy == WALSyncAlways {
+		if err := s.wal.syncUpTo(seq); err != nil {
+			logger.Log.Error("wal sync failed", zap.String("path", s.wal.path), zap.Error(err))
+			return err
+		}
+	}
+	if s.syncer == nil {
+		return nil
+	}
+	if err := s.syncer.commit(s.saveSynced); err != nil {
+		logger.Log.Error("failed to save metrics snapshot", zap.String("path", s.syncer.path), zap.Error(err))
+		return err
+	}
+	return nil
+}
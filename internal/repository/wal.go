@@ -0,0 +1,395 @@
+package repository
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// WALSyncPolicy — когда журнал сбрасывается на диск (fsync)
+type WALSyncPolicy string
+
+const (
+	// WALSyncAlways — перед возвратом из каждого изменения; одновременные изменения делят один fsync
+	WALSyncAlways WALSyncPolicy = "always"
+	// WALSyncBatch — в фоне раз в DefaultWALSyncInterval: при сбое теряется не больше интервала
+	WALSyncBatch WALSyncPolicy = "batch"
+	// WALSyncNone — сброс на усмотрение ОС: переживает падение процесса, но не ОС
+	WALSyncNone WALSyncPolicy = "none"
+)
+
+// DefaultWALSyncInterval — период фонового fsync в режиме WALSyncBatch
+const DefaultWALSyncInterval = 100 * time.Millisecond
+
+// ParseWALSyncPolicy разбирает значение флага -wal-sync; пустая строка — WALSyncBatch
+func ParseWALSyncPolicy(s string) (WALSyncPolicy, error) {
+	switch p := WALSyncPolicy(s); p {
+	case "":
+		return WALSyncBatch, nil
+	case WALSyncAlways, WALSyncBatch, WALSyncNone:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown WAL sync policy %q (want always, batch or none)", s)
+}
+
+// walRecord — одна запись журнала: изменения одного арендатора, применяемые вместе.
+// Seq растёт монотонно; снимок помнит последний вошедший в него Seq (см. snapshotFile.WALSeq).
+type walRecord struct {
+	Seq     uint64           `json:"seq"`
+	Tenant  string           `json:"tenant,omitempty"`
+	IdemKey string           `json:"idem_key,omitempty"`
+	Metrics []models.Metrics `json:"metrics"`
+}
+
+// walHeaderSize — заголовок записи: длина полезной нагрузки и её CRC32, little-endian
+const walHeaderSize = 8
+
+// walMaxRecord — больше этого длина в заголовке может быть только мусором
+const walMaxRecord = 64 << 20
+
+// writeAheadLog — журнал изменений MemStorage. Активный сегмент лежит в path; при снимке
+// он запечатывается в path.<последний Seq> и начинается новый (см. seal). Запечатанные
+// сегменты удаляются, когда их покрывают все хранимые поколения снимка (см. removeSealed).
+type writeAheadLog struct {
+	path   string
+	policy WALSyncPolicy
+
+	mu     sync.Mutex
+	f      *os.File
+	seq    uint64 // Seq последней записи
+	synced uint64 // записи до synced включительно сброшены на диск
+
+	syncMu sync.Mutex // один fsync за раз; ждущие получают результат чужого
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// appendRecord дописывает запись, присваивая ей следующий Seq
+func (w *writeAheadLog) appendRecord(rec walRecord) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	rec.Seq = w.seq + 1
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[walHeaderSize:], payload)
+	if _, err := w.f.Write(buf); err != nil {
+		return 0, err
+	}
+	w.seq = rec.Seq
+	return rec.Seq, nil
+}
+
+// syncUpTo дожидается, пока записи до seq включительно окажутся на диске
+func (w *writeAheadLog) syncUpTo(seq uint64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	w.mu.Lock()
+	if w.synced >= seq {
+		w.mu.Unlock()
+		return nil
+	}
+	f, target := w.f, w.seq
+	w.mu.Unlock()
+
+	err := f.Sync()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		// сегмент мог быть запечатан (и сброшен) параллельно — тогда записи уже на диске
+		if w.synced >= seq {
+			return nil
+		}
+		return err
+	}
+	if target > w.synced {
+		w.synced = target
+	}
+	return nil
+}
+
+// syncLoop — фоновый fsync для WALSyncBatch
+func (w *writeAheadLog) syncLoop(interval time.Duration) {
+	defer close(w.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-t.C:
+			w.mu.Lock()
+			seq := w.seq
+			w.mu.Unlock()
+			if err := w.syncUpTo(seq); err != nil {
+				logger.Log.Error("wal sync failed", zap.String("path", w.path), zap.Error(err))
+			}
+		}
+	}
+}
+
+// renameFile — os.Rename; подменяется в тестах, чтобы проверить отказ при запечатывании
+var renameFile = os.Rename
+
+// seal закрывает активный сегмент под именем path.<Seq> и открывает новый.
+// Возвращает Seq последней записи: всё до него включительно войдёт в снимок.
+// При ошибке журнал остаётся рабочим: запись продолжается в прежний активный сегмент.
+func (w *writeAheadLog) seal() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.f.Sync(); err != nil {
+		return 0, err
+	}
+	w.synced = w.seq
+	// пустой сегмент запечатывать незачем
+	if info, err := w.f.Stat(); err == nil && info.Size() == 0 {
+		return w.seq, nil
+	}
+	if err := w.f.Close(); err != nil {
+		return 0, w.reopen(err)
+	}
+	sealed := w.path + "." + strconv.FormatUint(w.seq, 10)
+	if err := renameFile(w.path, sealed); err != nil {
+		return 0, w.reopen(err)
+	}
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, DefaultSnapshotPerm)
+	if err != nil {
+		// возвращаем сегмент на место, чтобы дописывать в него
+		if rerr := renameFile(sealed, w.path); rerr != nil {
+			return 0, errors.Join(err, rerr)
+		}
+		return 0, w.reopen(err)
+	}
+	w.f = f
+	return w.seq, nil
+}
+
+// reopen снова открывает активный сегмент после неудачного seal и возвращает cause
+// (вместе с ошибкой открытия, если не вышло и оно)
+func (w *writeAheadLog) reopen(cause error) error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, DefaultSnapshotPerm)
+	if err != nil {
+		logger.Log.Error("cannot reopen wal segment", zap.String("path", w.path), zap.Error(err))
+		return errors.Join(cause, err)
+	}
+	w.f = f
+	return cause
+}
+
+// removeSealed удаляет запечатанные сегменты, целиком покрытые снимком с upTo
+func (w *writeAheadLog) removeSealed(upTo uint64) {
+	segments, err := sealedSegments(w.path)
+	if err != nil {
+		logger.Log.Warn("cannot list wal segments", zap.Error(err))
+		return
+	}
+	for _, seg := range segments {
+		if seg.last <= upTo {
+			if err := os.Remove(seg.path); err != nil {
+				logger.Log.Warn("cannot remove wal segment", zap.String("path", seg.path), zap.Error(err))
+			}
+		}
+	}
+}
+
+func (w *writeAheadLog) close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+type walSegment struct {
+	path string
+	last uint64 // Seq последней записи сегмента
+}
+
+// sealedSegments возвращает запечатанные сегменты журнала path по возрастанию Seq
+func sealedSegments(path string) ([]walSegment, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var segments []walSegment
+	for _, m := range matches {
+		last, err := strconv.ParseUint(strings.TrimPrefix(m, path+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, walSegment{path: m, last: last})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].last < segments[j].last })
+	return segments, nil
+}
+
+// readWALSegment читает записи сегмента. Недописанная или повреждённая запись
+// (падение посреди записи) и всё после неё отбрасываются; good — длина целой части.
+func readWALSegment(path string, fn func(walRecord)) (good int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Log.Warn("wal: torn record header, discarding tail", zap.String("path", path), zap.Int64("offset", good))
+			}
+			return good, nil
+		}
+		size := binary.LittleEndian.Uint32(header[0:4])
+		if size > walMaxRecord {
+			logger.Log.Warn("wal: corrupt record header, discarding tail", zap.String("path", path), zap.Int64("offset", good))
+			return good, nil
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(f, payload); err != nil {
+			logger.Log.Warn("wal: torn record, discarding tail", zap.String("path", path), zap.Int64("offset", good))
+			return good, nil
+		}
+		var rec walRecord
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) || json.Unmarshal(payload, &rec) != nil {
+			logger.Log.Warn("wal: corrupt record, discarding tail", zap.String("path", path), zap.Int64("offset", good))
+			return good, nil
+		}
+		fn(rec)
+		good += int64(walHeaderSize) + int64(size)
+	}
+}
+
+// OpenWAL включает журнал изменений в path. Записи новее последнего восстановленного снимка
+// (см. LoadFromFile) применяются поверх него, если replay; иначе старый журнал отбрасывается.
+// Вызывать до начала обслуживания запросов; при снимке журнал обрезается (см. SaveToFile).
+func (s *MemStorage) OpenWAL(path string, policy WALSyncPolicy, replay bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments, err := sealedSegments(path)
+	if err != nil {
+		return err
+	}
+	files := make([]string, 0, len(segments)+1)
+	for _, seg := range segments {
+		files = append(files, seg.path)
+	}
+	files = append(files, path)
+
+	lastSeq := s.snapshotWALSeq
+	var replayed int
+	for _, name := range files {
+		good, err := readWALSegment(name, func(rec walRecord) {
+			if rec.Seq > lastSeq {
+				lastSeq = rec.Seq
+			}
+			if !replay || rec.Seq <= s.snapshotWALSeq {
+				return // уже в снимке
+			}
+			s.replayWALRecord(rec)
+			replayed++
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// хвост активного сегмента обрезаем, чтобы новые записи не шли после мусора
+		if name == path {
+			if err := os.Truncate(path, good); err != nil {
+				return err
+			}
+		}
+	}
+	if !replay {
+		for _, seg := range segments {
+			_ = os.Remove(seg.path)
+		}
+		if err := os.Truncate(path, 0); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if replayed > 0 {
+		logger.Log.Info("wal replayed", zap.String("path", path), zap.Int("records", replayed))
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, DefaultSnapshotPerm)
+	if err != nil {
+		return err
+	}
+	w := &writeAheadLog{path: path, policy: policy, f: f, seq: lastSeq, synced: lastSeq}
+	if policy == WALSyncBatch {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncLoop(DefaultWALSyncInterval)
+	}
+	s.wal = w
+	return nil
+}
+
+// CloseWAL сбрасывает журнал на диск и закрывает его; изменения после этого не журналируются
+// и завершаются ошибкой записи, так что вызывать после остановки обработки запросов
+func (s *MemStorage) CloseWAL() error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.close()
+}
+
+// replayWALRecord применяет запись журнала; вызывать под s.mu.Lock
+func (s *MemStorage) replayWALRecord(rec walRecord) {
+	p := s.writePartition(rec.Tenant)
+	if err := s.applyBatch(p, rec.Metrics); err != nil {
+		// в журнал пишутся только применившиеся изменения: отказ здесь — расхождение со снимком или порча
+		logger.Log.Error("wal record skipped", zap.Uint64("seq", rec.Seq), zap.Error(err))
+		return
+	}
+	if rec.IdemKey != "" {
+		p.idemKeys[rec.IdemKey] = time.Now()
+	}
+}
+
+// logWAL пишет запись в журнал до применения изменения; вызывать под s.mu.Lock.
+// Без журнала возвращает 0.
+func (s *MemStorage) logWAL(rec walRecord) (uint64, error) {
+	if s.wal == nil {
+		return 0, nil
+	}
+	seq, err := s.wal.appendRecord(rec)
+	if err != nil {
+		logger.Log.Error("wal append failed", zap.String("path", s.wal.path), zap.Error(err))
+		return 0, err
+	}
+	return seq, nil
+}
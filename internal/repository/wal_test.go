@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+func TestWALSealRenameFailure(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, "metrics.json")
+	walPath := filepath.Join(dir, "metrics.wal")
+	ctx := context.Background()
+
+	s := NewMemStorage()
+	require.NoError(t, s.OpenWAL(walPath, WALSyncAlways, true))
+	s.UpdateCounter(ctx, "PollCount", 1)
+
+	// сегмент не удалось запечатать: снимок не записан, но журнал продолжает принимать записи
+	renameFile = func(string, string) error { return errors.New("rename failed") }
+	assert.Error(t, s.SaveToFile(snapshot))
+	renameFile = os.Rename
+	s.UpdateCounter(ctx, "PollCount", 2)
+	require.NoError(t, s.CloseWAL())
+
+	restored := NewMemStorage()
+	require.NoError(t, restored.OpenWAL(walPath, WALSyncAlways, true))
+	v, _ := restored.GetCounter(ctx, "PollCount")
+	assert.Equal(t, int64(3), v)
+
+	// следующий снимок запечатывает сегмент как обычно
+	require.NoError(t, restored.SaveToFile(snapshot))
+	restored.UpdateCounter(ctx, "PollCount", 4)
+	require.NoError(t, restored.CloseWAL())
+
+	again := NewMemStorage()
+	require.NoError(t, again.LoadFromFile(snapshot))
+	require.NoError(t, again.OpenWAL(walPath, WALSyncAlways, true))
+	v, _ = again.GetCounter(ctx, "PollCount")
+	assert.Equal(t, int64(7), v)
+	require.NoError(t, again.CloseWAL())
+}
+
+func TestWALSkipsRejectedBatches(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "metrics.wal")
+	ctx := context.Background()
+	one := int64(1)
+	histogram := func(bounds ...float64) models.Metrics {
+		return models.Metrics{ID: "latency", MType: models.Histogram, Histogram: &models.HistogramData{
+			Bounds: bounds, Counts: make([]uint64, len(bounds)+1),
+		}}
+	}
+
+	s := NewMemStorage()
+	require.NoError(t, s.OpenWAL(walPath, WALSyncAlways, true))
+	require.NoError(t, s.UpdateBatch(ctx, []models.Metrics{histogram(1, 2)}))
+
+	// батч с другими границами отклоняется целиком и в журнал не попадает
+	bad := []models.Metrics{{ID: "PollCount", MType: models.Counter, Delta: &one}, histogram(5)}
+	assert.ErrorIs(t, s.UpdateBatch(ctx, bad), models.ErrBoundsMismatch)
+	_, err := s.UpdateBatchOnce(ctx, "key-1", bad)
+	assert.ErrorIs(t, err, models.ErrBoundsMismatch)
+	require.NoError(t, s.CloseWAL())
+
+	var records int
+	_, err = readWALSegment(walPath, func(walRecord) { records++ })
+	require.NoError(t, err)
+	assert.Equal(t, 1, records)
+}
@@ -0,0 +1,106 @@
+// Package tenant описывает арендаторов (команды), между которыми разделены метрики и ключи подписи.
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Header — заголовок, в котором агент передаёт идентификатор арендатора
+const Header = "X-Tenant-ID"
+
+// Default — арендатор по умолчанию: запросы без заголовка, подписанные общим ключом -k
+const Default = ""
+
+// Tenant — арендатор запроса и его ключ HMAC
+type Tenant struct {
+	ID  string
+	Key string
+}
+
+type ctxKey struct{}
+
+// WithTenant кладёт арендатора в контекст запроса
+func WithTenant(ctx context.Context, t Tenant) context.Context {
+	return context.WithValue(ctx, ctxKey{}, t)
+}
+
+// FromContext возвращает арендатора из контекста; без арендатора — Default с пустым ключом
+func FromContext(ctx context.Context) Tenant {
+	t, _ := ctx.Value(ctxKey{}).(Tenant)
+	return t
+}
+
+// IDFromContext — сокращение для FromContext(ctx).ID, используется хранилищами
+func IDFromContext(ctx context.Context) string {
+	return FromContext(ctx).ID
+}
+
+// KeyOr возвращает ключ арендатора из контекста, а если арендатор не определён — fallback
+func KeyOr(ctx context.Context, fallback string) string {
+	if t, ok := ctx.Value(ctxKey{}).(Tenant); ok {
+		return t.Key
+	}
+	return fallback
+}
+
+// Registry хранит ключи арендаторов
+type Registry struct {
+	defaultKey string
+	keys       map[string]string
+}
+
+// NewRegistry создаёт реестр: defaultKey — ключ арендатора по умолчанию, keys — ключи остальных
+func NewRegistry(defaultKey string, keys map[string]string) *Registry {
+	return &Registry{defaultKey: defaultKey, keys: keys}
+}
+
+// Lookup возвращает арендатора по идентификатору; false — арендатор не зарегистрирован
+func (r *Registry) Lookup(id string) (Tenant, bool) {
+	if id == Default {
+		return Tenant{ID: Default, Key: r.defaultKey}, true
+	}
+	key, ok := r.keys[id]
+	if !ok {
+		return Tenant{}, false
+	}
+	return Tenant{ID: id, Key: key}, true
+}
+
+// ParseKeys разбирает список "team-a:secret1,team-b:secret2"
+func ParseKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	if strings.TrimSpace(s) == "" {
+		return keys, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		id, key, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("tenant entry %q must look like id:key", pair)
+		}
+		if !ValidID(id) {
+			return nil, fmt.Errorf("invalid tenant id %q", id)
+		}
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("duplicate tenant id %q", id)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// ValidID проверяет идентификатор арендатора: 1–64 символа [a-zA-Z0-9_-]
+func ValidID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS gauge_samples (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    value DOUBLE PRECISION NOT NULL,
+    ts TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS gauge_samples_name_ts_idx ON gauge_samples (name, ts);
+
+CREATE TABLE IF NOT EXISTS counter_samples (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    delta BIGINT NOT NULL,
+    ts TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS counter_samples_name_ts_idx ON counter_samples (name, ts);
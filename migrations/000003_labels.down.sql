@@ -0,0 +1,19 @@
+DROP INDEX IF EXISTS counter_samples_series_ts_idx;
+DELETE FROM counter_samples WHERE labels <> '{}'::jsonb;
+ALTER TABLE counter_samples DROP COLUMN IF EXISTS labels;
+CREATE INDEX IF NOT EXISTS counter_samples_name_ts_idx ON counter_samples (name, ts);
+
+DROP INDEX IF EXISTS gauge_samples_series_ts_idx;
+DELETE FROM gauge_samples WHERE labels <> '{}'::jsonb;
+ALTER TABLE gauge_samples DROP COLUMN IF EXISTS labels;
+CREATE INDEX IF NOT EXISTS gauge_samples_name_ts_idx ON gauge_samples (name, ts);
+
+DELETE FROM counter_metrics WHERE labels <> '{}'::jsonb;
+ALTER TABLE counter_metrics DROP CONSTRAINT IF EXISTS counter_metrics_pkey;
+ALTER TABLE counter_metrics DROP COLUMN IF EXISTS labels;
+ALTER TABLE counter_metrics ADD CONSTRAINT counter_metrics_pkey PRIMARY KEY (name);
+
+DELETE FROM gauge_metrics WHERE labels <> '{}'::jsonb;
+ALTER TABLE gauge_metrics DROP CONSTRAINT IF EXISTS gauge_metrics_pkey;
+ALTER TABLE gauge_metrics DROP COLUMN IF EXISTS labels;
+ALTER TABLE gauge_metrics ADD CONSTRAINT gauge_metrics_pkey PRIMARY KEY (name);
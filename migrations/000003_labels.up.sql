@@ -0,0 +1,15 @@
+ALTER TABLE gauge_metrics ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}'::jsonb;
+ALTER TABLE gauge_metrics DROP CONSTRAINT IF EXISTS gauge_metrics_pkey;
+ALTER TABLE gauge_metrics ADD CONSTRAINT gauge_metrics_pkey PRIMARY KEY (name, labels);
+
+ALTER TABLE counter_metrics ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}'::jsonb;
+ALTER TABLE counter_metrics DROP CONSTRAINT IF EXISTS counter_metrics_pkey;
+ALTER TABLE counter_metrics ADD CONSTRAINT counter_metrics_pkey PRIMARY KEY (name, labels);
+
+ALTER TABLE gauge_samples ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}'::jsonb;
+DROP INDEX IF EXISTS gauge_samples_name_ts_idx;
+CREATE INDEX IF NOT EXISTS gauge_samples_series_ts_idx ON gauge_samples (name, labels, ts);
+
+ALTER TABLE counter_samples ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}'::jsonb;
+DROP INDEX IF EXISTS counter_samples_name_ts_idx;
+CREATE INDEX IF NOT EXISTS counter_samples_series_ts_idx ON counter_samples (name, labels, ts);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS histogram_metrics;
\ No newline at end of file
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS histogram_metrics (
+    name TEXT NOT NULL,
+    labels JSONB NOT NULL DEFAULT '{}'::jsonb,
+    bounds DOUBLE PRECISION[] NOT NULL,
+    counts BIGINT[] NOT NULL,
+    sum DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (name, labels)
+);
@@ -0,0 +1,24 @@
+DROP INDEX IF EXISTS counter_samples_series_ts_idx;
+DELETE FROM counter_samples WHERE tenant <> '';
+ALTER TABLE counter_samples DROP COLUMN IF EXISTS tenant;
+CREATE INDEX IF NOT EXISTS counter_samples_series_ts_idx ON counter_samples (name, labels, ts);
+
+DROP INDEX IF EXISTS gauge_samples_series_ts_idx;
+DELETE FROM gauge_samples WHERE tenant <> '';
+ALTER TABLE gauge_samples DROP COLUMN IF EXISTS tenant;
+CREATE INDEX IF NOT EXISTS gauge_samples_series_ts_idx ON gauge_samples (name, labels, ts);
+
+DELETE FROM histogram_metrics WHERE tenant <> '';
+ALTER TABLE histogram_metrics DROP CONSTRAINT IF EXISTS histogram_metrics_pkey;
+ALTER TABLE histogram_metrics DROP COLUMN IF EXISTS tenant;
+ALTER TABLE histogram_metrics ADD CONSTRAINT histogram_metrics_pkey PRIMARY KEY (name, labels);
+
+DELETE FROM counter_metrics WHERE tenant <> '';
+ALTER TABLE counter_metrics DROP CONSTRAINT IF EXISTS counter_metrics_pkey;
+ALTER TABLE counter_metrics DROP COLUMN IF EXISTS tenant;
+ALTER TABLE counter_metrics ADD CONSTRAINT counter_metrics_pkey PRIMARY KEY (name, labels);
+
+DELETE FROM gauge_metrics WHERE tenant <> '';
+ALTER TABLE gauge_metrics DROP CONSTRAINT IF EXISTS gauge_metrics_pkey;
+ALTER TABLE gauge_metrics DROP COLUMN IF EXISTS tenant;
+ALTER TABLE gauge_metrics ADD CONSTRAINT gauge_metrics_pkey PRIMARY KEY (name, labels);
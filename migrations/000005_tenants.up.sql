@@ -0,0 +1,19 @@
+ALTER TABLE gauge_metrics ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT '';
+ALTER TABLE gauge_metrics DROP CONSTRAINT IF EXISTS gauge_metrics_pkey;
+ALTER TABLE gauge_metrics ADD CONSTRAINT gauge_metrics_pkey PRIMARY KEY (tenant, name, labels);
+
+ALTER TABLE counter_metrics ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT '';
+ALTER TABLE counter_metrics DROP CONSTRAINT IF EXISTS counter_metrics_pkey;
+ALTER TABLE counter_metrics ADD CONSTRAINT counter_metrics_pkey PRIMARY KEY (tenant, name, labels);
+
+ALTER TABLE histogram_metrics ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT '';
+ALTER TABLE histogram_metrics DROP CONSTRAINT IF EXISTS histogram_metrics_pkey;
+ALTER TABLE histogram_metrics ADD CONSTRAINT histogram_metrics_pkey PRIMARY KEY (tenant, name, labels);
+
+ALTER TABLE gauge_samples ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT '';
+DROP INDEX IF EXISTS gauge_samples_series_ts_idx;
+CREATE INDEX IF NOT EXISTS gauge_samples_series_ts_idx ON gauge_samples (tenant, name, labels, ts);
+
+ALTER TABLE counter_samples ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT '';
+DROP INDEX IF EXISTS counter_samples_series_ts_idx;
+CREATE INDEX IF NOT EXISTS counter_samples_series_ts_idx ON counter_samples (tenant, name, labels, ts);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    tenant     TEXT NOT NULL DEFAULT '',
+    key        TEXT NOT NULL,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_applied_at_idx ON idempotency_keys (applied_at);
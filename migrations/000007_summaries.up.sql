@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS summary_metrics (
+    tenant TEXT NOT NULL DEFAULT '',
+    name TEXT NOT NULL,
+    labels JSONB NOT NULL DEFAULT '{}'::jsonb,
+    quantiles DOUBLE PRECISION[] NOT NULL,
+    quantile_values DOUBLE PRECISION[] NOT NULL,
+    count BIGINT NOT NULL,
+    sum DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (tenant, name, labels)
+);